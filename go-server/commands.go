@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kexxu-robotics/kex-stream-server/go-server/eventstream"
+)
+
+const commandsUsage = `usage: go-server [command]
+
+without a command the server is started
+
+commands:
+  migrate [up]          apply all pending database migrations
+  migrate down [steps]  roll back the last <steps> migrations (default 1)
+  migrate status        list the migrations and if they are applied
+  archive export <dir> [fromId=N] [toId=N] [creationTimeFrom=T] [creationTimeTo=T] [destId=ID] [segment=N]
+                        export a range of events to an archive, toId and
+                        creationTimeTo are exclusive, times in unix seconds
+  archive import <dir>  restore the events of an archive, events that are
+                        already in the store are skipped
+  archive verify <dir>  check the segments of an archive against its manifest
+  encryption reencrypt [batch=N]
+                        encrypt all payloads again with encryption: keyid:,
+                        also the payloads in plain text, with an empty keyid
+                        all payloads are decrypted, large payloads are
+                        compressed on the way with compression: codec:
+  chain heads           list the last link of every hash chain
+  chain verify [chainId] [fromSeq=N] [toSeq=N]
+                        check the hash chain of the events, without a
+                        chainId all chains, and report the first broken link
+`
+
+// runCommand runs a subcommand from the command line instead of the server
+func runCommand(args []string, store eventstream.EventStore) {
+	switch args[0] {
+	case "migrate":
+		migrator, ok := store.(eventstream.Migrator)
+		if !ok {
+			fmt.Println("the", conf.Store, "store has no database schema to migrate")
+			os.Exit(1)
+		}
+		if err := runMigrate(args[1:], migrator); err != nil {
+			fmt.Println("ERROR!", err)
+			os.Exit(1)
+		}
+	case "archive":
+		if err := runArchive(args[1:], store); err != nil {
+			fmt.Println("ERROR!", err)
+			os.Exit(1)
+		}
+	case "encryption":
+		payloadStore, ok := store.(eventstream.PayloadStore)
+		if !ok {
+			fmt.Println("the", conf.Store, "store cannot encrypt its payloads again")
+			os.Exit(1)
+		}
+		if err := runEncryption(args[1:], payloadStore); err != nil {
+			fmt.Println("ERROR!", err)
+			os.Exit(1)
+		}
+	case "chain":
+		chainStore, ok := store.(eventstream.ChainStore)
+		if !ok {
+			fmt.Println("the", conf.Store, "store has no hash chains")
+			os.Exit(1)
+		}
+		if err := runChain(args[1:], chainStore); err != nil {
+			fmt.Println("ERROR!", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Print(commandsUsage)
+		os.Exit(2)
+	}
+}
+
+func runMigrate(args []string, migrator eventstream.Migrator) error {
+	// a migration can take long on a large events table, it is not cut off
+	ctx := context.Background()
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "up":
+		applied, err := eventstream.MigrateUp(ctx, migrator)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("database schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+		rolledBack, err := eventstream.MigrateDown(ctx, migrator, steps)
+		for _, m := range rolledBack {
+			fmt.Printf("rolled back %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		status, err := eventstream.GetMigrationStatus(ctx, migrator)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + time.Unix(s.AppliedTimeUnixSec, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate action: %s", action)
+	}
+}
+
+func runArchive(args []string, store eventstream.EventStore) error {
+	if len(args) < 2 {
+		return errors.New("usage: archive export|import|verify <dir>")
+	}
+	action, dir := args[0], args[1]
+
+	switch action {
+	case "export":
+		params := make(map[string]string)
+		for _, arg := range args[2:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid argument %s, use name=value", arg)
+			}
+			params[parts[0]] = parts[1]
+		}
+		ar, segmentEvents, err := parseArchiveRange(func(name string) string {
+			value := params[name]
+			delete(params, name)
+			return value
+		})
+		if err != nil {
+			return err
+		}
+		for name := range params {
+			return fmt.Errorf("unknown argument %s", name)
+		}
+		manifest, err := eventstream.ExportArchive(context.Background(), store, conf.EventStreamId, dir, ar, segmentEvents)
+		for _, segment := range manifest.Segments {
+			fmt.Printf("exported %s: %d events, ids %d to %d\n", segment.File, segment.Events, segment.MinId, segment.MaxId)
+		}
+		if err == nil {
+			fmt.Println("exported", manifest.Events, "events to", dir)
+		}
+		return err
+	case "import":
+		report, err := eventstream.ImportArchive(context.Background(), store, dir)
+		fmt.Printf("restored %d of %d events from %d segments, %d were already saved\n", report.Restored, report.Events, report.Segments, report.Skipped)
+		return err
+	case "verify":
+		manifest, err := eventstream.VerifyArchive(dir)
+		if err == nil {
+			fmt.Println("archive is complete,", manifest.Events, "events in", len(manifest.Segments), "segments")
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown archive action: %s", action)
+	}
+}
+
+func runEncryption(args []string, store eventstream.PayloadStore) error {
+	if len(args) < 1 || args[0] != "reencrypt" {
+		return errors.New("usage: encryption reencrypt [batch=N]")
+	}
+	batchSize := 1000
+	for _, arg := range args[1:] {
+		value := strings.TrimPrefix(arg, "batch=")
+		n, err := strconv.Atoi(value)
+		if value == arg || err != nil || n < 1 {
+			return fmt.Errorf("invalid argument %s, use batch=N", arg)
+		}
+		batchSize = n
+	}
+
+	keys, err := payloadKeys()
+	if err != nil {
+		return err
+	}
+	compression, err := payloadCompression()
+	if err != nil {
+		return err
+	}
+	report, err := eventstream.ReencryptPayloads(context.Background(), store, keys, compression, batchSize)
+	if keys.KeyId == "" {
+		fmt.Printf("decrypted %d of %d events, %d were changed in the meantime\n", report.Reencrypted, report.Events, report.Skipped)
+	} else {
+		fmt.Printf("encrypted %d of %d events with key %s, %d were changed in the meantime\n", report.Reencrypted, report.Events, report.KeyId, report.Skipped)
+	}
+	return err
+}
+
+func runChain(args []string, store eventstream.ChainStore) error {
+	if len(args) < 1 || (args[0] != "heads" && args[0] != "verify") {
+		return errors.New("usage: chain heads|verify [chainId] [fromSeq=N] [toSeq=N]")
+	}
+	ctx := context.Background()
+	heads, err := store.ChainHeads(ctx)
+	if err != nil {
+		return err
+	}
+	if args[0] == "heads" {
+		for _, head := range heads {
+			fmt.Println(head.ChainId, head.Seq, head.Hash)
+		}
+		return nil
+	}
+
+	chainIds := []string{}
+	params := make(map[string]string)
+	for _, arg := range args[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) == 2 {
+			params[parts[0]] = parts[1]
+		} else {
+			chainIds = append(chainIds, arg)
+		}
+	}
+	fromSeq, toSeq, err := parseChainRange(func(name string) string {
+		value := params[name]
+		delete(params, name)
+		return value
+	})
+	if err != nil {
+		return err
+	}
+	for name := range params {
+		return fmt.Errorf("unknown argument %s", name)
+	}
+	if len(chainIds) == 0 {
+		for _, head := range heads {
+			chainIds = append(chainIds, head.ChainId)
+		}
+	}
+
+	keys, err := payloadKeys()
+	if err != nil {
+		return err
+	}
+	broken := 0
+	for _, chainId := range chainIds {
+		report, err := eventstream.VerifyChain(ctx, store, keys, chainId, fromSeq, toSeq)
+		if err != nil {
+			return err
+		}
+		if report.Broken != nil {
+			broken++
+			fmt.Printf("%s is broken at %d, event %d %s: %s\n", chainId, report.Broken.Seq, report.Broken.Id, report.Broken.EventId, report.Broken.Reason)
+			continue
+		}
+		fmt.Printf("%s is intact from %d to %d, %d events of which %d redacted, head %d %s\n", chainId, report.FromSeq, report.ToSeq, report.Events, report.Redacted, report.Head.Seq, report.Head.Hash)
+	}
+	if broken > 0 {
+		return fmt.Errorf("%d of %d chains are broken", broken, len(chainIds))
+	}
+	return nil
+}
+
+// parseChainRange reads the fromSeq and toSeq parameters, used by the chain
+// command and the /api/chains/verify endpoint
+func parseChainRange(param func(name string) string) (int64, int64, error) {
+	seqs := []int64{0, 0}
+	for i, name := range []string{"fromSeq", "toSeq"} {
+		value := param(name)
+		if value == "" {
+			continue
+		}
+		var err error
+		seqs[i], err = strconv.ParseInt(value, 10, 64)
+		if err != nil || seqs[i] < 0 {
+			return 0, 0, fmt.Errorf("%s must be a non-negative number", name)
+		}
+	}
+	return seqs[0], seqs[1], nil
+}
+
+// payloadKeys reads the master keys of the payload encryption from the conf
+func payloadKeys() (*eventstream.PayloadKeys, error) {
+	keys := &eventstream.PayloadKeys{
+		KeyId:      conf.Encryption.KeyId,
+		MasterKeys: make(map[string][]byte),
+	}
+	for keyId, encoded := range conf.Encryption.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return keys, fmt.Errorf("payload key %s is not base64", keyId)
+		}
+		keys.MasterKeys[keyId] = key
+	}
+	return keys, keys.Check()
+}
+
+// payloadCompression reads the compression of the payloads from the conf
+func payloadCompression() (*eventstream.PayloadCompression, error) {
+	compression := &eventstream.PayloadCompression{
+		Codec:    conf.Compression.Codec,
+		MinBytes: conf.Compression.MinBytes,
+	}
+	if compression.MinBytes <= 0 {
+		compression.MinBytes = 4096
+	}
+	return compression, compression.Check()
+}
+
+// parseArchiveRange reads an ArchiveRange from the parameters fromId, toId,
+// creationTimeFrom, creationTimeTo, destId and the events per segment file
+// from segment, used by the archive command and the /api/archive endpoints
+func parseArchiveRange(param func(name string) string) (eventstream.ArchiveRange, int, error) {
+	ar := eventstream.ArchiveRange{
+		DestinationId: param("destId"),
+	}
+	segmentEvents := int64(0)
+	numbers := []struct {
+		param string
+		value *int64
+	}{
+		{"fromId", &ar.FromId},
+		{"toId", &ar.ToId},
+		{"creationTimeFrom", &ar.CreationTimeFrom},
+		{"creationTimeTo", &ar.CreationTimeTo},
+		{"segment", &segmentEvents},
+	}
+	for _, n := range numbers {
+		value := param(n.param)
+		if value == "" {
+			continue
+		}
+		var err error
+		*n.value, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || *n.value < 0 {
+			return ar, 0, fmt.Errorf("%s must be a non-negative number", n.param)
+		}
+	}
+	return ar, int(segmentEvents), nil
+}
+
+// checkMigrations runs on server startup, with automigrate the pending
+// migrations are applied, otherwise the server refuses to start on an
+// outdated schema
+func checkMigrations(migrator eventstream.Migrator) {
+	ctx := context.Background()
+	if conf.AutoMigrate {
+		applied, err := eventstream.MigrateUp(ctx, migrator)
+		for _, m := range applied {
+			fmt.Printf("applied migration %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			panic(fmt.Sprintln("ERROR! database migration failed", err))
+		}
+		return
+	}
+
+	status, err := eventstream.GetMigrationStatus(ctx, migrator)
+	if err != nil {
+		panic(fmt.Sprintln("ERROR! cannot read database migrations", err))
+	}
+	for _, s := range status {
+		if !s.Applied {
+			panic(fmt.Sprintf("ERROR! database migration %04d_%s is pending, run 'go-server migrate' or set automigrate: true in conf", s.Version, s.Name))
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package eventstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AggregateQuery counts the events of a query per EventType in fixed time
+// buckets, to chart the volume of events without getting the events
+type AggregateQuery struct {
+	Query     EventQuery // the events to count, the pagination is not used
+	Bucket    string     // one of AggregateBuckets
+	EventTime bool       // bucket on EventTimeUnixSec instead of CreationTimeUnixSec
+	From      int64      // unix seconds, inclusive
+	To        int64      // unix seconds, exclusive
+	GroupBy   []string   // (optional) also count per "originId" and/or "eventSubtype"
+	ValuePath []string   // (optional) numeric payload value to get the min, max and avg of
+}
+
+// AggregateBuckets are the bucket sizes in seconds, the buckets start at
+// a multiple of their size, so a day is a UTC day
+var AggregateBuckets = map[string]int64{
+	"minute": 60,
+	"hour":   60 * 60,
+	"day":    24 * 60 * 60,
+}
+
+// AggregateMaxBuckets is the most buckets the time range can have
+const AggregateMaxBuckets = 10000
+
+// AggregateBucket is the count of one EventType in one bucket
+type AggregateBucket struct {
+	StartUnixSec int64
+	EventType    string
+	OriginId     string // only with GroupBy originId
+	EventSubtype string // only with GroupBy eventSubtype
+	Count        int64
+
+	// of the events with a number at ValuePath, nil if there are none
+	Min *float64
+	Max *float64
+	Avg *float64
+}
+
+// Check validates the query, before it is translated to SQL
+func (aq *AggregateQuery) Check() error {
+	size, ok := AggregateBuckets[aq.Bucket]
+	if !ok {
+		return fmt.Errorf("unknown bucket %q, use minute, hour or day", aq.Bucket)
+	}
+	if aq.From <= 0 {
+		return errors.New("from must be a positive unix time")
+	}
+	if aq.To <= aq.From {
+		return errors.New("the time range needs a from before to")
+	}
+	if (aq.To-aq.From)/size > AggregateMaxBuckets {
+		return fmt.Errorf("the time range cannot have more than %d buckets", AggregateMaxBuckets)
+	}
+	for _, group := range aq.GroupBy {
+		if group != "originId" && group != "eventSubtype" {
+			return fmt.Errorf("cannot group by %q, use originId or eventSubtype", group)
+		}
+	}
+	for _, key := range aq.ValuePath {
+		if key == "" {
+			return fmt.Errorf("value path %q has an empty key", strings.Join(aq.ValuePath, "."))
+		}
+	}
+	return nil
+}
+
+// payload reports if the result depends on the payloads, with payload
+// filters or a ValuePath
+func (aq *AggregateQuery) payload() bool {
+	return len(aq.Query.Payload) > 0 || len(aq.ValuePath) > 0
+}
+
+// groupBy reports if the buckets are also split on group
+func (aq *AggregateQuery) groupBy(group string) bool {
+	for _, g := range aq.GroupBy {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// query returns the EventQuery with the time range of the buckets
+func (aq *AggregateQuery) query() EventQuery {
+	q := aq.Query
+	q.NewestId, q.LastId, q.Limit = 0, 0, 0
+	if aq.EventTime {
+		q.EventTimeFrom, q.EventTimeTo = aq.From, aq.To
+	} else {
+		q.CreationTimeFrom, q.CreationTimeTo = aq.From, aq.To
+	}
+	return q
+}
+
+// sql builds the aggregation in the SQL dialect of the store
+func (aq *AggregateQuery) sql(dialect string) (string, []interface{}) {
+	a := &sqlArgs{dialect: dialect}
+
+	timeColumn := "creation_time_unix_sec"
+	if aq.EventTime {
+		timeColumn = "event_time_unix_sec"
+	}
+	// the size is one of AggregateBuckets, not user input, % keeps the sign
+	// of the time so it is made positive like bucketStart does
+	size := AggregateBuckets[aq.Bucket]
+	columns := []string{fmt.Sprintf("%s - (%s %% %d + %d) %% %d AS bucket", timeColumn, timeColumn, size, size, size), "COALESCE(event_type, '') AS event_type"}
+	groups := []string{"bucket", "event_type"}
+	if aq.groupBy("originId") {
+		columns = append(columns, "origin_id")
+		groups = append(groups, "origin_id")
+	}
+	if aq.groupBy("eventSubtype") {
+		columns = append(columns, "COALESCE(event_subtype, '') AS event_subtype")
+		groups = append(groups, "event_subtype")
+	}
+
+	value := "CAST(NULL AS double precision)"
+	if len(aq.ValuePath) > 0 {
+		if dialect == "postgres" {
+			path := a.add(aq.ValuePath) + "::text[]"
+			value = "CASE WHEN jsonb_typeof(payload_json #> " + path + ") = 'number' THEN (payload_json #>> " + path + ")::double precision END"
+		} else {
+			// SQLite calls payloadNumber, see sqlite.go
+			path, _ := json.Marshal(aq.ValuePath)
+			value = "kex_payload_number(payload_json, " + a.add(string(path)) + ")"
+		}
+	}
+	columns = append(columns, value+" AS value")
+
+	q := aq.query()
+	conditions := q.sqlConditions(a)
+
+	sql := "SELECT " + strings.Join(groups, ", ") + ", count(*), min(value), max(value), avg(value) FROM (SELECT " + strings.Join(columns, ", ") + " FROM events"
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += ") AS e GROUP BY " + strings.Join(groups, ", ") + " ORDER BY " + strings.Join(groups, ", ")
+	return sql, a.args
+}
+
+// scanFields returns the fields of b in the order of the columns of sql
+func (aq *AggregateQuery) scanFields(b *AggregateBucket) []interface{} {
+	fields := []interface{}{&b.StartUnixSec, &b.EventType}
+	if aq.groupBy("originId") {
+		fields = append(fields, &b.OriginId)
+	}
+	if aq.groupBy("eventSubtype") {
+		fields = append(fields, &b.EventSubtype)
+	}
+	return append(fields, &b.Count, &b.Min, &b.Max, &b.Avg)
+}
+
+// bucketStart returns the start of the bucket of size that holds t, also
+// for a t before 1970, where t%size is negative
+func bucketStart(t, size int64) int64 {
+	return t - (t%size+size)%size
+}
+
+// payloadNumber returns the number at path in the payload
+func payloadNumber(payload json.RawMessage, path []string) (float64, bool) {
+	root, err := decodePayload(payload)
+	if err != nil {
+		return 0, false
+	}
+	value, ok := payloadPath(root, path)
+	if !ok {
+		return 0, false
+	}
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// aggregateMessages is the aggregation of the sql of the query in Go, on
+// events that passed the filters of the query
+func (aq *AggregateQuery) aggregateMessages(ems []EventMessage) []AggregateBucket {
+	size := AggregateBuckets[aq.Bucket]
+
+	type sum struct {
+		bucket AggregateBucket
+		total  float64
+		values int64
+	}
+	sums := make(map[AggregateBucket]*sum)
+	for i := range ems {
+		em := &ems[i]
+		t := em.CreationTimeUnixSec
+		if aq.EventTime {
+			t = em.EventTimeUnixSec
+		}
+		key := AggregateBucket{StartUnixSec: bucketStart(t, size), EventType: em.EventType}
+		if aq.groupBy("originId") {
+			key.OriginId = em.OriginId
+		}
+		if aq.groupBy("eventSubtype") {
+			key.EventSubtype = em.EventSubtype
+		}
+		s := sums[key]
+		if s == nil {
+			s = &sum{bucket: key}
+			sums[key] = s
+		}
+		s.bucket.Count++
+
+		if len(aq.ValuePath) == 0 {
+			continue
+		}
+		value, ok := payloadNumber(em.PayloadJson, aq.ValuePath)
+		if !ok {
+			continue
+		}
+		if s.values == 0 || value < *s.bucket.Min {
+			s.bucket.Min = &value
+		}
+		if s.values == 0 || value > *s.bucket.Max {
+			s.bucket.Max = &value
+		}
+		s.total += value
+		s.values++
+	}
+
+	buckets := make([]AggregateBucket, 0, len(sums))
+	for _, s := range sums {
+		if s.values > 0 {
+			avg := s.total / float64(s.values)
+			s.bucket.Avg = &avg
+		}
+		buckets = append(buckets, s.bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := &buckets[i], &buckets[j]
+		if a.StartUnixSec != b.StartUnixSec {
+			return a.StartUnixSec < b.StartUnixSec
+		}
+		if a.EventType != b.EventType {
+			return a.EventType < b.EventType
+		}
+		if a.OriginId != b.OriginId {
+			return a.OriginId < b.OriginId
+		}
+		return a.EventSubtype < b.EventSubtype
+	})
+	return buckets
+}
@@ -0,0 +1,22 @@
+package eventstream
+
+import "testing"
+
+func TestBucketStart(t *testing.T) {
+	tests := []struct {
+		t, size, want int64
+	}{
+		{0, 60, 0},
+		{59, 60, 0},
+		{60, 60, 60},
+		{3601, 3600, 3600},
+		{-1, 60, -60},
+		{-60, 60, -60},
+		{-61, 60, -120},
+	}
+	for _, tt := range tests {
+		if got := bucketStart(tt.t, tt.size); got != tt.want {
+			t.Errorf("bucketStart(%d, %d) = %d, want %d", tt.t, tt.size, got, tt.want)
+		}
+	}
+}
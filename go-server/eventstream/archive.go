@@ -0,0 +1,344 @@
+package eventstream
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cold archive of the stream
+//
+// An archive is a directory with gzipped NDJSON segment files, one
+// EventMessage per line, and a manifest.json with the range, the segments
+// and their sha256. The manifest is written last, so a directory without
+// one is an export that did not finish.
+// An import restores the events as they were, with their Id, EventId and
+// iters, events that are already in the store are skipped, so an import
+// can be repeated. Encrypted payloads stay encrypted in the archive, so the
+// master keys are needed to read them after an import, see encryption.go.
+
+// ArchiveManifestFile is the name of the manifest in an archive directory
+const ArchiveManifestFile = "manifest.json"
+
+// ArchiveSegmentEvents is the default number of events per segment file
+const ArchiveSegmentEvents = 10000
+
+// ArchiveRange is the part of the stream to export, all fields are optional
+type ArchiveRange struct {
+	FromId           int64  // inclusive
+	ToId             int64  // exclusive
+	CreationTimeFrom int64  // unix seconds, inclusive
+	CreationTimeTo   int64  // unix seconds, exclusive
+	DestinationId    string // only the events of one destination
+}
+
+// query returns the EventQuery of the range, from new to old
+func (ar ArchiveRange) query() EventQuery {
+	q := EventQuery{
+		DestinationId:    ar.DestinationId,
+		CreationTimeFrom: ar.CreationTimeFrom,
+		CreationTimeTo:   ar.CreationTimeTo,
+		LastId:           ar.ToId,
+	}
+	if ar.FromId > 0 {
+		q.NewestId = ar.FromId - 1
+	}
+	return q
+}
+
+// ArchiveManifest describes an archive
+type ArchiveManifest struct {
+	Version        int // of the archive format
+	EventStreamId  string
+	CreatedUnixSec int64
+	Range          ArchiveRange
+	Events         int64
+	Segments       []ArchiveSegment // from the newest events to the oldest
+}
+
+// ArchiveSegment is one segment file of an archive
+type ArchiveSegment struct {
+	File                   string
+	Events                 int64
+	MinId                  int64
+	MaxId                  int64
+	MinCreationTimeUnixSec int64
+	MaxCreationTimeUnixSec int64
+	Sha256                 string // hex, of the gzipped file
+}
+
+// archivedEvent is a line of a segment file
+type archivedEvent struct {
+	EventMessage
+	EncryptedPayload *archivedPayload // nil if the payload is in PayloadJson
+}
+
+type archivedPayload struct {
+	KeyId string
+	Data  []byte
+	Codec string // the payload was compressed before it was encrypted
+	Size  int64
+}
+
+// ArchiveImportReport is what an import restored
+type ArchiveImportReport struct {
+	Segments int
+	Events   int64
+	Restored int64
+	Skipped  int64 // already in the store
+}
+
+// ExportArchive writes the events of the range to a new archive in dir,
+// with at most segmentEvents events per segment file
+func ExportArchive(ctx context.Context, store EventStore, eventStreamId string, dir string, ar ArchiveRange, segmentEvents int) (ArchiveManifest, error) {
+	manifest := ArchiveManifest{
+		Version:        1,
+		EventStreamId:  eventStreamId,
+		CreatedUnixSec: time.Now().Unix(),
+		Range:          ar,
+		Segments:       []ArchiveSegment{},
+	}
+	if segmentEvents <= 0 {
+		segmentEvents = ArchiveSegmentEvents
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return manifest, err
+	}
+	manifestPath := filepath.Join(dir, ArchiveManifestFile)
+	if _, err := os.Stat(manifestPath); err == nil {
+		return manifest, fmt.Errorf("there already is an archive in %s", dir)
+	}
+
+	// page from new to old, a segment per page
+	q := ar.query()
+	q.Limit = segmentEvents
+	for {
+		ems, err := store.QueryEvents(ctx, q)
+		if err != nil {
+			return manifest, err
+		}
+		if len(ems) == 0 {
+			break
+		}
+
+		segment, err := writeArchiveSegment(dir, fmt.Sprintf("events-%06d.ndjson.gz", len(manifest.Segments)+1), ems)
+		if err != nil {
+			return manifest, err
+		}
+		manifest.Segments = append(manifest.Segments, segment)
+		manifest.Events += segment.Events
+
+		if len(ems) < segmentEvents {
+			break
+		}
+		q.LastId = ems[len(ems)-1].Id
+	}
+
+	// the manifest last, via a rename so it is never half written
+	data, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := os.WriteFile(manifestPath+".tmp", data, 0644); err != nil {
+		return manifest, err
+	}
+	return manifest, os.Rename(manifestPath+".tmp", manifestPath)
+}
+
+// writeArchiveSegment writes ems to a gzipped NDJSON file
+func writeArchiveSegment(dir, name string, ems []EventMessage) (ArchiveSegment, error) {
+	segment := ArchiveSegment{
+		File:   name,
+		Events: int64(len(ems)),
+		MinId:  ems[0].Id,
+		MaxId:  ems[0].Id,
+
+		MinCreationTimeUnixSec: ems[0].CreationTimeUnixSec,
+		MaxCreationTimeUnixSec: ems[0].CreationTimeUnixSec,
+	}
+
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return segment, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(f, hash))
+	encoder := json.NewEncoder(zw)
+	for i := range ems {
+		em := &ems[i]
+		// the compressed payloads are archived as JSON, the segment is
+		// compressed as a whole
+		if err := inflatePayload(em); err != nil {
+			return segment, err
+		}
+		line := archivedEvent{EventMessage: *em}
+		if em.payloadKeyId != "" {
+			line.EncryptedPayload = &archivedPayload{KeyId: em.payloadKeyId, Data: em.payloadData, Codec: em.payloadCodec, Size: em.payloadSize}
+		}
+		if err := encoder.Encode(&line); err != nil {
+			return segment, err
+		}
+		if em.Id < segment.MinId {
+			segment.MinId = em.Id
+		}
+		if em.Id > segment.MaxId {
+			segment.MaxId = em.Id
+		}
+		if em.CreationTimeUnixSec < segment.MinCreationTimeUnixSec {
+			segment.MinCreationTimeUnixSec = em.CreationTimeUnixSec
+		}
+		if em.CreationTimeUnixSec > segment.MaxCreationTimeUnixSec {
+			segment.MaxCreationTimeUnixSec = em.CreationTimeUnixSec
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return segment, err
+	}
+	if err := f.Sync(); err != nil {
+		return segment, err
+	}
+
+	segment.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return segment, f.Close()
+}
+
+// ReadArchiveManifest reads the manifest of the archive in dir
+func ReadArchiveManifest(dir string) (ArchiveManifest, error) {
+	manifest := ArchiveManifest{}
+	data, err := os.ReadFile(filepath.Join(dir, ArchiveManifestFile))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid archive manifest: %w", err)
+	}
+	if manifest.Version != 1 {
+		return manifest, fmt.Errorf("unknown archive version %d", manifest.Version)
+	}
+	return manifest, nil
+}
+
+// VerifyArchive checks all segments of the archive in dir against its manifest
+func VerifyArchive(dir string) (ArchiveManifest, error) {
+	manifest, err := ReadArchiveManifest(dir)
+	if err != nil {
+		return manifest, err
+	}
+	for _, segment := range manifest.Segments {
+		if err := readArchiveSegment(dir, segment, nil); err != nil {
+			return manifest, err
+		}
+	}
+	return manifest, nil
+}
+
+// ImportArchive restores the events of the archive in dir into the store,
+// all segments are checked against the manifest before anything is restored
+func ImportArchive(ctx context.Context, store EventStore, dir string) (ArchiveImportReport, error) {
+	report := ArchiveImportReport{}
+	manifest, err := VerifyArchive(dir)
+	if err != nil {
+		return report, err
+	}
+
+	for _, segment := range manifest.Segments {
+		err := readArchiveSegment(dir, segment, func(ems []EventMessage) error {
+			restored, err := store.RestoreEvents(ctx, ems)
+			report.Events += int64(len(ems))
+			report.Restored += restored
+			report.Skipped += int64(len(ems)) - restored
+			return err
+		})
+		if err != nil {
+			return report, err
+		}
+		report.Segments++
+	}
+	return report, nil
+}
+
+// archiveRestoreBatch is the number of events restored per transaction
+const archiveRestoreBatch = 1000
+
+// readArchiveSegment reads a segment and checks it against the manifest,
+// restore is called with batches of its events, nil only checks
+func readArchiveSegment(dir string, segment ArchiveSegment, restore func(ems []EventMessage) error) error {
+	if filepath.Base(segment.File) != segment.File {
+		return fmt.Errorf("invalid archive segment name %q", segment.File)
+	}
+	f, err := os.Open(filepath.Join(dir, segment.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	hashed := io.TeeReader(f, hash)
+	zr, err := gzip.NewReader(hashed)
+	if err != nil {
+		return fmt.Errorf("archive segment %s: %w", segment.File, err)
+	}
+
+	events := int64(0)
+	batch := []EventMessage{}
+	decoder := json.NewDecoder(bufio.NewReader(zr))
+	for {
+		line := archivedEvent{}
+		err := decoder.Decode(&line)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive segment %s: %w", segment.File, err)
+		}
+		em := line.EventMessage
+		if line.EncryptedPayload != nil {
+			em.payloadKeyId = line.EncryptedPayload.KeyId
+			em.payloadData = line.EncryptedPayload.Data
+			em.payloadCodec = line.EncryptedPayload.Codec
+			em.payloadSize = line.EncryptedPayload.Size
+		}
+		if em.Id < segment.MinId || em.Id > segment.MaxId {
+			return fmt.Errorf("archive segment %s: event %d is outside the ids of the manifest", segment.File, em.Id)
+		}
+		events++
+
+		if restore == nil {
+			continue
+		}
+		batch = append(batch, em)
+		if len(batch) == archiveRestoreBatch {
+			if err := restore(batch); err != nil {
+				return err
+			}
+			batch = []EventMessage{}
+		}
+	}
+	// read to the end, so the hash covers the whole file
+	if _, err := io.Copy(io.Discard, hashed); err != nil {
+		return err
+	}
+
+	if events != segment.Events {
+		return fmt.Errorf("archive segment %s has %d events, the manifest says %d", segment.File, events, segment.Events)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != segment.Sha256 {
+		return fmt.Errorf("archive segment %s does not match its sha256", segment.File)
+	}
+	if restore != nil && len(batch) > 0 {
+		return restore(batch)
+	}
+	return nil
+}
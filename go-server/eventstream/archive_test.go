@@ -0,0 +1,156 @@
+package eventstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			es := &EventStream{Store: store, ChainScope: ChainDestination}
+			for i := 0; i < 7; i++ {
+				em := testEvent("o1", fmt.Sprint("e", i), fmt.Sprintf(`{"i":%d,"big":9007199254740993}`, i))
+				em.DestinationId = []string{"d1", "d2"}[i%2]
+				if _, err := es.SaveMessage(ctx, em); err != nil {
+					t.Fatal(err)
+				}
+			}
+			original, err := store.QueryEvents(ctx, EventQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			manifest, err := ExportArchive(ctx, store, "test", dir, ArchiveRange{}, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Events != 7 || len(manifest.Segments) != 3 {
+				t.Fatalf("exported %d events in %d segments, want 7 in 3", manifest.Events, len(manifest.Segments))
+			}
+			if _, err := VerifyArchive(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			// restore into an empty store of the same kind, twice
+			restored := testStores(t)[name]
+			for round, want := range []int64{7, 0} {
+				report, err := ImportArchive(ctx, restored, dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.Events != 7 || report.Restored != want {
+					t.Fatalf("import %d restored %d of %d events, want %d", round, report.Restored, report.Events, want)
+				}
+			}
+			got, err := restored.QueryEvents(ctx, EventQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(original) {
+				t.Fatalf("restored %d events, want %d", len(got), len(original))
+			}
+			for i := range got {
+				a, b := &original[i], &got[i]
+				if a.Id != b.Id || a.EventId != b.EventId || a.OriginIter != b.OriginIter || a.DestinationIter != b.DestinationIter || string(a.PayloadJson) != string(b.PayloadJson) {
+					t.Errorf("restored %d %s %s, want %d %s %s", b.Id, b.EventId, b.PayloadJson, a.Id, a.EventId, a.PayloadJson)
+				}
+			}
+
+			// the chains of the restored events still verify
+			for _, chainId := range []string{"destination:d1", "destination:d2"} {
+				report, err := VerifyChain(ctx, restored.(ChainStore), nil, chainId, 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.Broken != nil || report.Events == 0 {
+					t.Errorf("%s: %d events, broken %+v", chainId, report.Events, report.Broken)
+				}
+			}
+
+			// new events continue after the restored iters and chains
+			saved, err := (&EventStream{Store: restored, ChainScope: ChainDestination}).SaveMessage(ctx, testEvent("o1", "e7", `{}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.OriginIter != 8 {
+				t.Errorf("the next event got OriginIter %d, want 8", saved.OriginIter)
+			}
+			report, err := VerifyChain(ctx, restored.(ChainStore), nil, "destination:o1", 0, 0)
+			if err != nil || report.Broken != nil {
+				t.Errorf("chain of the new event: %v, broken %+v", err, report.Broken)
+			}
+		})
+	}
+}
+
+func TestVerifyArchiveChanged(t *testing.T) {
+	ctx := context.Background()
+	store := &MemoryStore{}
+	for i := 0; i < 3; i++ {
+		if _, err := (&EventStream{Store: store}).SaveMessage(ctx, testEvent("o1", fmt.Sprint("e", i), `{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	manifest, err := ExportArchive(ctx, store, "test", dir, ArchiveRange{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a segment with a changed event no longer has its sha256
+	segment := filepath.Join(dir, manifest.Segments[0].File)
+	rewriteGzip(t, segment, func(data []byte) []byte {
+		return bytes.Replace(data, []byte(`"EventId":"e1"`), []byte(`"EventId":"e9"`), 1)
+	})
+	if _, err := VerifyArchive(dir); err == nil || !strings.Contains(err.Error(), "sha256") {
+		t.Errorf("got %v, want a sha256 mismatch", err)
+	}
+
+	restored := &MemoryStore{}
+	if _, err := ImportArchive(ctx, restored, dir); err == nil {
+		t.Error("a changed archive was imported")
+	}
+	if events, _ := restored.QueryEvents(ctx, EventQuery{}); len(events) != 0 {
+		t.Errorf("%d events of a changed archive were imported", len(events))
+	}
+}
+
+// rewriteGzip replaces the content of a gzipped file with change(content)
+func rewriteGzip(t *testing.T, file string, change func(data []byte) []byte) {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := change(data)
+	if bytes.Equal(changed, data) {
+		t.Fatal("the content did not change")
+	}
+
+	compressed := bytes.Buffer{}
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(changed)
+	zw.Close()
+	if err := os.WriteFile(file, compressed.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package eventstream
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// group commit for SaveMessage
+//
+// When BatchWindow is set on the EventStream, concurrent SaveMessage calls
+// do not each do their own insert. The first save starts a window, the saves
+// that arrive during the window (up to BatchMaxEvents) are collected, and the
+// whole group is saved with Store.InsertEvents in a single transaction.
+// Every caller still gets its own Id or error, and MQTT is notified after
+// the transaction is committed.
+
+// defaultBatchMaxEvents is used when BatchWindow is set without BatchMaxEvents
+const defaultBatchMaxEvents = 100
+
+type saveRequest struct {
+	em     EventMessage
+	result chan SaveResult
+}
+
+// insertBatched queues em for the next group commit and waits for its result,
+// when ctx ends first it stops waiting, the group can still save em
+func (es *EventStream) insertBatched(ctx context.Context, em EventMessage) (EventMessage, error) {
+	es.batchOnce.Do(func() {
+		es.saveQueue = make(chan saveRequest)
+		go es.runBatcher()
+	})
+
+	req := saveRequest{em: em, result: make(chan SaveResult, 1)}
+	select {
+	case es.saveQueue <- req:
+	case <-ctx.Done():
+		return em, ctx.Err()
+	}
+	select {
+	case result := <-req.result:
+		return result.Event, result.Err
+	case <-ctx.Done():
+		return em, ctx.Err()
+	}
+}
+
+// runBatcher collects the queued saves into groups and flushes them, one
+// group at a time, the saves arriving during a flush form the next group
+func (es *EventStream) runBatcher() {
+	maxEvents := es.BatchMaxEvents
+	if maxEvents <= 0 {
+		maxEvents = defaultBatchMaxEvents
+	}
+
+	for {
+		batch := []saveRequest{<-es.saveQueue}
+
+		window := time.NewTimer(es.BatchWindow)
+	collect:
+		for len(batch) < maxEvents {
+			select {
+			case req := <-es.saveQueue:
+				batch = append(batch, req)
+			case <-window.C:
+				break collect
+			}
+		}
+		window.Stop()
+
+		es.flushBatch(batch)
+	}
+}
+
+// flushBatch saves a group and hands every caller its own result, the group
+// has its own deadline, a caller that stops waiting does not cancel the others
+func (es *EventStream) flushBatch(batch []saveRequest) {
+	ems := make([]EventMessage, len(batch))
+	for i, req := range batch {
+		ems[i] = req.em
+	}
+
+	ctx, cancel := es.insertContext(context.Background())
+	defer cancel()
+	start := time.Now()
+	results, err := es.Store.InsertEvents(ctx, ems)
+	err = ctxErr(ctx, err)
+	if err != nil {
+		// the transaction failed, nothing of this group was saved
+		for _, req := range batch {
+			req.result <- SaveResult{Event: req.em, Err: err}
+		}
+		return
+	}
+	fmt.Println("group commit of", len(batch), "events in", time.Since(start))
+
+	for i, req := range batch {
+		req.result <- results[i]
+	}
+}
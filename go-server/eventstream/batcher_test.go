@@ -0,0 +1,88 @@
+package eventstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStore counts the inserts of the groups
+type countingStore struct {
+	EventStore
+	groups int64
+	events int64
+}
+
+func (cs *countingStore) InsertEvents(ctx context.Context, ems []EventMessage) ([]SaveResult, error) {
+	atomic.AddInt64(&cs.groups, 1)
+	atomic.AddInt64(&cs.events, int64(len(ems)))
+	return cs.EventStore.InsertEvents(ctx, ems)
+}
+
+func TestSaveMessageBatched(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			counting := &countingStore{EventStore: store}
+			es := &EventStream{Store: counting, BatchWindow: 50 * time.Millisecond, BatchMaxEvents: 8}
+
+			// 20 saves and a retry of each, at the same time
+			const saves = 20
+			ids := make([][2]int64, saves)
+			wg := sync.WaitGroup{}
+			for i := 0; i < saves; i++ {
+				for retry := 0; retry < 2; retry++ {
+					wg.Add(1)
+					go func(i, retry int) {
+						defer wg.Done()
+						saved, err := es.SaveMessage(ctx, testEvent("o1", fmt.Sprint("e", i), fmt.Sprintf(`{"i":%d}`, i)))
+						if err != nil && !errors.Is(err, ErrDuplicateEvent) {
+							t.Error(err)
+						}
+						if string(saved.PayloadJson) != fmt.Sprintf(`{"i":%d}`, i) {
+							t.Errorf("save %d got the event %s of another caller", i, saved.PayloadJson)
+						}
+						ids[i][retry] = saved.Id
+					}(i, retry)
+				}
+			}
+			wg.Wait()
+
+			seen := map[int64]bool{}
+			for i := range ids {
+				if ids[i][0] == 0 || ids[i][0] != ids[i][1] {
+					t.Errorf("save %d and its retry got Ids %d and %d, want the same Id", i, ids[i][0], ids[i][1])
+				}
+				if seen[ids[i][0]] {
+					t.Errorf("save %d got the Id %d of another save", i, ids[i][0])
+				}
+				seen[ids[i][0]] = true
+			}
+			if counting.events != 2*saves {
+				t.Errorf("%d events went through the groups, want %d", counting.events, 2*saves)
+			}
+			if counting.groups < 2*saves/8 || counting.groups >= 2*saves {
+				t.Errorf("the saves were inserted in %d groups of at most 8", counting.groups)
+			}
+		})
+	}
+}
+
+func TestSaveMessageBatchedContext(t *testing.T) {
+	es := &EventStream{Store: &MemoryStore{}, BatchWindow: time.Second}
+
+	// the caller stops waiting, the group still saves the event
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := es.SaveMessage(ctx, testEvent("o1", "e1", `{}`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline of the caller", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := es.Store.GetByEventId(context.Background(), "o1", "e1"); err != nil {
+		t.Errorf("the event of the caller that stopped waiting was not saved: %v", err)
+	}
+}
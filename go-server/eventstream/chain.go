@@ -0,0 +1,400 @@
+package eventstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+// hash chains of the events
+//
+// With a ChainScope on the EventStream every saved event gets a ChainLink:
+// the events of a chain are numbered by Seq, and the Hash of an event is the
+// SHA-256 of its content together with the Hash of the event before it. An
+// event that is changed or deleted afterwards breaks the chain at that
+// event, see VerifyChain. There is a chain per destination,
+// "destination:<destination id>", or one chain of all events, "global",
+// which makes all inserts wait for each other.
+//
+// The payload, EventSubtype and OriginGroupId are in the Hash through the
+// DataHash. An erasure or redaction changes them but keeps the DataHash, so
+// the chain still verifies, the redacted events are counted instead of
+// checked. The payload is hashed in a canonical form, with the keys sorted
+// and the numbers written like JavaScript does (RFC 8785), so the hash does
+// not depend on how the database keeps the JSON, and it is hashed before it
+// is compressed or encrypted. Unlike RFC 8785 the integers beyond 2^53 are
+// kept exact instead of rounded to a float64, so two payloads that differ
+// only in a large id do not get the same hash.
+//
+// Whoever can write to the database can still rewrite a chain from the
+// changed event up to its head, so keep a copy of the heads, /api/chains,
+// somewhere else and compare them. Retention deletes the oldest events of a
+// chain, a verification then starts at the oldest event that is left.
+
+// the scopes of the chains
+const (
+	ChainDestination = "destination"
+	ChainGlobal      = "global"
+)
+
+// ChainLink is the place of an event in its hash chain
+type ChainLink struct {
+	Id       string // "destination:<destination id>" or "global"
+	Seq      int64  // from 1, without gaps
+	PrevHash string // the Hash of the event before, "" for the first event
+	Hash     string // hex SHA-256 of the content of the event, see chainHash
+	DataHash string // hex SHA-256 of the payload, EventSubtype and OriginGroupId
+}
+
+// ChainHead is the last link of a chain
+type ChainHead struct {
+	ChainId string
+	Seq     int64
+	Hash    string
+}
+
+// ChainStore is a store that keeps the hash chains of the events
+type ChainStore interface {
+	// ChainHeads returns the head of every chain, by ChainId
+	ChainHeads(ctx context.Context) ([]ChainHead, error)
+	// ChainEvents returns at most limit events of a chain with a Seq of at
+	// least fromSeq, by Seq
+	ChainEvents(ctx context.Context, chainId string, fromSeq int64, limit int) ([]EventMessage, error)
+}
+
+// CheckChainScope validates a scope, "" does not chain the events
+func CheckChainScope(scope string) error {
+	switch scope {
+	case "", ChainDestination, ChainGlobal:
+		return nil
+	}
+	return fmt.Errorf("unknown chain scope %q, use %s or %s", scope, ChainDestination, ChainGlobal)
+}
+
+// newChainLink starts the link of em in the chain of scope, the store sets
+// the Seq, PrevHash and Hash with link
+func newChainLink(scope string, em *EventMessage) (*ChainLink, error) {
+	chainId := ChainGlobal
+	if scope == ChainDestination {
+		chainId = ChainDestination + ":" + em.DestinationId
+	}
+	dataHash, err := chainDataHash(em)
+	if err != nil {
+		return nil, err
+	}
+	return &ChainLink{Id: chainId, DataHash: dataHash}, nil
+}
+
+// link appends em to the chain of head, head moves to em. em gets a new
+// ChainLink, the one it had can be shared with a copy of em.
+func (head *ChainHead) link(em *EventMessage) {
+	link := &ChainLink{
+		Id:       head.ChainId,
+		Seq:      head.Seq + 1,
+		PrevHash: head.Hash,
+		DataHash: em.Chain.DataHash,
+	}
+	link.Hash = chainHash(em, link)
+	em.Chain = link
+	head.Seq = link.Seq
+	head.Hash = link.Hash
+}
+
+// chainHash is the hex SHA-256 of the canonical JSON of the fields of em
+// that are not erased, with link
+func chainHash(em *EventMessage, link *ChainLink) string {
+	content, _ := canonicalJSON(struct {
+		ChainId             string
+		Seq                 int64
+		PrevHash            string
+		EventId             string
+		CreationTimeUnixSec int64
+		OriginId            string
+		OriginIter          int64
+		OriginBuildVersion  string
+		DestinationId       string
+		DestinationIter     int64
+		EventTimeUnixSec    int64
+		EventType           string
+		EventVersion        string
+		DataHash            string
+	}{
+		ChainId:             link.Id,
+		Seq:                 link.Seq,
+		PrevHash:            link.PrevHash,
+		EventId:             em.EventId,
+		CreationTimeUnixSec: em.CreationTimeUnixSec,
+		OriginId:            em.OriginId,
+		OriginIter:          em.OriginIter,
+		OriginBuildVersion:  em.OriginBuildVersion,
+		DestinationId:       em.DestinationId,
+		DestinationIter:     em.DestinationIter,
+		EventTimeUnixSec:    em.EventTimeUnixSec,
+		EventType:           em.EventType,
+		EventVersion:        em.EventVersion,
+		DataHash:            link.DataHash,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// chainDataHash is the hex SHA-256 of the canonical JSON of the fields of
+// em that can be erased
+func chainDataHash(em *EventMessage) (string, error) {
+	payload, err := canonicalPayload(em.PayloadJson)
+	if err != nil {
+		return "", fmt.Errorf("event %d: payload cannot be hashed: %w", em.Id, err)
+	}
+	content, err := canonicalJSON(struct {
+		EventSubtype  string
+		OriginGroupId string
+		Payload       interface{}
+	}{em.EventSubtype, em.OriginGroupId, payload})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canonicalPayload decodes a payload for canonicalJSON, with its numbers
+// written like JavaScript does, see canonicalNumber
+func canonicalPayload(data json.RawMessage) (interface{}, error) {
+	value, err := decodePayload(data)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalNumbers(value)
+}
+
+// canonicalNumbers replaces the numbers of a decoded payload by their
+// canonical form
+func canonicalNumbers(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key := range v {
+			n, err := canonicalNumbers(v[key])
+			if err != nil {
+				return nil, err
+			}
+			v[key] = n
+		}
+	case []interface{}:
+		for i := range v {
+			n, err := canonicalNumbers(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = n
+		}
+	case json.Number:
+		return canonicalNumber(v)
+	}
+	return value, nil
+}
+
+// maxSafeInteger is the largest integer a float64 holds exactly
+const maxSafeInteger = 1 << 53
+
+// canonicalNumber writes n as a float64 like JavaScript does, 1.0 as 1 and
+// 1E3 as 1000, except for an integer beyond 2^53, which is written exact
+func canonicalNumber(n json.Number) (json.Number, error) {
+	if i, ok := new(big.Int).SetString(string(n), 10); ok && i.CmpAbs(big.NewInt(maxSafeInteger)) > 0 {
+		return json.Number(i.String()), nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return "", fmt.Errorf("number %s: %w", n, err)
+	}
+	if f == 0 {
+		// -0 is written as 0
+		f = 0
+	}
+	// encoding/json writes a float64 like JavaScript does
+	encoded, err := json.Marshal(f)
+	return json.Number(encoded), err
+}
+
+// canonicalJSON encodes v without spaces, with the keys of the maps sorted
+// and without escaping <, > and &, the payloads in v are decoded by
+// canonicalPayload
+func canonicalJSON(v interface{}) ([]byte, error) {
+	encoded := bytes.Buffer{}
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(encoded.Bytes(), []byte("\n")), nil
+}
+
+// ChainReport is the outcome of VerifyChain
+type ChainReport struct {
+	ChainId  string
+	FromSeq  int64 // the first event that was checked, above the asked one if the events before were deleted
+	ToSeq    int64 // the last event that was checked
+	Events   int64
+	Redacted int64 // of which the data was erased, only their Hash was checked
+	Head     ChainHead
+	Broken   *ChainBreak // the first broken link, nil if the chain is intact
+}
+
+// ChainBreak is where a chain is broken
+type ChainBreak struct {
+	Seq     int64
+	Id      int64 // of the event, 0 if it is missing
+	EventId string
+	Reason  string
+}
+
+// ErrUnknownChain is returned by VerifyChain for a chain without head
+var ErrUnknownChain = errors.New("unknown chain")
+
+// VerifyChain checks the links of the events of a chain with a Seq from
+// fromSeq up to toSeq, 0 up to the head, it stops at the first broken link.
+// The encrypted payloads are decrypted with keys to check their DataHash.
+func VerifyChain(ctx context.Context, store ChainStore, keys *PayloadKeys, chainId string, fromSeq, toSeq int64) (ChainReport, error) {
+	report := ChainReport{ChainId: chainId}
+	heads, err := store.ChainHeads(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, head := range heads {
+		if head.ChainId == chainId {
+			report.Head = head
+		}
+	}
+	if report.Head.ChainId == "" {
+		return report, fmt.Errorf("%w %s", ErrUnknownChain, chainId)
+	}
+	if fromSeq < 1 {
+		fromSeq = 1
+	}
+	if toSeq < 1 || toSeq > report.Head.Seq {
+		toSeq = report.Head.Seq
+	}
+
+	var prev *ChainLink
+	next := fromSeq
+	for next <= toSeq {
+		ems, err := store.ChainEvents(ctx, chainId, next, 1000)
+		if err != nil {
+			return report, err
+		}
+		ems, err = keys.OpenAll(ems)
+		if err != nil {
+			return report, err
+		}
+		for i := range ems {
+			em := &ems[i]
+			link := em.Chain
+			if link.Seq > toSeq {
+				break
+			}
+			report.Broken = verifyLink(em, prev)
+			if report.Broken != nil {
+				return report, nil
+			}
+			if prev == nil {
+				report.FromSeq = link.Seq
+			}
+			report.ToSeq = link.Seq
+			report.Events++
+			if em.RedactedUnixSec > 0 {
+				report.Redacted++
+			}
+			prev = link
+		}
+		if len(ems) < 1000 {
+			break
+		}
+		next = ems[len(ems)-1].Chain.Seq + 1
+	}
+
+	// the newest events cannot be deleted by retention
+	if prev != nil && toSeq == report.Head.Seq {
+		switch {
+		case prev.Seq < report.Head.Seq:
+			report.Broken = &ChainBreak{Seq: prev.Seq + 1, Reason: fmt.Sprintf("events %d to %d, the head, are missing", prev.Seq+1, report.Head.Seq)}
+		case prev.Hash != report.Head.Hash:
+			report.Broken = &ChainBreak{Seq: prev.Seq, Reason: "the head has another Hash than its event"}
+		}
+	}
+	return report, nil
+}
+
+// verifyLink checks the link of em, and that it follows prev, the link
+// before it, nil for the first event that is checked
+func verifyLink(em *EventMessage, prev *ChainLink) *ChainBreak {
+	link := em.Chain
+	broken := func(reason string) *ChainBreak {
+		return &ChainBreak{Seq: link.Seq, Id: em.Id, EventId: em.EventId, Reason: reason}
+	}
+	if prev != nil && link.Seq != prev.Seq+1 {
+		return &ChainBreak{Seq: prev.Seq + 1, Reason: fmt.Sprintf("events %d to %d are missing", prev.Seq+1, link.Seq-1)}
+	}
+	if prev != nil && link.PrevHash != prev.Hash {
+		return broken(fmt.Sprintf("PrevHash is not the Hash of event %d", prev.Seq))
+	}
+	if link.Seq == 1 && link.PrevHash != "" {
+		return broken("the first event has a PrevHash")
+	}
+	if chainHash(em, link) != link.Hash {
+		return broken("the event does not match its Hash")
+	}
+	if em.RedactedUnixSec > 0 {
+		return nil
+	}
+	dataHash, err := chainDataHash(em)
+	if err != nil || dataHash != link.DataHash {
+		return broken("the payload, EventSubtype or OriginGroupId do not match the DataHash")
+	}
+	return nil
+}
+
+// chainIds returns the ids of the chains of ems, sorted, so their heads can
+// be locked in the same order by every insert
+func chainIds(ems []EventMessage) []string {
+	seen := make(map[string]bool)
+	ids := []string{}
+	for _, em := range ems {
+		if em.Chain != nil && !seen[em.Chain.Id] {
+			seen[em.Chain.Id] = true
+			ids = append(ids, em.Chain.Id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// linkChains links the chained events of ems, in their order, to the heads
+// of their chains
+func linkChains(heads map[string]*ChainHead, ems []EventMessage) {
+	for i := range ems {
+		if ems[i].Chain != nil {
+			heads[ems[i].Chain.Id].link(&ems[i])
+		}
+	}
+}
+
+// restoredHeads returns the last links of the chains of restored events
+func restoredHeads(ems []EventMessage) map[string]*ChainHead {
+	heads := make(map[string]*ChainHead)
+	for _, em := range ems {
+		if em.Chain == nil {
+			continue
+		}
+		head := heads[em.Chain.Id]
+		if head == nil || em.Chain.Seq > head.Seq {
+			heads[em.Chain.Id] = &ChainHead{ChainId: em.Chain.Id, Seq: em.Chain.Seq, Hash: em.Chain.Hash}
+		}
+	}
+	return heads
+}
@@ -0,0 +1,140 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"b":1,"a":2}`, `{"a":2,"b":1}`},
+		{`{"n":1.0}`, `{"n":1}`},
+		{`{"n":1E3}`, `{"n":1000}`},
+		{`{"n":-0}`, `{"n":0}`},
+		{`{"n":0.000001}`, `{"n":0.000001}`},
+		{`{"n":1e-7}`, `{"n":1e-7}`},
+		{`{"n":1e21}`, `{"n":1e+21}`},
+		{`{"n":9007199254740992}`, `{"n":9007199254740992}`},
+		{`{"n":9007199254740993}`, `{"n":9007199254740993}`},
+		{`{"n":-9007199254740993}`, `{"n":-9007199254740993}`},
+		{`[{"s":"<&>"},[1.50]]`, `[{"s":"<&>"},[1.5]]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			payload, err := canonicalPayload(json.RawMessage(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := canonicalJSON(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("canonicalJSON(%s) = %s, want %s", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainDataHashLargeIntegers(t *testing.T) {
+	a, err := chainDataHash(&EventMessage{PayloadJson: json.RawMessage(`{"id":9007199254740992}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := chainDataHash(&EventMessage{PayloadJson: json.RawMessage(`{"id":9007199254740993}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("payloads that differ in an integer beyond 2^53 have the same DataHash")
+	}
+}
+
+// tamperEvent changes the stored event id behind the back of the store, in
+// memory with change and in SQLite with the SQL set
+func tamperEvent(t *testing.T, store EventStore, id int64, change func(em *EventMessage), set string) {
+	t.Helper()
+	switch s := store.(type) {
+	case *MemoryStore:
+		s.Lock()
+		defer s.Unlock()
+		for i := range s.events {
+			if s.events[i].Id == id {
+				link := *s.events[i].Chain
+				s.events[i].Chain = &link
+				change(&s.events[i])
+			}
+		}
+	case *SQLiteStore:
+		if _, err := s.DB.Exec("UPDATE events SET "+set+" WHERE id = ?", id); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("cannot change the events of a %T", store)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(em *EventMessage)
+		set    string
+		reason string
+	}{
+		{"intact", nil, "", ""},
+		{"payload", func(em *EventMessage) { em.PayloadJson = json.RawMessage(`{"i":99}`) }, `payload_json = '{"i":99}'`, "DataHash"},
+		{"subtype", func(em *EventMessage) { em.EventSubtype = "other" }, "event_subtype = 'other'", "DataHash"},
+		{"event type", func(em *EventMessage) { em.EventType = "other" }, "event_type = 'other'", "Hash"},
+		{"prev hash", func(em *EventMessage) { em.Chain.PrevHash = "00" }, "chain_prev_hash = '00'", "PrevHash"},
+	}
+	for _, tt := range tests {
+		for name, store := range testStores(t) {
+			t.Run(tt.name+" "+name, func(t *testing.T) {
+				ctx := context.Background()
+				es := &EventStream{Store: store, ChainScope: ChainGlobal}
+				ids := []int64{}
+				for i := 0; i < 5; i++ {
+					saved, err := es.SaveMessage(ctx, testEvent([]string{"o1", "o2"}[i%2], fmt.Sprint("e", i), fmt.Sprintf(`{"i":%d,"name":"n%d"}`, i, i)))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if saved.Chain == nil || saved.Chain.Seq != int64(i+1) {
+						t.Fatalf("event %d got the link %+v", i, saved.Chain)
+					}
+					ids = append(ids, saved.Id)
+				}
+
+				// a redaction keeps the chain intact
+				if _, err := store.(Eraser).EraseEvents(ctx, ErasureRequest{OriginId: "o2", Paths: [][]string{{"name"}}, By: "test"}); err != nil {
+					t.Fatal(err)
+				}
+				if tt.change != nil {
+					tamperEvent(t, store, ids[2], tt.change, tt.set)
+				}
+
+				report, err := VerifyChain(ctx, store.(ChainStore), nil, ChainGlobal, 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.change == nil {
+					if report.Broken != nil || report.Events != 5 || report.Redacted != 2 || report.Head.Seq != 5 {
+						t.Errorf("got %d events, %d redacted, head %d, broken %+v, want 5, 2 redacted, intact", report.Events, report.Redacted, report.Head.Seq, report.Broken)
+					}
+					return
+				}
+				if report.Broken == nil || report.Broken.Seq != 3 || !strings.Contains(report.Broken.Reason, tt.reason) {
+					t.Errorf("got the break %+v, want event 3 with %s", report.Broken, tt.reason)
+				}
+				if report.Events != 2 {
+					t.Errorf("checked %d events before the break, want 2", report.Events)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package eventstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression of large payloads
+//
+// With PayloadCompression on the EventStream, payloads of at least MinBytes,
+// such as map snapshots, are stored compressed in payload_data, with the
+// codec in payload_codec and the size of the JSON in payload_size, and {} in
+// payload_json. ParseRows decompresses them, so the stores return them as
+// they were saved. A payload that is also encrypted is compressed before it
+// is encrypted and decompressed by the EventStream, see encryption.go.
+//
+// The database cannot look into compressed payloads, the smaller payloads
+// stay plain JSON. It is decided per event, on payload_codec and not on the
+// PayloadCompression: a query with payload filters, or an aggregation of
+// payload values, fails with ErrPayloadCompressed only when a compressed
+// event could be in its result, see sqlOpaquePayloads, and the paths of the
+// payloads of an origin cannot be redacted while one of its events is
+// compressed.
+
+// the codecs of the compressed payloads
+const (
+	CodecZstd = "zstd"
+	CodecGzip = "gzip"
+)
+
+// ErrPayloadCompressed is returned for the queries on the payloads that the
+// database cannot answer because the payloads are compressed
+var ErrPayloadCompressed = errors.New("payloads are compressed")
+
+// payloadMaxInflated limits the size of a decompressed payload
+const payloadMaxInflated = 16 * 1024 * 1024
+
+// the zstd encoder and decoder are safe for concurrent EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(payloadMaxInflated))
+)
+
+// PayloadCompression compresses the large payloads before they are stored
+type PayloadCompression struct {
+	Codec    string // CodecZstd or CodecGzip, "" does not compress
+	MinBytes int    // the payloads of at least MinBytes are compressed
+}
+
+// Check validates the codec
+func (pc *PayloadCompression) Check() error {
+	switch pc.Codec {
+	case "", CodecZstd, CodecGzip:
+		return nil
+	}
+	return fmt.Errorf("unknown payload codec %q, use %s or %s", pc.Codec, CodecZstd, CodecGzip)
+}
+
+// Compressed reports if payloads are compressed
+func (pc *PayloadCompression) Compressed() bool {
+	return pc != nil && pc.Codec != ""
+}
+
+// Compress compresses the payload of em, if it is large enough and the
+// compressed payload is smaller
+func (pc *PayloadCompression) Compress(em EventMessage) (EventMessage, error) {
+	if !pc.Compressed() || len(em.PayloadJson) < pc.MinBytes || em.payloadData != nil {
+		return em, nil
+	}
+	data, err := compressPayload(pc.Codec, em.PayloadJson)
+	if err != nil {
+		return em, err
+	}
+	if len(data) >= len(em.PayloadJson) {
+		return em, nil
+	}
+	em.payloadData = data
+	em.payloadCodec = pc.Codec
+	em.payloadSize = int64(len(em.PayloadJson))
+	em.PayloadJson = json.RawMessage("{}")
+	return em, nil
+}
+
+// compressPayload compresses a payload with codec
+func compressPayload(codec string, payload []byte) ([]byte, error) {
+	switch codec {
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(payload, nil), nil
+	case CodecGzip:
+		compressed := bytes.Buffer{}
+		zw := gzip.NewWriter(&compressed)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown payload codec %q", codec)
+}
+
+// inflatePayload decompresses the payload of em, if it is compressed and
+// not encrypted
+func inflatePayload(em *EventMessage) error {
+	if em.payloadCodec == "" || em.payloadKeyId != "" {
+		return nil
+	}
+
+	var payload []byte
+	var err error
+	switch em.payloadCodec {
+	case CodecZstd:
+		payload, err = zstdDecoder.DecodeAll(em.payloadData, nil)
+	case CodecGzip:
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(bytes.NewReader(em.payloadData))
+		if err == nil {
+			payload, err = io.ReadAll(io.LimitReader(zr, payloadMaxInflated+1))
+		}
+		if err == nil && len(payload) > payloadMaxInflated {
+			err = errors.New("payload is too large")
+		}
+	default:
+		err = fmt.Errorf("unknown payload codec %q", em.payloadCodec)
+	}
+	if err != nil {
+		return fmt.Errorf("event %d: cannot decompress the payload: %w", em.Id, err)
+	}
+
+	em.PayloadJson = payload
+	em.payloadData = nil
+	em.payloadCodec = ""
+	em.payloadSize = 0
+	return nil
+}
+
+// PayloadStats is the storage used by the payloads of one codec
+type PayloadStats struct {
+	Codec       string // "" for the payloads that are not compressed
+	Encrypted   bool
+	Events      int64
+	Bytes       int64 // of the JSON of the payloads
+	StoredBytes int64 // as stored, compressed or encrypted
+}
+
+// PayloadStatsStore is a store that can report the storage of its payloads
+type PayloadStatsStore interface {
+	// PayloadStats goes through all events, per codec and encrypted or not
+	PayloadStats(ctx context.Context) ([]PayloadStats, error)
+}
@@ -0,0 +1,150 @@
+package eventstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPayloadCompression(t *testing.T) {
+	large := fmt.Sprintf(`{"map":%q}`, strings.Repeat("0123456789", 1000))
+	payloads := map[string]string{"small": `{"level":1}`, "large": large}
+
+	tests := []struct {
+		codec string
+		keys  *PayloadKeys
+	}{
+		{CodecZstd, nil},
+		{CodecGzip, nil},
+		{CodecZstd, testPayloadKeys("k1", "k1")},
+	}
+	for _, tt := range tests {
+		for name, store := range testStores(t) {
+			t.Run(fmt.Sprint(tt.codec, " encrypted ", tt.keys != nil, " ", name), func(t *testing.T) {
+				ctx := context.Background()
+				es := &EventStream{Store: store, Keys: tt.keys, Compression: &PayloadCompression{Codec: tt.codec, MinBytes: 4096}}
+				for eventId, payload := range payloads {
+					if _, err := es.SaveMessage(ctx, testEvent("o1", eventId, payload)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// the large payload is stored compressed
+				stats, err := store.(PayloadStatsStore).PayloadStats(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, s := range stats {
+					if s.Events != 1 || (s.Codec == tt.codec && (s.Bytes != int64(len(large)) || s.StoredBytes >= s.Bytes)) {
+						t.Errorf("unexpected payload stats %+v", s)
+					}
+				}
+				if len(stats) != 2 || stats[1].Codec != tt.codec || stats[1].Encrypted != (tt.keys != nil) {
+					t.Errorf("got the payload stats %+v, want one compressed payload", stats)
+				}
+
+				read, err := es.QueryEvents(ctx, EventQuery{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range read {
+					if string(read[i].PayloadJson) != payloads[read[i].EventId] {
+						t.Errorf("%s is read as %.40s, want %.40s", read[i].EventId, read[i].PayloadJson, payloads[read[i].EventId])
+					}
+				}
+				saved, err := es.GetByEventId(ctx, "o1", "large")
+				if err != nil || string(saved.PayloadJson) != large {
+					t.Errorf("GetByEventId of the large payload: %v", err)
+				}
+
+				// the database cannot filter on compressed payloads
+				f, _ := ParsePayloadFilter("level=1")
+				if _, err := es.QueryEvents(ctx, EventQuery{Payload: []PayloadFilter{f}}); !errors.Is(err, ErrPayloadCompressed) && !errors.Is(err, ErrPayloadEncrypted) {
+					t.Errorf("a payload filter got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestInflatePayloadLimit(t *testing.T) {
+	for _, codec := range []string{CodecZstd, CodecGzip} {
+		huge := make([]byte, payloadMaxInflated+1)
+		data, err := compressPayload(codec, huge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		em := EventMessage{payloadData: data, payloadCodec: codec}
+		if err := inflatePayload(&em); err == nil {
+			t.Errorf("%s: a payload above %d bytes was decompressed", codec, payloadMaxInflated)
+		}
+	}
+}
+
+func TestPayloadFiltersCompressedEvents(t *testing.T) {
+	large := fmt.Sprintf(`{"level":1,"map":%q}`, strings.Repeat("0123456789", 1000))
+	level, _ := ParsePayloadFilter("level=1")
+
+	tests := []struct {
+		name string
+		q    EventQuery
+		want string // the EventIds, "" for ErrPayloadCompressed
+	}{
+		{"compressed event in the result", EventQuery{Payload: []PayloadFilter{level}}, ""},
+		{"page before the compressed event", EventQuery{Payload: []PayloadFilter{level}, Limit: 2}, "e4 e3"},
+		{"page up to the compressed event", EventQuery{Payload: []PayloadFilter{level}, Limit: 3}, ""},
+		{"other event type", EventQuery{EventType: "status", Payload: []PayloadFilter{level}}, "e4 e3 e1"},
+		{"no payload filters", EventQuery{}, "e4 e3 map e1"},
+	}
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			es := &EventStream{Store: store, Compression: &PayloadCompression{Codec: CodecZstd, MinBytes: 4096}}
+			for _, e := range [][3]string{{"o1", "e1", `{"level":1}`}, {"o1", "map", large}, {"o2", "e3", `{"level":1}`}, {"o2", "e4", `{"level":1}`}} {
+				em := testEvent(e[0], e[1], e[2])
+				if e[1] == "map" {
+					em.EventType = "map"
+				}
+				if _, err := es.SaveMessage(ctx, em); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// also with the compression turned off again
+			for _, compression := range []*PayloadCompression{es.Compression, nil} {
+				es.Compression = compression
+				for _, tt := range tests {
+					got, err := es.QueryEvents(ctx, tt.q)
+					if tt.want == "" {
+						if !errors.Is(err, ErrPayloadCompressed) {
+							t.Errorf("%s: got %v, want ErrPayloadCompressed", tt.name, err)
+						}
+						continue
+					}
+					if err != nil || eventIds(got) != tt.want {
+						t.Errorf("%s: got %s %v, want %s", tt.name, eventIds(got), err, tt.want)
+					}
+				}
+			}
+
+			aq := AggregateQuery{Query: EventQuery{EventType: "status"}, Bucket: "day", EventTime: true, From: 1700000000, To: 1700000001, ValuePath: []string{"level"}}
+			if buckets, err := es.AggregateEvents(ctx, aq); err != nil || len(buckets) != 1 || buckets[0].Count != 3 {
+				t.Errorf("aggregation of the plain payloads: %+v %v", buckets, err)
+			}
+			aq.Query.EventType = ""
+			if _, err := es.AggregateEvents(ctx, aq); !errors.Is(err, ErrPayloadCompressed) {
+				t.Errorf("aggregation of the compressed payload: got %v, want ErrPayloadCompressed", err)
+			}
+
+			eraser := store.(Eraser)
+			if _, err := eraser.EraseEvents(ctx, ErasureRequest{OriginId: "o2", Paths: [][]string{{"level"}}, By: "test"}); err != nil {
+				t.Errorf("redaction of plain payloads: %v", err)
+			}
+			if _, err := eraser.EraseEvents(ctx, ErasureRequest{OriginId: "o1", Paths: [][]string{{"level"}}, By: "test"}); !errors.Is(err, ErrPayloadCompressed) {
+				t.Errorf("redaction of a compressed payload: got %v, want ErrPayloadCompressed", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package eventstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryption at rest of the payloads
+//
+// With PayloadKeys on the EventStream, SaveMessage encrypts the PayloadJson
+// of the events with AES-256-GCM before they are stored. The key is derived
+// per origin from a master key with HKDF-SHA256, and the EventId is
+// authenticated with the payload, so a payload cannot be moved to another
+// event. An encrypted event keeps {} in payload_json, the encrypted payload
+// is in payload_data and the id of its master key in payload_key_id. The
+// reads of the EventStream decrypt the payloads with the master key of the
+// row, so an old master key has to be kept until its events are encrypted
+// again with the new one, see ReencryptPayloads. A compressed payload is
+// compressed before it is encrypted, see compression.go.
+//
+// The database cannot look into encrypted payloads. Like the compressed
+// payloads it is decided per event, on payload_key_id and not on the master
+// keys: payload filters and aggregated payload values fail with
+// ErrPayloadEncrypted only when an encrypted event could be in their result,
+// and the paths of the payloads of an origin cannot be redacted while one of
+// its events is encrypted.
+
+// ErrPayloadEncrypted is returned for the queries on the payloads that the
+// database cannot answer because the payloads are encrypted
+var ErrPayloadEncrypted = errors.New("payloads are encrypted")
+
+// PayloadKeySize is the size of a master key in bytes
+const PayloadKeySize = 32
+
+// PayloadKeys are the master keys of the payload encryption
+type PayloadKeys struct {
+	KeyId      string            // of the master key new payloads are encrypted with, "" stores them in plain text
+	MasterKeys map[string][]byte // by key id, the old keys decrypt the events that were not encrypted again
+
+	aeads sync.Map // "<key id> <origin id>" to its cipher.AEAD
+}
+
+// Check validates the keys
+func (pk *PayloadKeys) Check() error {
+	for keyId, key := range pk.MasterKeys {
+		if keyId == "" || len(keyId) > 64 {
+			return fmt.Errorf("payload key id %q must have 1 to 64 characters", keyId)
+		}
+		if len(key) != PayloadKeySize {
+			return fmt.Errorf("payload key %s has %d bytes instead of %d", keyId, len(key), PayloadKeySize)
+		}
+	}
+	if _, ok := pk.MasterKeys[pk.KeyId]; pk.KeyId != "" && !ok {
+		return fmt.Errorf("there is no payload key %s", pk.KeyId)
+	}
+	return nil
+}
+
+// Encrypted reports if there can be encrypted payloads
+func (pk *PayloadKeys) Encrypted() bool {
+	return pk != nil && len(pk.MasterKeys) > 0
+}
+
+// aead returns the cipher of an origin under a master key
+func (pk *PayloadKeys) aead(keyId, originId string) (cipher.AEAD, error) {
+	cacheKey := keyId + " " + originId
+	if aead, ok := pk.aeads.Load(cacheKey); ok {
+		return aead.(cipher.AEAD), nil
+	}
+	masterKey, ok := pk.MasterKeys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("there is no payload key %s", keyId)
+	}
+
+	key := make([]byte, PayloadKeySize)
+	kdf := hkdf.New(sha256.New, masterKey, nil, []byte("kex-stream-server payload "+originId))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	pk.aeads.Store(cacheKey, aead)
+	return aead, nil
+}
+
+// Seal encrypts the payload of em with the key of its origin, a compressed
+// payload is encrypted as it is compressed, an empty payload is stored as it is
+func (pk *PayloadKeys) Seal(em EventMessage) (EventMessage, error) {
+	if pk == nil || pk.KeyId == "" || em.payloadKeyId != "" {
+		return em, nil
+	}
+	plain := em.payloadData
+	if em.payloadCodec == "" {
+		if bytes.Equal(em.PayloadJson, []byte("{}")) {
+			return em, nil
+		}
+		plain = em.PayloadJson
+		em.payloadSize = int64(len(em.PayloadJson))
+	}
+	aead, err := pk.aead(pk.KeyId, em.OriginId)
+	if err != nil {
+		return em, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return em, err
+	}
+	em.payloadData = aead.Seal(nonce, nonce, plain, []byte(em.EventId))
+	em.payloadKeyId = pk.KeyId
+	em.PayloadJson = json.RawMessage("{}")
+	return em, nil
+}
+
+// Open decrypts and decompresses the payload of em
+func (pk *PayloadKeys) Open(em EventMessage) (EventMessage, error) {
+	em, err := pk.unseal(em)
+	if err != nil {
+		return em, err
+	}
+	return em, inflatePayload(&em)
+}
+
+// unseal decrypts the payload of em, if it is encrypted, a compressed payload
+// stays compressed
+func (pk *PayloadKeys) unseal(em EventMessage) (EventMessage, error) {
+	if em.payloadKeyId == "" {
+		return em, nil
+	}
+	if pk == nil {
+		return em, fmt.Errorf("event %d is encrypted with payload key %s, there are no payload keys", em.Id, em.payloadKeyId)
+	}
+	aead, err := pk.aead(em.payloadKeyId, em.OriginId)
+	if err != nil {
+		return em, fmt.Errorf("event %d: %w", em.Id, err)
+	}
+	if len(em.payloadData) < aead.NonceSize() {
+		return em, fmt.Errorf("event %d: encrypted payload is too short", em.Id)
+	}
+	nonce, data := em.payloadData[:aead.NonceSize()], em.payloadData[aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, data, []byte(em.EventId))
+	if err != nil {
+		return em, fmt.Errorf("event %d: cannot decrypt the payload with key %s: %w", em.Id, em.payloadKeyId, err)
+	}
+	em.payloadKeyId = ""
+	if em.payloadCodec != "" {
+		em.payloadData = payload
+		return em, nil
+	}
+	em.PayloadJson = payload
+	em.payloadData = nil
+	em.payloadSize = 0
+	return em, nil
+}
+
+// OpenAll decrypts and decompresses the payloads of ems
+func (pk *PayloadKeys) OpenAll(ems []EventMessage) ([]EventMessage, error) {
+	for i := range ems {
+		em, err := pk.Open(ems[i])
+		if err != nil {
+			return ems, err
+		}
+		ems[i] = em
+	}
+	return ems, nil
+}
+
+// PayloadStore is a store of which the payloads can be encrypted again
+type PayloadStore interface {
+	// StalePayloads returns at most limit events with an Id above afterId,
+	// from old to new, of which the payload is not stored with keyId
+	StalePayloads(ctx context.Context, keyId string, afterId int64, limit int) ([]EventMessage, error)
+	// UpdatePayloads stores the payload of ems[i] in place of the payload of
+	// stale[i], when the event is still stored as stale[i], it returns the
+	// number of events that were updated
+	UpdatePayloads(ctx context.Context, stale, ems []EventMessage) (int64, error)
+}
+
+// ReencryptReport is the outcome of ReencryptPayloads
+type ReencryptReport struct {
+	KeyId       string
+	Events      int64
+	Reencrypted int64
+	Skipped     int64 // changed in the meantime, for instance erased
+}
+
+// ReencryptPayloads encrypts all stored payloads again with the KeyId of
+// keys, in batches of batchSize events, the payloads in plain text are
+// encrypted too, or with an empty KeyId all payloads are decrypted. The
+// payloads that are not compressed yet are compressed with compression.
+func ReencryptPayloads(ctx context.Context, store PayloadStore, keys *PayloadKeys, compression *PayloadCompression, batchSize int) (ReencryptReport, error) {
+	report := ReencryptReport{KeyId: keys.KeyId}
+	afterId := int64(0)
+	for {
+		stale, err := store.StalePayloads(ctx, keys.KeyId, afterId, batchSize)
+		if err != nil {
+			return report, err
+		}
+		if len(stale) == 0 {
+			return report, nil
+		}
+
+		ems := make([]EventMessage, len(stale))
+		for i := range stale {
+			em, err := keys.unseal(stale[i])
+			if err != nil {
+				return report, err
+			}
+			em, err = compression.Compress(em)
+			if err != nil {
+				return report, err
+			}
+			ems[i], err = keys.Seal(em)
+			if err != nil {
+				return report, err
+			}
+		}
+		updated, err := store.UpdatePayloads(ctx, stale, ems)
+		if err != nil {
+			return report, err
+		}
+		report.Events += int64(len(stale))
+		report.Reencrypted += updated
+		report.Skipped += int64(len(stale)) - updated
+		afterId = stale[len(stale)-1].Id
+	}
+}
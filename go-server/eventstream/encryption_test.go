@@ -0,0 +1,189 @@
+package eventstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testPayloadKeys are payload keys with the master keys of keyIds, the
+// master key of a key id is always the same
+func testPayloadKeys(keyId string, keyIds ...string) *PayloadKeys {
+	pk := &PayloadKeys{KeyId: keyId, MasterKeys: map[string][]byte{}}
+	for _, id := range keyIds {
+		key := sha256.Sum256([]byte(id))
+		pk.MasterKeys[id] = key[:]
+	}
+	return pk
+}
+
+func TestPayloadKeysOpen(t *testing.T) {
+	keys := testPayloadKeys("k1", "k1", "k2")
+	sealed, err := keys.Seal(testEvent("o1", "e1", `{"secret":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sealed.PayloadJson) != "{}" || sealed.payloadKeyId != "k1" || bytes.Contains(sealed.payloadData, []byte("secret")) {
+		t.Fatalf("sealed payload %s with key %q, data %q", sealed.PayloadJson, sealed.payloadKeyId, sealed.payloadData)
+	}
+
+	tests := []struct {
+		name   string
+		keys   *PayloadKeys
+		change func(em *EventMessage)
+		ok     bool
+	}{
+		{"same keys", keys, func(em *EventMessage) {}, true},
+		{"only the key of the event", testPayloadKeys("", "k1"), func(em *EventMessage) {}, true},
+		{"another origin", keys, func(em *EventMessage) { em.OriginId = "o2" }, false},
+		{"another EventId", keys, func(em *EventMessage) { em.EventId = "e2" }, false},
+		{"another master key", keys, func(em *EventMessage) { em.payloadKeyId = "k2" }, false},
+		{"unknown master key", testPayloadKeys("k2", "k2"), func(em *EventMessage) {}, false},
+		{"no keys", nil, func(em *EventMessage) {}, false},
+		{"changed data", keys, func(em *EventMessage) {
+			em.payloadData = append([]byte{}, em.payloadData...)
+			em.payloadData[len(em.payloadData)-1] ^= 1
+		}, false},
+	}
+	for _, tt := range tests {
+		em := sealed
+		tt.change(&em)
+		opened, err := tt.keys.Open(em)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && string(opened.PayloadJson) != `{"secret":1}` {
+			t.Errorf("%s: opened %s", tt.name, opened.PayloadJson)
+		}
+	}
+
+	// the nonce is new for every payload
+	again, err := keys.Seal(testEvent("o1", "e1", `{"secret":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again.payloadData, sealed.payloadData) {
+		t.Error("the same payload was sealed to the same data twice")
+	}
+}
+
+func TestPayloadEncryption(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			es := &EventStream{Store: store, Keys: testPayloadKeys("k1", "k1")}
+			for i := 0; i < 5; i++ {
+				if _, err := es.SaveMessage(ctx, testEvent("o1", fmt.Sprint("e", i), fmt.Sprintf(`{"i":%d}`, i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := es.SaveMessage(ctx, testEvent("o1", "empty", `{}`)); err != nil {
+				t.Fatal(err)
+			}
+			checkPayloads(t, es, "k1")
+
+			// rotate to k2, the old key is needed until the reencrypt is done
+			es.Keys = testPayloadKeys("k2", "k1", "k2")
+			report, err := ReencryptPayloads(ctx, store.(PayloadStore), es.Keys, nil, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Events != 5 || report.Reencrypted != 5 {
+				t.Fatalf("reencrypted %d of %d events, want 5", report.Reencrypted, report.Events)
+			}
+			es.Keys = testPayloadKeys("k2", "k2")
+			checkPayloads(t, es, "k2")
+
+			// and decrypt them all
+			es.Keys = testPayloadKeys("", "k2")
+			if _, err := ReencryptPayloads(ctx, store.(PayloadStore), es.Keys, nil, 2); err != nil {
+				t.Fatal(err)
+			}
+			es.Keys = nil
+			checkPayloads(t, es, "")
+		})
+	}
+}
+
+func TestPayloadFiltersEncryptedEvents(t *testing.T) {
+	level, _ := ParsePayloadFilter("level=1")
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			es := &EventStream{Store: store}
+			for _, e := range [][2]string{{"o1", "e1"}, {"o2", "e2"}} {
+				if _, err := es.SaveMessage(ctx, testEvent(e[0], e[1], `{"level":1}`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the master keys alone refuse nothing, the saved payloads are plain
+			es.Keys = testPayloadKeys("k1", "k1")
+			if got, err := es.QueryEvents(ctx, EventQuery{Payload: []PayloadFilter{level}}); err != nil || eventIds(got) != "e2 e1" {
+				t.Errorf("filter on plain payloads: got %s %v, want e2 e1", eventIds(got), err)
+			}
+
+			if _, err := es.SaveMessage(ctx, testEvent("o1", "e3", `{"level":1}`)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := es.QueryEvents(ctx, EventQuery{Payload: []PayloadFilter{level}}); !errors.Is(err, ErrPayloadEncrypted) {
+				t.Errorf("filter on an encrypted payload: got %v, want ErrPayloadEncrypted", err)
+			}
+			if got, err := es.QueryEvents(ctx, EventQuery{OriginId: "o2", Payload: []PayloadFilter{level}}); err != nil || eventIds(got) != "e2" {
+				t.Errorf("filter on the plain payloads of o2: got %s %v, want e2", eventIds(got), err)
+			}
+			aq := AggregateQuery{Bucket: "day", EventTime: true, From: 1700000000, To: 1700000001, ValuePath: []string{"level"}}
+			if _, err := es.AggregateEvents(ctx, aq); !errors.Is(err, ErrPayloadEncrypted) {
+				t.Errorf("aggregation of an encrypted payload: got %v, want ErrPayloadEncrypted", err)
+			}
+
+			eraser := store.(Eraser)
+			if _, err := eraser.EraseEvents(ctx, ErasureRequest{OriginId: "o2", Paths: [][]string{{"level"}}, By: "test"}); err != nil {
+				t.Errorf("redaction of plain payloads: %v", err)
+			}
+			if _, err := eraser.EraseEvents(ctx, ErasureRequest{OriginId: "o1", Paths: [][]string{{"level"}}, By: "test"}); !errors.Is(err, ErrPayloadEncrypted) {
+				t.Errorf("redaction of an encrypted payload: got %v, want ErrPayloadEncrypted", err)
+			}
+		})
+	}
+}
+
+// checkPayloads checks that the payloads are stored with keyId and that the
+// EventStream reads them as they were saved
+func checkPayloads(t *testing.T, es *EventStream, keyId string) {
+	t.Helper()
+	ctx := context.Background()
+	stored, err := es.Store.QueryEvents(ctx, EventQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range stored {
+		em := &stored[i]
+		want := keyId
+		if em.EventId == "empty" {
+			want = ""
+		}
+		if em.payloadKeyId != want || (want != "" && string(em.PayloadJson) != "{}") {
+			t.Errorf("%s is stored as %s with key %q, want key %q", em.EventId, em.PayloadJson, em.payloadKeyId, want)
+		}
+	}
+
+	read, err := es.QueryEvents(ctx, EventQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range read {
+		em := &read[i]
+		want := "{}"
+		if em.EventId != "empty" {
+			want = fmt.Sprintf(`{"i":%s}`, em.EventId[1:])
+		}
+		if string(em.PayloadJson) != want {
+			t.Errorf("%s is read as %s, want %s", em.EventId, em.PayloadJson, want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// erasure of personal data
+//
+// origins.owner_email ties the origins to the people that own them, and some
+// payloads contain personal data. An erasure empties the payload, the
+// EventSubtype and the OriginGroupId of all events of an origin, or of all
+// origins of an owner, a redaction only removes some paths from the
+// payloads. The events sent by the origins and the events sent to them are
+// erased. They stay as tombstones with their Id, EventId, type, iters and
+// times, so the iters have no gaps and the pagination of the consumers keeps
+// working. Encrypted and compressed payloads are erased too, but their paths
+// cannot be redacted, so a redaction fails while one of the events of the
+// origins is stored encrypted or compressed, see encryption.go and
+// compression.go.
+//
+// Every erasure is recorded in the erasures table, with who did it and why.
+// Archives exported before an erasure still hold the data, they have to be
+// erased or expired on their own, see archive.go.
+
+// Eraser is a store that can erase the personal data of events
+type Eraser interface {
+	EraseEvents(ctx context.Context, req ErasureRequest) (Erasure, error)
+	// Erasures returns the audit of the erasures, oldest first
+	Erasures(ctx context.Context) ([]Erasure, error)
+}
+
+// ErasureRequest selects the events to erase by OriginId or by OwnerEmail
+type ErasureRequest struct {
+	OriginId   string
+	OwnerEmail string // all origins with this owner_email
+
+	// payload paths to redact, keys or array indexes like a PayloadFilter,
+	// nil erases the whole payload
+	Paths [][]string
+
+	By     string // who asked for the erasure
+	Reason string
+}
+
+// Erasure is the audit record of an erasure
+type Erasure struct {
+	Id          int64
+	TimeUnixSec int64
+	By          string
+	Reason      string
+	OriginIds   []string // the origins of the owner at the time of the erasure
+	OwnerEmail  string
+	Paths       [][]string
+
+	// the number of events that were changed, and their range of ids
+	Events int64
+	MinId  int64
+	MaxId  int64
+}
+
+// Check validates the request
+func (req *ErasureRequest) Check() error {
+	if (req.OriginId == "") == (req.OwnerEmail == "") {
+		return errors.New("erasure needs either an OriginId or an OwnerEmail")
+	}
+	if req.By == "" {
+		return errors.New("erasure needs the name of who erases")
+	}
+	for _, path := range req.Paths {
+		if len(path) == 0 {
+			return errors.New("erasure path is empty")
+		}
+		for _, key := range path {
+			if key == "" {
+				return fmt.Errorf("erasure path %q has an empty key", strings.Join(path, "."))
+			}
+		}
+	}
+	return nil
+}
+
+// erasure starts the audit record of req
+func (req *ErasureRequest) erasure(originIds []string, now int64) Erasure {
+	paths := req.Paths
+	if paths == nil {
+		paths = [][]string{}
+	}
+	return Erasure{
+		TimeUnixSec: now,
+		By:          req.By,
+		Reason:      req.Reason,
+		OriginIds:   originIds,
+		OwnerEmail:  req.OwnerEmail,
+		Paths:       paths,
+	}
+}
+
+// add counts an erased event in the audit record
+func (e *Erasure) add(id int64) {
+	if e.Events == 0 || id < e.MinId {
+		e.MinId = id
+	}
+	if id > e.MaxId {
+		e.MaxId = id
+	}
+	e.Events++
+}
+
+// sqlErase translates the erasure of the events of originIds into an
+// UPDATE of the events table that returns the ids of the changed events.
+// The events that have nothing left to erase are not changed, so erasing
+// twice does not change the time of the first erasure.
+func (req *ErasureRequest) sqlErase(dialect string, originIds []string, now int64) (string, []interface{}) {
+	a := &sqlArgs{dialect: dialect}
+
+	// the placeholders of SQLite are positional, so the parameters are
+	// added in the order of the statement
+	set := "payload_json = '{}', payload_data = NULL, payload_key_id = NULL, payload_codec = NULL, payload_size = NULL, event_subtype = '', origin_group_id = ''"
+	if len(req.Paths) > 0 && dialect == "postgres" {
+		set = "payload_json = payload_json"
+		for _, path := range req.Paths {
+			set += " #- " + a.add(path) + "::text[]"
+		}
+	} else if len(req.Paths) > 0 {
+		paths, _ := json.Marshal(req.Paths)
+		set = "payload_json = kex_payload_redact(payload_json, " + a.add(string(paths)) + ")"
+	}
+	set += ", redacted_time_unix_sec = " + a.add(now)
+
+	origins := sqlOrigins(a, originIds)
+
+	changed := "NOT (payload_json = '{}' AND payload_data IS NULL AND COALESCE(event_subtype, '') = '' AND COALESCE(origin_group_id, '') = '')"
+	if len(req.Paths) > 0 && dialect == "postgres" {
+		found := make([]string, len(req.Paths))
+		for i, path := range req.Paths {
+			found[i] = "payload_json #> " + a.add(path) + "::text[] IS NOT NULL"
+		}
+		changed = "(" + strings.Join(found, " OR ") + ")"
+	} else if len(req.Paths) > 0 {
+		paths, _ := json.Marshal(req.Paths)
+		changed = "kex_payload_redact(payload_json, " + a.add(string(paths)) + ") IS NOT NULL"
+	}
+
+	return "UPDATE events SET " + set + " WHERE " + origins + " AND " + changed + " RETURNING id", a.args
+}
+
+// sqlOrigins is the condition of the events sent by or sent to originIds
+func sqlOrigins(a *sqlArgs, originIds []string) string {
+	if a.dialect == "postgres" {
+		return "(origin_id = ANY(" + a.add(originIds) + "::text[]) OR destination_id = ANY(" + a.add(originIds) + "::text[]))"
+	}
+	in := func() string {
+		placeholders := make([]string, len(originIds))
+		for i, id := range originIds {
+			placeholders[i] = a.add(id)
+		}
+		return "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	return "(origin_id IN " + in() + " OR destination_id IN " + in() + ")"
+}
+
+// sqlOpaqueOrigins builds the query of the highest sqlOpaqueLevel of the
+// events of originIds, of which the paths of the payloads cannot be redacted
+func sqlOpaqueOrigins(dialect string, originIds []string) (string, []interface{}) {
+	a := &sqlArgs{dialect: dialect}
+	return "SELECT COALESCE(max(" + sqlOpaqueLevel + "), 0) FROM events WHERE " + sqlOrigins(a, originIds) + " AND " + sqlOpaquePayload, a.args
+}
+
+// redactPayload removes the paths from a payload, it returns false if none
+// of the paths was in the payload
+func redactPayload(payload json.RawMessage, paths [][]string) (json.RawMessage, bool) {
+	value, err := decodePayload(payload)
+	if err != nil {
+		return payload, false
+	}
+	redacted := false
+	for _, path := range paths {
+		removed := false
+		value, removed = payloadRemove(value, path)
+		redacted = redacted || removed
+	}
+	if !redacted {
+		return payload, false
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return payload, false
+	}
+	return data, true
+}
@@ -1,22 +1,28 @@
 package eventstream
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
-
-	"github.com/jackc/pgx/v4/pgxpool"
+	"strings"
 )
 
 type Handler struct {
 	Debug       bool
 	BaseUrl     string
 	StaticPath  string
-	Conn        *pgxpool.Pool
 	Secure      *Secure
 	EventStream *EventStream
+
+	// the password of the api, for the endpoints that read the events of
+	// other origins than the requesting one, "" disables them
+	ApiPass string
 }
 
 func setHeaders(w *http.ResponseWriter) {
@@ -28,8 +34,19 @@ func setHeaders(w *http.ResponseWriter) {
 
 func (h *Handler) debugMsg(msg ...interface{}) {
 	if h.Debug {
-		fmt.Println(msg)
+		fmt.Println(msg...)
+	}
+}
+
+// apiAuthorized checks the <pass> of the api, if it is wrong it writes the
+// error and returns false
+func (h *Handler) apiAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if h.ApiPass == "" || r.FormValue("pass") != h.ApiPass {
+		h.debugMsg("BLOCKED: invalid api pass")
+		http.Error(w, "access denied", http.StatusUnauthorized)
+		return false
 	}
+	return true
 }
 
 func (h *Handler) AddEvent(w http.ResponseWriter, r *http.Request) {
@@ -83,19 +100,212 @@ func (h *Handler) AddEvent(w http.ResponseWriter, r *http.Request) {
 
 	event.OriginId = originId    // just making sure you post to the same origin as provided in the request
 	event.DestinationId = destId // just making sure you post to the same destination as provided in the request
-	eventSaved, err := h.EventStream.SaveMessage(event)
-	if err != nil {
+	var eventSaved EventMessage
+	if expected := r.FormValue("expectedVersion"); expected != "" {
+		// only save if no other event was saved to the destination since
+		// the writer read it at this version
+		expectedVersion, parseErr := strconv.ParseInt(expected, 10, 64)
+		if parseErr != nil || expectedVersion < 0 {
+			http.Error(w, "expectedVersion must be a non-negative integer", 400)
+			return
+		}
+		eventSaved, err = h.EventStream.SaveExpected(r.Context(), event, expectedVersion)
+	} else {
+		eventSaved, err = h.EventStream.SaveMessage(r.Context(), event)
+	}
+	duplicate := errors.Is(err, ErrDuplicateEvent)
+	versionErr := &VersionError{}
+	if errors.As(err, &versionErr) {
+		// tell the writer the version to read up to before it tries again
+		h.debugMsg(versionErr)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		js, _ := json.Marshal(struct {
+			Error   string
+			Version int64
+		}{Error: versionErr.Error(), Version: versionErr.Version})
+		w.Write(js)
+		return
+	}
+	schemaErr := &SchemaError{}
+	if errors.As(err, &schemaErr) {
+		// tell the origin what part of the payload does not match
+		h.debugMsg(schemaErr)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		js, _ := json.Marshal(struct {
+			Error      string
+			Violations []SchemaViolation
+		}{Error: schemaErr.Error(), Violations: schemaErr.Violations})
+		w.Write(js)
+		return
+	}
+	if errors.Is(err, ErrEventDeleted) {
+		// a retry long after the original, which retention removed since
+		h.debugMsg(err)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if errors.Is(err, ErrInvalidSignature) {
+		// the origin has a public key, the password is not enough
+		h.debugMsg(err)
+		http.Error(w, err.Error(), 401)
+		return
+	}
+	if errors.Is(err, ErrInvalidEvent) {
+		// a field is missing or the payload is not valid JSON, a retry
+		// would fail the same way
+		h.debugMsg(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil && !duplicate {
 		h.debugMsg("error saving EventMessage:", err)
-		http.Error(w, "error saving event", http.StatusInternalServerError)
+		h.storeError(w, err, "error saving event")
 		return
 	}
 
-	idObj := struct{ Id int64 }{Id: eventSaved.Id}
+	// a retried event returns the Id of the original, Version is the
+	// DestinationIter of the event, the version of the destination after it
+	idObj := struct {
+		Id        int64
+		Duplicate bool
+		Version   int64
+	}{Id: eventSaved.Id, Duplicate: duplicate, Version: eventSaved.DestinationIter}
 	js, _ := json.Marshal(idObj)
 	w.Write(js)
 
 }
 
+// AddEvents saves a batch of events in a single transaction, for instance
+// the events an origin buffered while it was offline.
+// The body is a JSON array of EventMessages, or NDJSON with one EventMessage
+// per line. The origin is authenticated once, and the batch counts as
+// Secure.BatchWeight requests against the rate limit, a batch that does not
+// fit in what is left of the limit is refused as a whole.
+//
+// Every event gets a result, in the same order as the request:
+// [{"Id": 12, "Duplicate": false, "Error": ""}, ...]
+// a payload that does not match its schema also gets the Violations,
+// null for the other events
+func (h *Handler) AddEvents(w http.ResponseWriter, r *http.Request) {
+	setHeaders(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(200)
+		return
+	}
+
+	originId := r.FormValue("id")
+	destId := r.FormValue("destId")
+	// if no destination is set, post to yourself
+	if destId == "" {
+		destId = originId
+	}
+	fmt.Println("AddEvents originId:", originId, "destId:", destId)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 16*1024*1024) // max 16mb
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		h.debugMsg(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	events, err := parseEventBatch(data)
+	if err != nil {
+		h.debugMsg("json error:", err)
+		http.Error(w, "json error", http.StatusBadRequest)
+		return
+	}
+	if len(events) > maxBatchEvents {
+		h.debugMsg("batch of", len(events), "events is above the maximum of", maxBatchEvents)
+		http.Error(w, fmt.Sprint("a batch cannot have more than ", maxBatchEvents, " events"), 400)
+		return
+	}
+	// the whole batch has to fit in the rate limit before anything is saved
+	secure, err, msg := h.Secure.CheckWeighted(destId, r.FormValue("p"), h.Secure.BatchWeight(len(events)))
+	if !secure {
+		h.debugMsg(msg)
+		http.Error(w, "not authorized", 401)
+		return
+	}
+	if err != nil {
+		h.debugMsg(err)
+		http.Error(w, "authentication error", 500)
+		return
+	}
+
+	for i := range events {
+		events[i].OriginId = originId    // just making sure you post to the same origin as provided in the request
+		events[i].DestinationId = destId // just making sure you post to the same destination as provided in the request
+	}
+	saved, err := h.EventStream.SaveMessages(r.Context(), events)
+	if err != nil {
+		h.debugMsg("error saving batch of EventMessages:", err)
+		h.storeError(w, err, "error saving events")
+		return
+	}
+
+	type result struct {
+		Id         int64
+		Duplicate  bool
+		Error      string
+		Violations []SchemaViolation
+	}
+	results := make([]result, len(saved))
+	for i, s := range saved {
+		results[i].Id = s.Event.Id
+		schemaErr := &SchemaError{}
+		switch {
+		case s.Err == nil:
+		case errors.Is(s.Err, ErrDuplicateEvent):
+			results[i].Duplicate = true
+		case errors.As(s.Err, &schemaErr):
+			results[i].Id = 0
+			results[i].Error = schemaErr.Error()
+			results[i].Violations = schemaErr.Violations
+		case errors.Is(s.Err, ErrInvalidEvent), errors.Is(s.Err, ErrInvalidSignature), errors.Is(s.Err, ErrEventDeleted):
+			results[i].Id = 0
+			results[i].Error = s.Err.Error()
+		default:
+			h.debugMsg("error saving EventMessage:", s.Err)
+			results[i].Id = 0
+			results[i].Error = "error saving event"
+		}
+	}
+	js, _ := json.Marshal(results)
+	w.Write(js)
+}
+
+// maxBatchEvents is the maximum number of events AddEvents accepts at once
+const maxBatchEvents = 1000
+
+// parseEventBatch reads a JSON array or NDJSON of EventMessages
+func parseEventBatch(data []byte) ([]EventMessage, error) {
+	data = bytes.TrimSpace(data)
+	events := []EventMessage{}
+
+	if len(data) > 0 && data[0] == '[' {
+		err := json.Unmarshal(data, &events)
+		return events, err
+	}
+
+	// NDJSON, the decoder reads one EventMessage after the other
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		event := EventMessage{}
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+}
+
 // GetOriginEvents gets the events from the provided originId <id>
 // Events are returned paginated, from new to old
 // To get the next page, provide the last (lowest) <lastId> from the previous page
@@ -114,6 +324,13 @@ func (h *Handler) AddEvent(w http.ResponseWriter, r *http.Request) {
 //
 // if no <newestId> is provided, paginated results until the very first
 // events are returned
+//
+// Alternatively, to catch up on events since an iter, from old to new:
+// <sinceIter> gets the events for <id> with DestinationIter > sinceIter
+// <sinceOriginIter> gets the events sent by <id> with OriginIter > sinceOriginIter
+//
+// Without an iter, the events can be filtered with the parameters of
+// QueryEvents, e.g. <eventType>
 func (h *Handler) GetOriginEvents(w http.ResponseWriter, r *http.Request) {
 	setHeaders(&w)
 	if r.Method == "OPTIONS" {
@@ -140,8 +357,45 @@ func (h *Handler) GetOriginEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	eventType := r.FormValue("eventType")
-	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	q, ok := h.queryParams(w, r)
+	if !ok {
+		return
+	}
+
+	sinceIter, errSinceIter := strconv.ParseInt(r.FormValue("sinceIter"), 10, 64)
+	sinceOriginIter, errSinceOriginIter := strconv.ParseInt(r.FormValue("sinceOriginIter"), 10, 64)
+
+	ms := []EventMessage{}
+
+	if errSinceIter == nil {
+		// events for this device since a DestinationIter, from old to new
+		ms, err = h.EventStream.GetByDestinationIdSinceIter(r.Context(), destId, sinceIter, q.Limit)
+	} else if errSinceOriginIter == nil {
+		// events sent by this device since an OriginIter, from old to new
+		ms, err = h.EventStream.GetByOriginIdSinceIter(r.Context(), destId, sinceOriginIter, q.Limit)
+	} else {
+		// the events for this device, optionally filtered like QueryEvents
+		q.DestinationId = destId
+		ms, err = h.EventStream.QueryEvents(r.Context(), q)
+	}
+	if err != nil {
+		fmt.Println("error getting event messages:", err)
+		h.storeError(w, err, "error getting event messages")
+		return
+	}
+	ms, ok = h.upcastEvents(w, r, ms)
+	if !ok {
+		return
+	}
+	js, _ := json.Marshal(&ms)
+
+	w.Write(js)
+}
+
+// pageParams reads the pagination of the event lists: newestId, lastId and
+// limit, if the limit is too high it writes the error and returns false
+func (h *Handler) pageParams(w http.ResponseWriter, r *http.Request) (newestId, lastId, limit int, ok bool) {
+	limit, _ = strconv.Atoi(r.FormValue("limit"))
 	// if no limit is provided get the first 100 messages, to avoid spam
 	if limit == 0 {
 		limit = 100
@@ -150,36 +404,431 @@ func (h *Handler) GetOriginEvents(w http.ResponseWriter, r *http.Request) {
 	if limit > 1000 {
 		h.debugMsg("limit was set above the maxium of 1000 event messages")
 		http.Error(w, "limit cannot be more than 1000", 400)
-		return
+		return 0, 0, 0, false
 	}
-	lastId, _ := strconv.Atoi(r.FormValue("lastId"))
+	lastId, _ = strconv.Atoi(r.FormValue("lastId"))
 	newestId, err := strconv.Atoi(r.FormValue("newestId"))
 	if err != nil {
 		newestId = -1 // if newestId is not set, get all messages from the start
 	}
+	return newestId, lastId, limit, true
+}
 
-	ms := []EventMessage{}
+// queryParams reads an EventQuery from the request, the filters are optional:
+// originId, destId, groupId, eventType, eventSubtype, eventVersion,
+// originBuildVersion, eventTimeFrom, eventTimeTo, creationTimeFrom and
+// creationTimeTo (unix seconds), with the pagination of pageParams
+// <payload> filters on the payload, e.g. payload=level<20, it can be given
+// more than once, see PayloadFilter for the syntax
+// if a parameter is invalid it writes the error and returns false
+func (h *Handler) queryParams(w http.ResponseWriter, r *http.Request) (EventQuery, bool) {
+	q := EventQuery{
+		OriginId:           r.FormValue("originId"),
+		DestinationId:      r.FormValue("destId"),
+		OriginGroupId:      r.FormValue("groupId"),
+		EventType:          r.FormValue("eventType"),
+		EventSubtype:       r.FormValue("eventSubtype"),
+		EventVersion:       r.FormValue("eventVersion"),
+		OriginBuildVersion: r.FormValue("originBuildVersion"),
+	}
+
+	times := []struct {
+		param string
+		value *int64
+	}{
+		{"eventTimeFrom", &q.EventTimeFrom},
+		{"eventTimeTo", &q.EventTimeTo},
+		{"creationTimeFrom", &q.CreationTimeFrom},
+		{"creationTimeTo", &q.CreationTimeTo},
+	}
+	for _, t := range times {
+		if r.FormValue(t.param) == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(r.FormValue(t.param), 10, 64)
+		if err != nil {
+			h.debugMsg("invalid", t.param, err)
+			http.Error(w, t.param+" must be a unix time in seconds", 400)
+			return q, false
+		}
+		*t.value = value
+	}
+
+	for _, p := range r.Form["payload"] {
+		filter, err := ParsePayloadFilter(p)
+		if err != nil {
+			h.debugMsg("invalid payload filter", err)
+			http.Error(w, err.Error(), 400)
+			return q, false
+		}
+		q.Payload = append(q.Payload, filter)
+	}
+
+	newestId, lastId, limit, ok := h.pageParams(w, r)
+	q.NewestId = int64(newestId)
+	q.LastId = int64(lastId)
+	q.Limit = limit
+	return q, ok
+}
+
+// storeError writes the error of an EventStream call, a store that did not
+// answer before the deadline is a 504 and a canceled call a 503, so the
+// client knows it can retry, a query on encrypted or compressed payloads is
+// a 400, the other errors are a 500 with msg
+func (h *Handler) storeError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "timeout "+msg, http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		http.Error(w, "canceled "+msg, http.StatusServiceUnavailable)
+	case errors.Is(err, ErrPayloadEncrypted), errors.Is(err, ErrPayloadCompressed):
+		http.Error(w, err.Error(), 400)
+	default:
+		http.Error(w, msg, http.StatusInternalServerError)
+	}
+}
+
+// upcastEvents converts the events of <eventType> to <targetVersion>, if it
+// is set, the other events are returned as they are
+// if an event cannot be converted it writes the error and returns false
+func (h *Handler) upcastEvents(w http.ResponseWriter, r *http.Request, ms []EventMessage) ([]EventMessage, bool) {
+	targetVersion := r.FormValue("targetVersion")
+	if targetVersion == "" {
+		return ms, true
+	}
+	eventType := r.FormValue("eventType")
+	if eventType == "" {
+		http.Error(w, "targetVersion needs an eventType", 400)
+		return ms, false
+	}
+	ms, err := h.EventStream.UpcastEvents(ms, eventType, targetVersion)
+	if errors.Is(err, ErrNoUpcaster) {
+		h.debugMsg(err)
+		http.Error(w, err.Error(), 400)
+		return ms, false
+	}
+	if err != nil {
+		fmt.Println("error upcasting event messages:", err)
+		http.Error(w, "error upcasting event messages", http.StatusInternalServerError)
+		return ms, false
+	}
+	return ms, true
+}
+
+// QueryEvents gets the events of the requesting destination <id> matching
+// the filters of queryParams, paginated from new to old in the same way as
+// GetOriginEvents (newestId, lastId, limit)
+// <originId> and <groupId> filter on the origins that sent the events to
+// <id>, a <destId> other than <id> is not authorized
+func (h *Handler) QueryEvents(w http.ResponseWriter, r *http.Request) {
+	setHeaders(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(200)
+		return
+	}
+
+	id := r.FormValue("id")
+	fmt.Println("QueryEvents id:", id)
+	secure, err, msg := h.Secure.Check(id, r.FormValue("p"))
+	if !secure {
+		h.debugMsg(msg)
+		http.Error(w, "not authorized", 401)
+		return
+	}
+	if err != nil {
+		h.debugMsg(err)
+		http.Error(w, "authentication error", 500)
+		return
+	}
+
+	q, ok := h.queryParams(w, r)
+	if !ok {
+		return
+	}
+	if q.DestinationId != "" && q.DestinationId != id {
+		h.debugMsg("BLOCKED:", id, "cannot query the events of", q.DestinationId)
+		http.Error(w, "not authorized", 401)
+		return
+	}
+	q.DestinationId = id
+	ms, err := h.EventStream.QueryEvents(r.Context(), q)
+	if err != nil {
+		fmt.Println("error getting event messages:", err)
+		h.storeError(w, err, "error getting event messages")
+		return
+	}
+	ms, ok = h.upcastEvents(w, r, ms)
+	if !ok {
+		return
+	}
+	js, _ := json.Marshal(&ms)
+
+	w.Write(js)
+}
+
+// GetEvent gets a single event by the <eventId> its origin gave it
+// <originId> is the origin that saved the event, by default the
+// requesting origin <id>
+// returns 404 if there is no such event, or if the event was neither sent
+// by <id> nor to it
+func (h *Handler) GetEvent(w http.ResponseWriter, r *http.Request) {
+	setHeaders(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(200)
+		return
+	}
+
+	id := r.FormValue("id")
+	originId := r.FormValue("originId")
+	if originId == "" {
+		originId = id
+	}
+	eventId := r.FormValue("eventId")
+	fmt.Println("GetEvent id:", id, "originId:", originId, "eventId:", eventId)
+	secure, err, msg := h.Secure.Check(id, r.FormValue("p"))
+	if !secure {
+		h.debugMsg(msg)
+		http.Error(w, "not authorized", 401)
+		return
+	}
+	if err != nil {
+		h.debugMsg(err)
+		http.Error(w, "authentication error", 500)
+		return
+	}
+
+	if eventId == "" {
+		http.Error(w, "eventId not set", 400)
+		return
+	}
+
+	em, err := h.EventStream.GetByEventId(r.Context(), originId, eventId)
+	if err == nil && em.OriginId != id && em.DestinationId != id {
+		// the same as an event that does not exist, so other origins cannot
+		// find out which EventIds are used
+		h.debugMsg("BLOCKED:", id, "is not the origin or destination of", eventId)
+		err = ErrEventNotFound
+	}
+	if errors.Is(err, ErrEventNotFound) {
+		http.Error(w, "event not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Println("error getting event message:", err)
+		h.storeError(w, err, "error getting event message")
+		return
+	}
+	ms, ok := h.upcastEvents(w, r, []EventMessage{em})
+	if !ok {
+		return
+	}
+	js, _ := json.Marshal(&ms[0])
+
+	w.Write(js)
+}
+
+// GetTypeEvents gets the events of <eventType> across the whole stream,
+// paginated from new to old in the same way as GetOriginEvents
+// (newestId, lastId, limit)
+// the events of all origins are returned, so it needs the <pass> of the api
+func (h *Handler) GetTypeEvents(w http.ResponseWriter, r *http.Request) {
+	setHeaders(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(200)
+		return
+	}
+
+	eventType := r.FormValue("eventType")
+	fmt.Println("GetTypeEvents eventType:", eventType)
+	if !h.apiAuthorized(w, r) {
+		return
+	}
 
-	// if no eventType is provided, get all eventMessages from this device
 	if eventType == "" {
-		if lastId != 0 {
-			ms, err = h.EventStream.GetByDestinationIdPage(destId, newestId, lastId, limit)
-		} else {
-			ms, err = h.EventStream.GetByDestinationId(destId, newestId, limit)
+		http.Error(w, "eventType not set", 400)
+		return
+	}
+	newestId, lastId, limit, ok := h.pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	ms, err := h.EventStream.GetByEventType(r.Context(), eventType, newestId, lastId, limit)
+	if err != nil {
+		fmt.Println("error getting event messages:", err)
+		h.storeError(w, err, "error getting event messages")
+		return
+	}
+	ms, ok = h.upcastEvents(w, r, ms)
+	if !ok {
+		return
+	}
+	js, _ := json.Marshal(&ms)
+
+	w.Write(js)
+}
+
+// GetGroupEvents gets the events sent by the origins with OriginGroupId
+// <groupId>, paginated from new to old in the same way as GetOriginEvents
+// (newestId, lastId, limit)
+// the events of all origins in the group are returned, so it needs the
+// <pass> of the api
+func (h *Handler) GetGroupEvents(w http.ResponseWriter, r *http.Request) {
+	setHeaders(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(200)
+		return
+	}
+
+	groupId := r.FormValue("groupId")
+	fmt.Println("GetGroupEvents groupId:", groupId)
+	if !h.apiAuthorized(w, r) {
+		return
+	}
+
+	if groupId == "" {
+		http.Error(w, "groupId not set", 400)
+		return
+	}
+	newestId, lastId, limit, ok := h.pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	ms, err := h.EventStream.GetByOriginGroupId(r.Context(), groupId, newestId, lastId, limit)
+	if err != nil {
+		fmt.Println("error getting event messages:", err)
+		h.storeError(w, err, "error getting event messages")
+		return
+	}
+	ms, ok = h.upcastEvents(w, r, ms)
+	if !ok {
+		return
+	}
+	js, _ := json.Marshal(&ms)
+
+	w.Write(js)
+}
+
+// GetLatestEvents gets the latest event of every event type of the
+// destinations in <destIds>, comma separated, by default of the requesting
+// origin <id>, ordered by destination and event type
+// destinations other than <id> need the <pass> of the api
+func (h *Handler) GetLatestEvents(w http.ResponseWriter, r *http.Request) {
+	setHeaders(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(200)
+		return
+	}
+
+	id := r.FormValue("id")
+	h.debugMsg("GetLatestEvents id:", id, "destIds:", r.FormValue("destIds"))
+	secure, err, msg := h.Secure.Check(id, r.FormValue("p"))
+	if !secure {
+		h.debugMsg(msg)
+		http.Error(w, "not authorized", 401)
+		return
+	}
+	if err != nil {
+		h.debugMsg(err)
+		http.Error(w, "authentication error", 500)
+		return
+	}
+
+	destIds := []string{id}
+	if r.FormValue("destIds") != "" {
+		destIds = strings.Split(r.FormValue("destIds"), ",")
+	}
+	if len(destIds) > 100 {
+		http.Error(w, "destIds cannot have more than 100 destinations", 400)
+		return
+	}
+	for _, destId := range destIds {
+		if destId == id {
+			continue
 		}
-	} else {
-		if lastId != 0 {
-			ms, err = h.EventStream.GetByDestinationIdAndEventTypePage(destId, eventType, newestId, lastId, limit)
-		} else {
-			ms, err = h.EventStream.GetByDestinationIdAndEventType(destId, eventType, newestId, limit)
+		if !h.apiAuthorized(w, r) {
+			return
 		}
+		break
 	}
+
+	ms, err := h.EventStream.LatestEvents(r.Context(), destIds)
 	if err != nil {
 		fmt.Println("error getting event messages:", err)
-		http.Error(w, "error getting event messages", http.StatusInternalServerError)
+		h.storeError(w, err, "error getting event messages")
+		return
+	}
+	ms, ok := h.upcastEvents(w, r, ms)
+	if !ok {
 		return
 	}
 	js, _ := json.Marshal(&ms)
 
 	w.Write(js)
 }
+
+// AggregateEvents counts the events of the destination <id> per eventType in
+// buckets of a <bucket>: minute, hour or day, from <from> to <to> (unix
+// seconds, to is exclusive) of the creation time, or of the event time with
+// time=event
+// groupBy=originId,eventSubtype (optional) also splits the counts on those
+// value=<payload path> (optional) adds the min, max and avg of a number in
+// the payload, e.g. value=battery.level
+// the filters of queryEvents can be used too, e.g. eventType or payload
+func (h *Handler) AggregateEvents(w http.ResponseWriter, r *http.Request) {
+	setHeaders(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(200)
+		return
+	}
+
+	id := r.FormValue("id")
+	fmt.Println("AggregateEvents id:", id)
+	secure, err, msg := h.Secure.Check(id, r.FormValue("p"))
+	if !secure {
+		h.debugMsg(msg)
+		http.Error(w, "not authorized", 401)
+		return
+	}
+	if err != nil {
+		h.debugMsg(err)
+		http.Error(w, "authentication error", 500)
+		return
+	}
+
+	q, ok := h.queryParams(w, r)
+	if !ok {
+		return
+	}
+	q.DestinationId = id
+
+	aq := AggregateQuery{
+		Query:     q,
+		Bucket:    r.FormValue("bucket"),
+		EventTime: r.FormValue("time") == "event",
+	}
+	aq.From, _ = strconv.ParseInt(r.FormValue("from"), 10, 64)
+	aq.To, _ = strconv.ParseInt(r.FormValue("to"), 10, 64)
+	if r.FormValue("groupBy") != "" {
+		aq.GroupBy = strings.Split(r.FormValue("groupBy"), ",")
+	}
+	if r.FormValue("value") != "" {
+		aq.ValuePath = strings.Split(r.FormValue("value"), ".")
+	}
+	if err := aq.Check(); err != nil {
+		h.debugMsg("invalid aggregation", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	buckets, err := h.EventStream.AggregateEvents(r.Context(), aq)
+	if err != nil {
+		fmt.Println("error aggregating event messages:", err)
+		h.storeError(w, err, "error aggregating event messages")
+		return
+	}
+	js, _ := json.Marshal(&buckets)
+
+	w.Write(js)
+}
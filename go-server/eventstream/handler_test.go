@@ -0,0 +1,111 @@
+package eventstream
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAddEventExpectedVersion(t *testing.T) {
+	h := &Handler{
+		Secure:      &Secure{MaxRequestsPerMin: 1000, Origins: map[string]*SecureOrigin{"o1": {Id: "o1"}}},
+		EventStream: &EventStream{Store: &MemoryStore{}},
+	}
+
+	tests := []struct {
+		eventId  string
+		expected string
+		code     int
+		body     string
+	}{
+		{"e1", "0", 200, ""},
+		{"e2", "0", 409, `"Version":1`},
+		{"e2", "-1", 400, "expectedVersion must be a non-negative integer"},
+		{"e2", "one", 400, "expectedVersion must be a non-negative integer"},
+		{"e2", "1", 200, ""},
+		{"e3", "", 200, ""},
+	}
+	for _, tt := range tests {
+		event := `{"EventId":"` + tt.eventId + `","OriginBuildVersion":"1.0","EventType":"status","EventVersion":"1","PayloadJson":{}}`
+		r := httptest.NewRequest("POST", "/api/addEvent?id=o1&expectedVersion="+tt.expected, strings.NewReader(event))
+		w := httptest.NewRecorder()
+		h.AddEvent(w, r)
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s at expectedVersion %q: got %d %s, want %d %s", tt.eventId, tt.expected, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+}
+
+func TestAddEventInvalid(t *testing.T) {
+	h := &Handler{
+		Secure:      &Secure{MaxRequestsPerMin: 1000, Origins: map[string]*SecureOrigin{"o1": {Id: "o1"}}},
+		EventStream: &EventStream{Store: &MemoryStore{}},
+	}
+
+	tests := []struct {
+		event string
+		code  int
+		body  string
+	}{
+		{`{"EventId":"e1","OriginBuildVersion":"1.0","EventType":"status","EventVersion":"1","PayloadJson":{}}`, 200, ""},
+		{`{"OriginBuildVersion":"1.0","EventType":"status","EventVersion":"1","PayloadJson":{}}`, 400, "EventId not set"},
+		{`{"EventId":"e2","EventType":"status","EventVersion":"1","PayloadJson":{}}`, 400, "OriginBuildVersion not set"},
+		{`{"EventId":"e3","OriginBuildVersion":"1.0","EventVersion":"1","PayloadJson":{}}`, 400, "EventVersion not set"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/addEvent?id=o1", strings.NewReader(tt.event))
+		w := httptest.NewRecorder()
+		h.AddEvent(w, r)
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: got %d %s, want %d %s", tt.event, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+}
+
+func TestAddEventsRateLimit(t *testing.T) {
+	store := &MemoryStore{}
+	h := &Handler{
+		Secure:      &Secure{MaxRequestsPerMin: 5, BatchEventsPerRequest: 10, Origins: map[string]*SecureOrigin{"o1": {Id: "o1"}}},
+		EventStream: &EventStream{Store: store},
+	}
+
+	tests := []struct {
+		events int
+		code   int
+		reqs   int64 // of the origin after the batch
+	}{
+		{25, 200, 3},
+		{30, 401, 3}, // would take it to 6
+		{20, 200, 5},
+		{1, 401, 5},
+	}
+	saved := 0
+	for i, tt := range tests {
+		body := ""
+		for j := 0; j < tt.events; j++ {
+			body += fmt.Sprintf(`{"EventId":"b%d-%d","OriginBuildVersion":"1.0","EventType":"status","EventVersion":"1","PayloadJson":{}}`+"\n", i, j)
+		}
+		r := httptest.NewRequest("POST", "/api/addEvents?id=o1", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.AddEvents(w, r)
+		if w.Code != tt.code {
+			t.Fatalf("batch %d of %d events: got %d %s, want %d", i, tt.events, w.Code, w.Body.String(), tt.code)
+		}
+		if reqs := h.Secure.Origins["o1"].ReqsLastMin; reqs != tt.reqs {
+			t.Fatalf("batch %d of %d events: the origin is at %d requests, want %d", i, tt.events, reqs, tt.reqs)
+		}
+		if tt.code == 200 {
+			saved += tt.events
+		}
+	}
+
+	events, err := store.QueryEvents(context.Background(), EventQuery{OriginId: "o1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != saved {
+		t.Errorf("got %d events, want %d, a refused batch should save nothing", len(events), saved)
+	}
+}
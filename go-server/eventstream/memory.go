@@ -0,0 +1,651 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a thread-safe, in-process EventStore, OriginStore,
+// SchemaStore, Eraser and PayloadStore.
+// Nothing is persisted, so it is meant for tests and development servers
+// that have no Postgresql available. Its calls do not wait on anything, so
+// they do not use their ctx.
+type MemoryStore struct {
+	sync.RWMutex
+
+	events   []EventMessage   // ordered by Id, oldest first
+	eventIds map[string]int64 // "<origin id> <event id>" to the Id of the event, kept when it is deleted
+	origins  []SecureOrigin
+	owners   map[string]string // origin id to the email of its owner
+	lastId   int64
+
+	originIters      map[string]int64
+	destinationIters map[string]int64
+
+	latest map[string]int64 // "<destination id> <event type>" to the Id of its latest event
+
+	chains map[string]*ChainHead // by chain id
+
+	schemas     []EventSchema
+	schemaModes map[string]string
+
+	erasures []Erasure
+}
+
+// AddOrigin registers an origin, passHash is the hex encoded sha256 of the
+// password, or empty for an origin without password, ownerEmail is
+// optional, publicKey is the base64 Ed25519 key of an origin that signs
+// its events, see signature.go
+func (ms *MemoryStore) AddOrigin(id, passHash, ownerEmail, publicKey string) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.owners == nil {
+		ms.owners = make(map[string]string)
+	}
+	ms.owners[id] = ownerEmail
+	for i := range ms.origins {
+		if ms.origins[i].Id == id {
+			ms.origins[i].PassHash = passHash
+			ms.origins[i].PublicKey = publicKey
+			return
+		}
+	}
+	ms.origins = append(ms.origins, SecureOrigin{Id: id, PassHash: passHash, PublicKey: publicKey})
+}
+
+// LoadOrigins
+func (ms *MemoryStore) LoadOrigins(ctx context.Context) ([]SecureOrigin, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	origins := make([]SecureOrigin, len(ms.origins))
+	copy(origins, ms.origins)
+	return origins, nil
+}
+
+// LoadSchemas
+func (ms *MemoryStore) LoadSchemas(ctx context.Context) ([]EventSchema, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	schemas := make([]EventSchema, len(ms.schemas))
+	copy(schemas, ms.schemas)
+	return schemas, nil
+}
+
+// LoadSchemaModes
+func (ms *MemoryStore) LoadSchemaModes(ctx context.Context) (map[string]string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	modes := make(map[string]string)
+	for eventType, mode := range ms.schemaModes {
+		modes[eventType] = mode
+	}
+	return modes, nil
+}
+
+// SaveSchema
+func (ms *MemoryStore) SaveSchema(ctx context.Context, s EventSchema) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for i := range ms.schemas {
+		if ms.schemas[i].EventType == s.EventType && ms.schemas[i].EventVersion == s.EventVersion {
+			ms.schemas[i] = s
+			return nil
+		}
+	}
+	ms.schemas = append(ms.schemas, s)
+	return nil
+}
+
+// DeleteSchema
+func (ms *MemoryStore) DeleteSchema(ctx context.Context, eventType, eventVersion string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for i := range ms.schemas {
+		if ms.schemas[i].EventType == eventType && ms.schemas[i].EventVersion == eventVersion {
+			ms.schemas = append(ms.schemas[:i], ms.schemas[i+1:]...)
+			return nil
+		}
+	}
+	return ErrSchemaNotFound
+}
+
+// SetSchemaMode
+func (ms *MemoryStore) SetSchemaMode(ctx context.Context, eventType, mode string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.schemaModes == nil {
+		ms.schemaModes = make(map[string]string)
+	}
+	ms.schemaModes[eventType] = mode
+	return nil
+}
+
+// InsertEvent
+// an event that was already saved by its origin is not inserted again,
+// then the original Id is returned together with ErrDuplicateEvent
+// OriginIter and DestinationIter are assigned under the same lock
+func (ms *MemoryStore) InsertEvent(ctx context.Context, em EventMessage) (EventMessage, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	return ms.insertLocked(em)
+}
+
+// InsertEvents
+func (ms *MemoryStore) InsertEvents(ctx context.Context, ems []EventMessage) ([]SaveResult, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	results := make([]SaveResult, len(ems))
+	for i, em := range ems {
+		saved, err := ms.insertLocked(em)
+		results[i] = SaveResult{Event: saved, Err: err}
+	}
+	return results, nil
+}
+
+// insertLocked inserts em, the caller holds the write lock
+func (ms *MemoryStore) insertLocked(em EventMessage) (EventMessage, error) {
+	if ms.eventIds == nil {
+		ms.eventIds = make(map[string]int64)
+		ms.originIters = make(map[string]int64)
+		ms.destinationIters = make(map[string]int64)
+		ms.latest = make(map[string]int64)
+	}
+	key := em.OriginId + " " + em.EventId
+	if id, ok := ms.eventIds[key]; ok {
+		i := ms.indexOf(id)
+		if i == len(ms.events) {
+			em.Id = id
+			return em, ErrEventDeleted
+		}
+		return ms.events[i], ErrDuplicateEvent
+	}
+	if err := checkVersion(em, ms.destinationIters[em.DestinationId]); err != nil {
+		return em, err
+	}
+
+	ms.originIters[em.OriginId]++
+	em.OriginIter = ms.originIters[em.OriginId]
+	ms.destinationIters[em.DestinationId]++
+	em.DestinationIter = ms.destinationIters[em.DestinationId]
+	if em.Chain != nil {
+		ms.chainHead(em.Chain.Id).link(&em)
+	}
+
+	ms.lastId++
+	em.Id = ms.lastId
+	ms.eventIds[key] = em.Id
+	ms.events = append(ms.events, em)
+	ms.latest[em.DestinationId+" "+em.EventType] = em.Id
+	return em, nil
+}
+
+// RestoreEvents
+func (ms *MemoryStore) RestoreEvents(ctx context.Context, ems []EventMessage) (int64, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.eventIds == nil {
+		ms.eventIds = make(map[string]int64)
+		ms.originIters = make(map[string]int64)
+		ms.destinationIters = make(map[string]int64)
+		ms.latest = make(map[string]int64)
+	}
+
+	restored := int64(0)
+	for _, em := range ems {
+		key := em.OriginId + " " + em.EventId
+		if id, ok := ms.eventIds[key]; ok && (id != em.Id || ms.indexOf(id) != len(ms.events)) {
+			continue
+		}
+		i := sort.Search(len(ms.events), func(i int) bool {
+			return ms.events[i].Id >= em.Id
+		})
+		if i < len(ms.events) && ms.events[i].Id == em.Id {
+			continue
+		}
+
+		// keep the events ordered by Id
+		ms.events = append(ms.events, EventMessage{})
+		copy(ms.events[i+1:], ms.events[i:])
+		ms.events[i] = em
+		ms.eventIds[key] = em.Id
+		restored++
+
+		if em.Id > ms.lastId {
+			ms.lastId = em.Id
+		}
+		if em.OriginIter > ms.originIters[em.OriginId] {
+			ms.originIters[em.OriginId] = em.OriginIter
+		}
+		if em.DestinationIter > ms.destinationIters[em.DestinationId] {
+			ms.destinationIters[em.DestinationId] = em.DestinationIter
+		}
+		if em.EventType != "" && em.Id > ms.latest[em.DestinationId+" "+em.EventType] {
+			ms.latest[em.DestinationId+" "+em.EventType] = em.Id
+		}
+		if em.Chain != nil {
+			head := ms.chainHead(em.Chain.Id)
+			if em.Chain.Seq > head.Seq {
+				head.Seq = em.Chain.Seq
+				head.Hash = em.Chain.Hash
+			}
+		}
+	}
+	return restored, nil
+}
+
+// chainHead returns the head of a chain, the caller holds the write lock
+func (ms *MemoryStore) chainHead(chainId string) *ChainHead {
+	if ms.chains == nil {
+		ms.chains = make(map[string]*ChainHead)
+	}
+	head := ms.chains[chainId]
+	if head == nil {
+		head = &ChainHead{ChainId: chainId}
+		ms.chains[chainId] = head
+	}
+	return head
+}
+
+// ChainHeads
+func (ms *MemoryStore) ChainHeads(ctx context.Context) ([]ChainHead, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	heads := []ChainHead{}
+	for _, head := range ms.chains {
+		heads = append(heads, *head)
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i].ChainId < heads[j].ChainId
+	})
+	return heads, nil
+}
+
+// ChainEvents
+func (ms *MemoryStore) ChainEvents(ctx context.Context, chainId string, fromSeq int64, limit int) ([]EventMessage, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	found := []EventMessage{}
+	for i := range ms.events {
+		em := &ms.events[i]
+		if em.Chain != nil && em.Chain.Id == chainId && em.Chain.Seq >= fromSeq {
+			found = append(found, *em)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Chain.Seq < found[j].Chain.Seq
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+// indexOf returns the index of the event with id in events,
+// or len(events) if there is no such event
+func (ms *MemoryStore) indexOf(id int64) int {
+	i := sort.Search(len(ms.events), func(i int) bool {
+		return ms.events[i].Id >= id
+	})
+	if i < len(ms.events) && ms.events[i].Id != id {
+		return len(ms.events)
+	}
+	return i
+}
+
+// Ping
+func (ms *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// QueryEvents walks the events from new to old
+// an event with a payload that cannot be filtered on fails the query when
+// it could be on the page, like sqlOpaquePayloads
+func (ms *MemoryStore) QueryEvents(ctx context.Context, q EventQuery) ([]EventMessage, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	fields := q
+	fields.Payload = nil
+	found := []EventMessage{}
+	opaque := payloadPlain
+	for i, page := len(ms.events)-1, 0; i >= 0; i-- {
+		if q.Limit > 0 && page >= q.Limit {
+			break
+		}
+		em := &ms.events[i]
+		if em.Id <= q.NewestId {
+			break
+		}
+		if q.LastId > 0 && em.Id >= q.LastId {
+			continue
+		}
+		if len(q.Payload) > 0 && fields.Match(em) && payloadOpaqueLevel(em) > payloadPlain {
+			opaque = max(opaque, payloadOpaqueLevel(em))
+			page++
+			continue
+		}
+		if q.Match(em) {
+			found = append(found, *em)
+			page++
+		}
+	}
+	if err := opaquePayloadError(opaque); err != nil {
+		return nil, fmt.Errorf("%w, they cannot be filtered on", err)
+	}
+	return found, nil
+}
+
+// DeleteEvents
+func (ms *MemoryStore) DeleteEvents(ctx context.Context, q EventQuery, except []EventQuery, limit int) (int64, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	kept := ms.events[:0]
+	deleted := int64(0)
+	stale := make(map[string]bool)
+	for i := range ms.events {
+		em := &ms.events[i]
+		if deleted < int64(limit) && q.Match(em) && !matchAny(except, em) {
+			key := em.DestinationId + " " + em.EventType
+			if ms.latest[key] == em.Id {
+				delete(ms.latest, key)
+				stale[key] = true
+			}
+			deleted++
+			continue
+		}
+		kept = append(kept, *em)
+	}
+	// let go of the payloads of the deleted events
+	for i := len(kept); i < len(ms.events); i++ {
+		ms.events[i] = EventMessage{}
+	}
+	ms.events = kept
+
+	// the latest events that were deleted, move back to the newest left
+	for i := len(ms.events) - 1; i >= 0 && len(stale) > 0; i-- {
+		key := ms.events[i].DestinationId + " " + ms.events[i].EventType
+		if stale[key] {
+			ms.latest[key] = ms.events[i].Id
+			delete(stale, key)
+		}
+	}
+	return deleted, nil
+}
+
+// EraseEvents
+func (ms *MemoryStore) EraseEvents(ctx context.Context, req ErasureRequest) (Erasure, error) {
+	if err := req.Check(); err != nil {
+		return Erasure{}, err
+	}
+	ms.Lock()
+	defer ms.Unlock()
+
+	originIds := []string{req.OriginId}
+	if req.OwnerEmail != "" {
+		originIds = []string{}
+		for i := range ms.origins {
+			if ms.owners[ms.origins[i].Id] == req.OwnerEmail {
+				originIds = append(originIds, ms.origins[i].Id)
+			}
+		}
+		sort.Strings(originIds)
+	}
+	erasure := req.erasure(originIds, time.Now().Unix())
+
+	origins := make(map[string]bool)
+	for _, id := range originIds {
+		origins[id] = true
+	}
+	if len(req.Paths) > 0 {
+		for i := range ms.events {
+			em := &ms.events[i]
+			if !origins[em.OriginId] && !origins[em.DestinationId] {
+				continue
+			}
+			if err := opaquePayloadError(payloadOpaqueLevel(em)); err != nil {
+				return Erasure{}, fmt.Errorf("%w, their paths cannot be redacted, erase the whole payloads", err)
+			}
+		}
+	}
+	for i := range ms.events {
+		em := &ms.events[i]
+		if !origins[em.OriginId] && !origins[em.DestinationId] {
+			continue
+		}
+		if len(req.Paths) > 0 {
+			redacted, ok := redactPayload(em.PayloadJson, req.Paths)
+			if !ok {
+				continue
+			}
+			em.PayloadJson = redacted
+		} else {
+			if string(em.PayloadJson) == "{}" && em.payloadData == nil && em.EventSubtype == "" && em.OriginGroupId == "" {
+				continue
+			}
+			em.PayloadJson = json.RawMessage("{}")
+			em.payloadData = nil
+			em.payloadKeyId = ""
+			em.payloadCodec = ""
+			em.payloadSize = 0
+			em.EventSubtype = ""
+			em.OriginGroupId = ""
+		}
+		em.RedactedUnixSec = erasure.TimeUnixSec
+		erasure.add(em.Id)
+	}
+
+	erasure.Id = int64(len(ms.erasures)) + 1
+	ms.erasures = append(ms.erasures, erasure)
+	return erasure, nil
+}
+
+// Erasures
+func (ms *MemoryStore) Erasures(ctx context.Context) ([]Erasure, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	erasures := make([]Erasure, len(ms.erasures))
+	copy(erasures, ms.erasures)
+	return erasures, nil
+}
+
+// StalePayloads
+func (ms *MemoryStore) StalePayloads(ctx context.Context, keyId string, afterId int64, limit int) ([]EventMessage, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	found := []EventMessage{}
+	for i := range ms.events {
+		if len(found) >= limit {
+			break
+		}
+		em := &ms.events[i]
+		if em.Id <= afterId || em.payloadKeyId == keyId || (em.payloadData == nil && string(em.PayloadJson) == "{}") {
+			continue
+		}
+		found = append(found, *em)
+	}
+	return found, nil
+}
+
+// UpdatePayloads
+func (ms *MemoryStore) UpdatePayloads(ctx context.Context, stale, ems []EventMessage) (int64, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	updated := int64(0)
+	for i := range ems {
+		j := ms.indexOf(stale[i].Id)
+		if j == len(ms.events) {
+			continue
+		}
+		em := &ms.events[j]
+		if em.payloadKeyId != stale[i].payloadKeyId || em.RedactedUnixSec != stale[i].RedactedUnixSec {
+			continue
+		}
+		em.PayloadJson = ems[i].PayloadJson
+		em.payloadData = ems[i].payloadData
+		em.payloadKeyId = ems[i].payloadKeyId
+		em.payloadCodec = ems[i].payloadCodec
+		em.payloadSize = ems[i].payloadSize
+		updated++
+	}
+	return updated, nil
+}
+
+// PayloadStats
+func (ms *MemoryStore) PayloadStats(ctx context.Context) ([]PayloadStats, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	stats := []PayloadStats{}
+	index := make(map[PayloadStats]int)
+	for i := range ms.events {
+		em := &ms.events[i]
+		key := PayloadStats{Codec: em.payloadCodec, Encrypted: em.payloadKeyId != ""}
+		j, ok := index[key]
+		if !ok {
+			j = len(stats)
+			index[key] = j
+			stats = append(stats, key)
+		}
+		s := &stats[j]
+		s.Events++
+		if em.payloadData == nil {
+			s.Bytes += int64(len(em.PayloadJson))
+			s.StoredBytes += int64(len(em.PayloadJson))
+		} else {
+			s.Bytes += em.payloadSize
+			s.StoredBytes += int64(len(em.payloadData))
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Codec != stats[j].Codec {
+			return stats[i].Codec < stats[j].Codec
+		}
+		return !stats[i].Encrypted && stats[j].Encrypted
+	})
+	return stats, nil
+}
+
+// matchAny reports if em matches one of the queries
+func matchAny(queries []EventQuery, em *EventMessage) bool {
+	for i := range queries {
+		if queries[i].Match(em) {
+			return true
+		}
+	}
+	return false
+}
+
+// AggregateEvents
+func (ms *MemoryStore) AggregateEvents(ctx context.Context, aq AggregateQuery) ([]AggregateBucket, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	q := aq.query()
+	fields := q
+	fields.Payload = nil
+	ems := []EventMessage{}
+	for i := range ms.events {
+		em := &ms.events[i]
+		if aq.payload() && fields.Match(em) {
+			if err := opaquePayloadError(payloadOpaqueLevel(em)); err != nil {
+				return nil, fmt.Errorf("%w, they cannot be aggregated", err)
+			}
+		}
+		if q.Match(em) {
+			ems = append(ems, *em)
+		}
+	}
+	return aq.aggregateMessages(ems), nil
+}
+
+// LatestEvents
+func (ms *MemoryStore) LatestEvents(ctx context.Context, destIds []string) ([]EventMessage, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	dests := make(map[string]bool)
+	for _, destId := range destIds {
+		dests[destId] = true
+	}
+	ems := []EventMessage{}
+	for _, id := range ms.latest {
+		em := ms.events[ms.indexOf(id)]
+		if dests[em.DestinationId] {
+			ems = append(ems, em)
+		}
+	}
+	sort.Slice(ems, func(i, j int) bool {
+		if ems[i].DestinationId != ems[j].DestinationId {
+			return ems[i].DestinationId < ems[j].DestinationId
+		}
+		return ems[i].EventType < ems[j].EventType
+	})
+	return ems, nil
+}
+
+// GetByEventId
+func (ms *MemoryStore) GetByEventId(ctx context.Context, originId, eventId string) (EventMessage, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	id, ok := ms.eventIds[originId+" "+eventId]
+	if !ok || ms.indexOf(id) == len(ms.events) {
+		return EventMessage{}, ErrEventNotFound
+	}
+	return ms.events[ms.indexOf(id)], nil
+}
+
+// findSince returns at most limit matching events with iter(em) > sinceIter,
+// from old to new, iters increase with the Id so the events are in order
+func (ms *MemoryStore) findSince(sinceIter int64, limit int, iter func(em *EventMessage) int64, match func(em *EventMessage) bool) []EventMessage {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	found := []EventMessage{}
+	for i := range ms.events {
+		if len(found) >= limit {
+			break
+		}
+		em := &ms.events[i]
+		if match(em) && iter(em) > sinceIter {
+			found = append(found, *em)
+		}
+	}
+	return found
+}
+
+// GetByOriginIdSinceIter
+func (ms *MemoryStore) GetByOriginIdSinceIter(ctx context.Context, originId string, sinceIter int64, limit int) ([]EventMessage, error) {
+	return ms.findSince(sinceIter, limit,
+		func(em *EventMessage) int64 { return em.OriginIter },
+		func(em *EventMessage) bool { return em.OriginId == originId },
+	), nil
+}
+
+// GetByDestinationIdSinceIter
+func (ms *MemoryStore) GetByDestinationIdSinceIter(ctx context.Context, destId string, sinceIter int64, limit int) ([]EventMessage, error) {
+	return ms.findSince(sinceIter, limit,
+		func(em *EventMessage) int64 { return em.DestinationIter },
+		func(em *EventMessage) bool { return em.DestinationId == destId },
+	), nil
+}
@@ -0,0 +1,165 @@
+package eventstream
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the database schema lives in ordered, versioned migrations:
+// migrations/<dialect>/<version>_<name>.up.sql and .down.sql
+// every up migration needs a down migration to roll it back
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is one versioned step of the database schema
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells if a Migration has been applied to the database
+type MigrationStatus struct {
+	Migration
+	Applied            bool
+	AppliedTimeUnixSec int64
+}
+
+// Migrator is implemented by the stores that keep a database schema,
+// the applied versions are tracked in the schema_migrations table
+type Migrator interface {
+	// Migrations returns the migrations for this database, ordered by version
+	Migrations() ([]Migration, error)
+	// AppliedMigrations returns the applied versions with their unix time
+	AppliedMigrations(ctx context.Context) (map[int64]int64, error)
+	// ApplyMigration runs the up or down sql of m and records it in
+	// schema_migrations, in a single transaction
+	ApplyMigration(ctx context.Context, m Migration, up bool) error
+}
+
+// LoadMigrations reads the embedded migrations of a dialect (postgres, sqlite)
+func LoadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", dialect, err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		up := strings.HasSuffix(fileName, ".up.sql")
+		if !up && !strings.HasSuffix(fileName, ".down.sql") {
+			return nil, errors.New("unexpected migration file " + fileName)
+		}
+		base := strings.TrimSuffix(strings.TrimSuffix(fileName, ".up.sql"), ".down.sql")
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("migration file name should be <version>_<name>: " + fileName)
+		}
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, errors.New("invalid migration version in " + fileName)
+		}
+
+		data, err := migrationFiles.ReadFile(path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[1] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, parts[1])
+		}
+		if up {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// GetMigrationStatus lists all migrations and if they are applied
+func GetMigrationStatus(ctx context.Context, mr Migrator) ([]MigrationStatus, error) {
+	migrations, err := mr.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := mr.AppliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := []MigrationStatus{}
+	for _, m := range migrations {
+		appliedTime, ok := applied[m.Version]
+		status = append(status, MigrationStatus{Migration: m, Applied: ok, AppliedTimeUnixSec: appliedTime})
+	}
+	return status, nil
+}
+
+// MigrateUp applies all pending migrations in order,
+// it returns the migrations that were applied
+func MigrateUp(ctx context.Context, mr Migrator) ([]Migration, error) {
+	status, err := GetMigrationStatus(ctx, mr)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, s := range status {
+		if s.Applied {
+			continue
+		}
+		if err := mr.ApplyMigration(ctx, s.Migration, true); err != nil {
+			return done, fmt.Errorf("migration %d_%s failed: %w", s.Version, s.Name, err)
+		}
+		done = append(done, s.Migration)
+	}
+	return done, nil
+}
+
+// MigrateDown rolls back the last <steps> applied migrations, newest first,
+// it returns the migrations that were rolled back
+func MigrateDown(ctx context.Context, mr Migrator, steps int) ([]Migration, error) {
+	status, err := GetMigrationStatus(ctx, mr)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for i := len(status) - 1; i >= 0 && len(done) < steps; i-- {
+		if !status[i].Applied {
+			continue
+		}
+		if err := mr.ApplyMigration(ctx, status[i].Migration, false); err != nil {
+			return done, fmt.Errorf("rollback of migration %d_%s failed: %w", status[i].Version, status[i].Name, err)
+		}
+		done = append(done, status[i].Migration)
+	}
+	return done, nil
+}
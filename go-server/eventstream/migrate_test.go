@@ -0,0 +1,58 @@
+package eventstream
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSQLiteMigrateDownKeepsPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int64
+		column  string
+		value   string
+	}{
+		{"encrypted payloads", 13, "payload_key_id", "k1"},
+		{"compressed payloads", 14, "payload_codec", CodecZstd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ss := openTestSQLite(t)
+			if _, err := ss.InsertEvent(ctx, EventMessage{EventId: "e1", OriginId: "o1", EventType: "t", PayloadJson: []byte("{}")}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ss.DB.Exec("UPDATE events SET "+tt.column+" = ?", tt.value); err != nil {
+				t.Fatal(err)
+			}
+
+			status, err := GetMigrationStatus(ctx, ss)
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps := 0
+			for _, s := range status {
+				if s.Version >= tt.version {
+					steps++
+				}
+			}
+			if _, err := MigrateDown(ctx, ss, steps); err == nil {
+				t.Fatalf("migration %d rolled back while %s is set", tt.version, tt.column)
+			}
+			applied, err := ss.AppliedMigrations(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := applied[tt.version]; !ok {
+				t.Fatalf("migration %d is not applied anymore", tt.version)
+			}
+
+			if _, err := ss.DB.Exec("UPDATE events SET " + tt.column + " = NULL"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := MigrateDown(ctx, ss, steps); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
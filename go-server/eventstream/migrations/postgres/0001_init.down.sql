@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS origins;
+DROP TABLE IF EXISTS events;
@@ -0,0 +1,33 @@
+-- events and origins as used by PostgresStore and Secure
+-- IF NOT EXISTS so databases created by hand before migrations existed are adopted
+
+CREATE TABLE IF NOT EXISTS events
+(
+    id bigint NOT NULL GENERATED ALWAYS AS IDENTITY,
+    event_id character varying(256) NOT NULL,
+    creation_time_unix_sec bigint,
+    origin_id character varying(256) NOT NULL,
+    origin_iter bigint,
+    origin_group_id character varying(256),
+    origin_build_version character varying(256),
+    destination_id character varying(256) NOT NULL,
+    destination_iter bigint,
+    event_time_unix_sec bigint,
+    event_type character varying(256),
+    event_subtype character varying(256),
+    event_version character varying(256),
+    payload_json json,
+    CONSTRAINT events_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS origins
+(
+    id character varying(128) NOT NULL,
+    added_iter bigserial NOT NULL,
+    added_timestamp TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    type character varying(128) NOT NULL,
+    version character varying(128) NOT NULL,
+    pass_hash character varying(128),
+    owner_email character varying(512),
+    PRIMARY KEY (id)
+);
@@ -0,0 +1,3 @@
+-- GetByDestinationId* walk the events of one destination from new to old
+CREATE INDEX IF NOT EXISTS events_destination_id_idx ON events (destination_id, id DESC);
+CREATE INDEX IF NOT EXISTS events_destination_id_event_type_idx ON events (destination_id, event_type, id DESC);
@@ -0,0 +1,13 @@
+-- an origin can safely retry an addEvent, the EventId it generated
+-- identifies the event, so (origin_id, event_id) has to be unique
+
+-- retries before this migration created duplicates, the first one is kept
+-- and the others are moved to events_duplicates, the down migration puts
+-- them back
+CREATE TABLE IF NOT EXISTS events_duplicates AS SELECT * FROM events WITH NO DATA;
+INSERT INTO events_duplicates
+SELECT a.* FROM events a
+WHERE EXISTS (SELECT 1 FROM events b WHERE b.origin_id = a.origin_id AND b.event_id = a.event_id AND b.id < a.id);
+DELETE FROM events WHERE id IN (SELECT id FROM events_duplicates);
+
+CREATE UNIQUE INDEX IF NOT EXISTS events_origin_id_event_id_key ON events (origin_id, event_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS events_destination_id_destination_iter_idx;
+DROP INDEX IF EXISTS events_origin_id_origin_iter_idx;
+DROP TABLE IF EXISTS stream_iters;
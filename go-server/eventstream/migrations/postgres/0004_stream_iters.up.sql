@@ -0,0 +1,21 @@
+-- the last OriginIter and DestinationIter per stream, incremented by
+-- InsertEvent in the same transaction as the insert of the event
+CREATE TABLE IF NOT EXISTS stream_iters
+(
+    stream_type character varying(16) NOT NULL, -- origin or destination
+    stream_id character varying(256) NOT NULL,
+    iter bigint NOT NULL,
+    PRIMARY KEY (stream_type, stream_id)
+);
+
+-- continue counting after the iters already in events
+INSERT INTO stream_iters (stream_type, stream_id, iter)
+SELECT 'origin', origin_id, COALESCE(MAX(origin_iter), 0) FROM events GROUP BY origin_id
+ON CONFLICT DO NOTHING;
+INSERT INTO stream_iters (stream_type, stream_id, iter)
+SELECT 'destination', destination_id, COALESCE(MAX(destination_iter), 0) FROM events GROUP BY destination_id
+ON CONFLICT DO NOTHING;
+
+-- events since iter N
+CREATE INDEX IF NOT EXISTS events_origin_id_origin_iter_idx ON events (origin_id, origin_iter);
+CREATE INDEX IF NOT EXISTS events_destination_id_destination_iter_idx ON events (destination_id, destination_iter);
@@ -0,0 +1,3 @@
+-- GetByEventType and GetByOriginGroupId walk the whole stream from new to old
+CREATE INDEX IF NOT EXISTS events_event_type_idx ON events (event_type, id DESC);
+CREATE INDEX IF NOT EXISTS events_origin_group_id_idx ON events (origin_group_id, id DESC);
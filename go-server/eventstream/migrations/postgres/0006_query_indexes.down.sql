@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS events_event_time_unix_sec_idx;
+DROP INDEX IF EXISTS events_origin_id_idx;
@@ -0,0 +1 @@
+ALTER TABLE events ALTER COLUMN payload_json TYPE json USING payload_json::json;
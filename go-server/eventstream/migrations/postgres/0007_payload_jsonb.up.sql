@@ -0,0 +1,2 @@
+-- PayloadJson is nested JSON in the API, jsonb stores it parsed
+ALTER TABLE events ALTER COLUMN payload_json TYPE jsonb USING payload_json::jsonb;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS events_creation_time_unix_sec_idx;
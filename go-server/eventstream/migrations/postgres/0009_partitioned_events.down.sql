@@ -0,0 +1,49 @@
+-- event_keys keeps the EventIds of the events removed by retention or a
+-- dropped partition, without it their retries would be saved again, so this
+-- fails while there are any. Delete those rows first to roll back anyway.
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM event_keys k WHERE NOT EXISTS (SELECT 1 FROM events e WHERE e.origin_id = k.origin_id AND e.event_id = k.event_id)) THEN
+		RAISE EXCEPTION 'event_keys holds the EventIds of deleted events, they would be lost, delete them from event_keys first to roll back anyway';
+	END IF;
+END $$;
+
+-- copy the events back into a single table
+CREATE TABLE events_unpartitioned
+(
+    id bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY,
+    event_id character varying(256) NOT NULL,
+    creation_time_unix_sec bigint,
+    origin_id character varying(256) NOT NULL,
+    origin_iter bigint,
+    origin_group_id character varying(256),
+    origin_build_version character varying(256),
+    destination_id character varying(256) NOT NULL,
+    destination_iter bigint,
+    event_time_unix_sec bigint,
+    event_type character varying(256),
+    event_subtype character varying(256),
+    event_version character varying(256),
+    payload_json jsonb,
+    CONSTRAINT events_unpartitioned_pkey PRIMARY KEY (id)
+);
+INSERT INTO events_unpartitioned (id, event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, destination_iter, event_time_unix_sec, event_type, event_subtype, event_version, payload_json)
+SELECT id, event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, destination_iter, event_time_unix_sec, event_type, event_subtype, event_version, payload_json FROM events;
+
+DROP TABLE events;
+DROP TABLE event_keys;
+ALTER TABLE events_unpartitioned RENAME TO events;
+ALTER TABLE events RENAME CONSTRAINT events_unpartitioned_pkey TO events_pkey;
+ALTER TABLE events ALTER COLUMN id SET GENERATED ALWAYS;
+SELECT setval(pg_get_serial_sequence('events', 'id'), COALESCE((SELECT max(id) FROM events), 0) + 1, false);
+
+CREATE INDEX events_destination_id_idx ON events (destination_id, id DESC);
+CREATE INDEX events_destination_id_event_type_idx ON events (destination_id, event_type, id DESC);
+CREATE UNIQUE INDEX events_origin_id_event_id_key ON events (origin_id, event_id);
+CREATE INDEX events_origin_id_origin_iter_idx ON events (origin_id, origin_iter);
+CREATE INDEX events_destination_id_destination_iter_idx ON events (destination_id, destination_iter);
+CREATE INDEX events_event_type_idx ON events (event_type, id DESC);
+CREATE INDEX events_origin_group_id_idx ON events (origin_group_id, id DESC);
+CREATE INDEX events_origin_id_idx ON events (origin_id, id DESC);
+CREATE INDEX events_event_time_unix_sec_idx ON events (event_time_unix_sec);
+CREATE INDEX events_creation_time_unix_sec_idx ON events (creation_time_unix_sec);
@@ -0,0 +1,84 @@
+-- events becomes a table partitioned by range on creation_time_unix_sec,
+-- the existing rows become the partition events_legacy and the server
+-- creates the next partitions ahead of time, see partitions.go
+
+-- free the names of the events table, its indexes and its id sequence
+ALTER TABLE events RENAME TO events_legacy;
+ALTER TABLE events_legacy RENAME CONSTRAINT events_pkey TO events_legacy_pkey;
+ALTER INDEX IF EXISTS events_destination_id_idx RENAME TO events_legacy_destination_id_idx;
+ALTER INDEX IF EXISTS events_destination_id_event_type_idx RENAME TO events_legacy_destination_id_event_type_idx;
+ALTER INDEX IF EXISTS events_origin_id_origin_iter_idx RENAME TO events_legacy_origin_id_origin_iter_idx;
+ALTER INDEX IF EXISTS events_destination_id_destination_iter_idx RENAME TO events_legacy_destination_id_destination_iter_idx;
+ALTER INDEX IF EXISTS events_event_type_idx RENAME TO events_legacy_event_type_idx;
+ALTER INDEX IF EXISTS events_origin_group_id_idx RENAME TO events_legacy_origin_group_id_idx;
+ALTER INDEX IF EXISTS events_origin_id_idx RENAME TO events_legacy_origin_id_idx;
+ALTER INDEX IF EXISTS events_event_time_unix_sec_idx RENAME TO events_legacy_event_time_unix_sec_idx;
+ALTER INDEX IF EXISTS events_creation_time_unix_sec_idx RENAME TO events_legacy_creation_time_unix_sec_idx;
+ALTER TABLE events_legacy ALTER COLUMN id DROP IDENTITY IF EXISTS;
+
+-- the partition key cannot be NULL
+UPDATE events_legacy SET creation_time_unix_sec = 0 WHERE creation_time_unix_sec IS NULL;
+ALTER TABLE events_legacy ALTER COLUMN creation_time_unix_sec SET NOT NULL;
+
+-- a partitioned table cannot have an identity column, the ids continue
+-- from a sequence
+CREATE SEQUENCE events_id_seq;
+SELECT setval('events_id_seq', COALESCE((SELECT max(id) FROM events_legacy), 0) + 1, false);
+
+CREATE TABLE events
+(
+    id bigint NOT NULL DEFAULT nextval('events_id_seq'),
+    event_id character varying(256) NOT NULL,
+    creation_time_unix_sec bigint NOT NULL,
+    origin_id character varying(256) NOT NULL,
+    origin_iter bigint,
+    origin_group_id character varying(256),
+    origin_build_version character varying(256),
+    destination_id character varying(256) NOT NULL,
+    destination_iter bigint,
+    event_time_unix_sec bigint,
+    event_type character varying(256),
+    event_subtype character varying(256),
+    event_version character varying(256),
+    payload_json jsonb,
+    CONSTRAINT events_pkey PRIMARY KEY (id, creation_time_unix_sec)
+) PARTITION BY RANGE (creation_time_unix_sec);
+ALTER SEQUENCE events_id_seq OWNED BY events.id;
+
+CREATE INDEX events_destination_id_idx ON events (destination_id, id DESC);
+CREATE INDEX events_destination_id_event_type_idx ON events (destination_id, event_type, id DESC);
+CREATE INDEX events_origin_id_event_id_idx ON events (origin_id, event_id);
+CREATE INDEX events_origin_id_origin_iter_idx ON events (origin_id, origin_iter);
+CREATE INDEX events_destination_id_destination_iter_idx ON events (destination_id, destination_iter);
+CREATE INDEX events_event_type_idx ON events (event_type, id DESC);
+CREATE INDEX events_origin_group_id_idx ON events (origin_group_id, id DESC);
+CREATE INDEX events_origin_id_idx ON events (origin_id, id DESC);
+CREATE INDEX events_event_time_unix_sec_idx ON events (event_time_unix_sec);
+CREATE INDEX events_creation_time_unix_sec_idx ON events (creation_time_unix_sec);
+
+-- a unique index on a partitioned table has to include the partition key,
+-- so (origin_id, event_id) is kept unique in event_keys, see InsertEvent
+CREATE TABLE event_keys
+(
+    origin_id character varying(256) NOT NULL,
+    event_id character varying(256) NOT NULL,
+    id bigint NOT NULL,
+    creation_time_unix_sec bigint NOT NULL,
+    PRIMARY KEY (origin_id, event_id)
+);
+CREATE INDEX event_keys_creation_time_unix_sec_idx ON event_keys (creation_time_unix_sec);
+INSERT INTO event_keys (origin_id, event_id, id, creation_time_unix_sec)
+SELECT origin_id, event_id, id, creation_time_unix_sec FROM events_legacy;
+DROP INDEX IF EXISTS events_origin_id_event_id_key;
+
+-- the existing rows up to now, the matching indexes are attached as they are
+DO $$
+DECLARE
+    bound bigint;
+BEGIN
+    SELECT COALESCE(max(creation_time_unix_sec), 0) + 1 INTO bound FROM events_legacy;
+    EXECUTE format('ALTER TABLE events ATTACH PARTITION events_legacy FOR VALUES FROM (MINVALUE) TO (%s)', bound);
+END $$;
+
+-- rows that fall outside the partitions, when the server is behind
+CREATE TABLE events_default PARTITION OF events DEFAULT;
@@ -0,0 +1,16 @@
+-- the latest event per destination and event type, updated in the same
+-- transaction as the insert of the event, see LatestEvents
+-- the creation time finds the partition of the event
+CREATE TABLE IF NOT EXISTS latest_events
+(
+    destination_id character varying(256) NOT NULL,
+    event_type character varying(256) NOT NULL,
+    id bigint NOT NULL,
+    creation_time_unix_sec bigint NOT NULL,
+    PRIMARY KEY (destination_id, event_type)
+);
+
+INSERT INTO latest_events (destination_id, event_type, id, creation_time_unix_sec)
+SELECT DISTINCT ON (destination_id, event_type) destination_id, event_type, id, creation_time_unix_sec
+FROM events WHERE event_type IS NOT NULL
+ORDER BY destination_id, event_type, id DESC;
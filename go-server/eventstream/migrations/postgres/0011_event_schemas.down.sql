@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS event_schema_modes;
+DROP TABLE IF EXISTS event_schemas;
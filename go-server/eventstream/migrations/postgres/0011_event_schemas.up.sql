@@ -0,0 +1,16 @@
+-- the JSON Schemas of the payloads per event type and version, and the
+-- schema mode per event type, see schema.go
+CREATE TABLE IF NOT EXISTS event_schemas
+(
+    event_type character varying(256) NOT NULL,
+    event_version character varying(256) NOT NULL,
+    schema_json text NOT NULL,
+    added_time_unix_sec bigint NOT NULL,
+    PRIMARY KEY (event_type, event_version)
+);
+
+CREATE TABLE IF NOT EXISTS event_schema_modes
+(
+    event_type character varying(256) NOT NULL PRIMARY KEY,
+    mode character varying(16) NOT NULL
+);
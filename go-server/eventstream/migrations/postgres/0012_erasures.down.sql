@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS erasures;
+DROP INDEX IF EXISTS origins_owner_email_idx;
+ALTER TABLE events DROP COLUMN IF EXISTS redacted_time_unix_sec;
@@ -0,0 +1,21 @@
+-- erasure of personal data, see erasure.go
+-- an erased or redacted event stays as a tombstone, with the time of the
+-- erasure in redacted_time_unix_sec, so the ids and iters have no gaps
+ALTER TABLE events ADD COLUMN IF NOT EXISTS redacted_time_unix_sec bigint;
+
+CREATE INDEX IF NOT EXISTS origins_owner_email_idx ON origins (owner_email);
+
+-- the audit of the erasures, what was erased and by whom
+CREATE TABLE IF NOT EXISTS erasures
+(
+    id bigint NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    time_unix_sec bigint NOT NULL,
+    erased_by character varying(256) NOT NULL,
+    reason text NOT NULL,
+    origin_ids text NOT NULL, -- JSON array
+    owner_email character varying(512) NOT NULL,
+    paths text NOT NULL, -- JSON array, empty when the whole payload was erased
+    events bigint NOT NULL,
+    min_id bigint NOT NULL,
+    max_id bigint NOT NULL
+);
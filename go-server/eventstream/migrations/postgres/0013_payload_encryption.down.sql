@@ -0,0 +1,11 @@
+-- the encrypted payloads would be lost, so this fails while there are any,
+-- decrypt them first with an empty keyid: ./go-server encryption reencrypt
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM events WHERE payload_key_id IS NOT NULL) THEN
+		RAISE EXCEPTION 'there are encrypted payloads, decrypt them first with an empty keyid: ./go-server encryption reencrypt';
+	END IF;
+END $$;
+
+ALTER TABLE events DROP COLUMN IF EXISTS payload_key_id;
+ALTER TABLE events DROP COLUMN IF EXISTS payload_data;
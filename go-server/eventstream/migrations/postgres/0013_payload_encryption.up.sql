@@ -0,0 +1,5 @@
+-- encryption at rest of the payloads, see encryption.go
+-- an encrypted event keeps {} in payload_json, the payload is encrypted in
+-- payload_data with the master key payload_key_id
+ALTER TABLE events ADD COLUMN IF NOT EXISTS payload_data bytea;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS payload_key_id character varying(64);
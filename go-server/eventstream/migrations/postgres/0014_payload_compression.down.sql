@@ -0,0 +1,10 @@
+-- the compressed payloads would be lost, so this fails while there are any
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM events WHERE payload_codec IS NOT NULL) THEN
+		RAISE EXCEPTION 'there are compressed payloads, they would be lost';
+	END IF;
+END $$;
+
+ALTER TABLE events DROP COLUMN IF EXISTS payload_size;
+ALTER TABLE events DROP COLUMN IF EXISTS payload_codec;
@@ -0,0 +1,18 @@
+-- hash chains of the events, see chain.go
+-- chain_hash covers the event and chain_prev_hash, chain_data_hash covers
+-- the payload, event_subtype and origin_group_id and stays after an erasure
+ALTER TABLE events ADD COLUMN IF NOT EXISTS chain_id character varying(300);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS chain_seq bigint;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS chain_prev_hash character varying(64);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS chain_hash character varying(64);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS chain_data_hash character varying(64);
+
+CREATE INDEX IF NOT EXISTS events_chain_id_chain_seq_idx ON events (chain_id, chain_seq) WHERE chain_id IS NOT NULL;
+
+-- the last link of every chain, locked by the inserts like stream_iters
+CREATE TABLE IF NOT EXISTS event_chains
+(
+    chain_id character varying(300) NOT NULL PRIMARY KEY,
+    seq bigint NOT NULL,
+    hash character varying(64) NOT NULL
+);
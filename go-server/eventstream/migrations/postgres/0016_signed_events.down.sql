@@ -0,0 +1,2 @@
+ALTER TABLE events DROP COLUMN IF EXISTS signature;
+ALTER TABLE origins DROP COLUMN IF EXISTS public_key;
@@ -0,0 +1,29 @@
+-- same columns as the Postgresql events and origins tables
+
+CREATE TABLE IF NOT EXISTS events
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_id TEXT NOT NULL,
+    creation_time_unix_sec INTEGER,
+    origin_id TEXT NOT NULL,
+    origin_iter INTEGER,
+    origin_group_id TEXT,
+    origin_build_version TEXT,
+    destination_id TEXT NOT NULL,
+    destination_iter INTEGER,
+    event_time_unix_sec INTEGER,
+    event_type TEXT,
+    event_subtype TEXT,
+    event_version TEXT,
+    payload_json TEXT
+);
+
+CREATE TABLE IF NOT EXISTS origins
+(
+    id TEXT NOT NULL PRIMARY KEY,
+    added_timestamp TEXT DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    type TEXT NOT NULL,
+    version TEXT NOT NULL,
+    pass_hash TEXT,
+    owner_email TEXT
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS events_destination_id_event_type_idx;
+DROP INDEX IF EXISTS events_destination_id_idx;
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS events_origin_id_event_id_key;
+
+-- put back the duplicates the up migration moved away
+CREATE TABLE IF NOT EXISTS events_duplicates AS SELECT * FROM events WHERE 0;
+INSERT INTO events SELECT * FROM events_duplicates;
+DROP TABLE events_duplicates;
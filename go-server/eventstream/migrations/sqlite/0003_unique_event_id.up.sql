@@ -0,0 +1,12 @@
+-- an origin can safely retry an addEvent, the EventId it generated
+-- identifies the event, so (origin_id, event_id) has to be unique
+
+-- retries before this migration created duplicates, the first one is kept
+-- and the others are moved to events_duplicates, the down migration puts
+-- them back
+CREATE TABLE IF NOT EXISTS events_duplicates AS SELECT * FROM events WHERE 0;
+INSERT INTO events_duplicates
+SELECT * FROM events WHERE id NOT IN (SELECT MIN(id) FROM events GROUP BY origin_id, event_id);
+DELETE FROM events WHERE id IN (SELECT id FROM events_duplicates);
+
+CREATE UNIQUE INDEX IF NOT EXISTS events_origin_id_event_id_key ON events (origin_id, event_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS events_origin_group_id_idx;
+DROP INDEX IF EXISTS events_event_type_idx;
@@ -0,0 +1,3 @@
+-- QueryEvents on an origin, and on an event time range
+CREATE INDEX IF NOT EXISTS events_origin_id_idx ON events (origin_id, id DESC);
+CREATE INDEX IF NOT EXISTS events_event_time_unix_sec_idx ON events (event_time_unix_sec);
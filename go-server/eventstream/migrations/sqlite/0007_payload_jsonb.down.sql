@@ -0,0 +1,2 @@
+-- the payloads stay valid JSON, there is nothing to undo
+SELECT 1;
@@ -0,0 +1,4 @@
+-- PayloadJson is nested JSON in the API, SQLite did not check the payloads
+-- so the ones that are not valid JSON are kept as a JSON string
+UPDATE events SET payload_json = NULL WHERE payload_json = '';
+UPDATE events SET payload_json = json_quote(payload_json) WHERE payload_json IS NOT NULL AND json_valid(payload_json) = 0;
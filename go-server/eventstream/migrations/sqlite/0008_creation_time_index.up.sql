@@ -0,0 +1,2 @@
+-- Retention deletes the events created before a time
+CREATE INDEX IF NOT EXISTS events_creation_time_unix_sec_idx ON events (creation_time_unix_sec);
@@ -0,0 +1,14 @@
+-- the latest event per destination and event type, updated in the same
+-- transaction as the insert of the event, see LatestEvents
+CREATE TABLE IF NOT EXISTS latest_events
+(
+    destination_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    id INTEGER NOT NULL,
+    PRIMARY KEY (destination_id, event_type)
+);
+
+INSERT INTO latest_events (destination_id, event_type, id)
+SELECT destination_id, event_type, max(id)
+FROM events WHERE event_type IS NOT NULL
+GROUP BY destination_id, event_type;
@@ -0,0 +1,16 @@
+-- the JSON Schemas of the payloads per event type and version, and the
+-- schema mode per event type, see schema.go
+CREATE TABLE IF NOT EXISTS event_schemas
+(
+    event_type TEXT NOT NULL,
+    event_version TEXT NOT NULL,
+    schema_json TEXT NOT NULL,
+    added_time_unix_sec INTEGER NOT NULL,
+    PRIMARY KEY (event_type, event_version)
+);
+
+CREATE TABLE IF NOT EXISTS event_schema_modes
+(
+    event_type TEXT NOT NULL PRIMARY KEY,
+    mode TEXT NOT NULL
+);
@@ -0,0 +1,21 @@
+-- erasure of personal data, see erasure.go
+-- an erased or redacted event stays as a tombstone, with the time of the
+-- erasure in redacted_time_unix_sec, so the ids and iters have no gaps
+ALTER TABLE events ADD COLUMN redacted_time_unix_sec INTEGER;
+
+CREATE INDEX IF NOT EXISTS origins_owner_email_idx ON origins (owner_email);
+
+-- the audit of the erasures, what was erased and by whom
+CREATE TABLE IF NOT EXISTS erasures
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time_unix_sec INTEGER NOT NULL,
+    erased_by TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    origin_ids TEXT NOT NULL, -- JSON array
+    owner_email TEXT NOT NULL,
+    paths TEXT NOT NULL, -- JSON array, empty when the whole payload was erased
+    events INTEGER NOT NULL,
+    min_id INTEGER NOT NULL,
+    max_id INTEGER NOT NULL
+);
@@ -0,0 +1,9 @@
+-- the encrypted payloads would be lost, so this fails while there are any,
+-- decrypt them first with an empty keyid: ./go-server encryption reencrypt
+-- SQLite has no RAISE outside of triggers, the CHECK fails instead
+CREATE TEMP TABLE migration_check (encrypted_events INTEGER CONSTRAINT decrypt_the_payloads_first CHECK (encrypted_events = 0));
+INSERT INTO migration_check SELECT count(*) FROM events WHERE payload_key_id IS NOT NULL;
+DROP TABLE migration_check;
+
+ALTER TABLE events DROP COLUMN payload_key_id;
+ALTER TABLE events DROP COLUMN payload_data;
@@ -0,0 +1,5 @@
+-- encryption at rest of the payloads, see encryption.go
+-- an encrypted event keeps {} in payload_json, the payload is encrypted in
+-- payload_data with the master key payload_key_id
+ALTER TABLE events ADD COLUMN payload_data BLOB;
+ALTER TABLE events ADD COLUMN payload_key_id TEXT;
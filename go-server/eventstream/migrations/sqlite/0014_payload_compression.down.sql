@@ -0,0 +1,8 @@
+-- the compressed payloads would be lost, so this fails while there are any
+-- SQLite has no RAISE outside of triggers, the CHECK fails instead
+CREATE TEMP TABLE migration_check (compressed_events INTEGER CONSTRAINT keep_the_compressed_payloads CHECK (compressed_events = 0));
+INSERT INTO migration_check SELECT count(*) FROM events WHERE payload_codec IS NOT NULL;
+DROP TABLE migration_check;
+
+ALTER TABLE events DROP COLUMN payload_size;
+ALTER TABLE events DROP COLUMN payload_codec;
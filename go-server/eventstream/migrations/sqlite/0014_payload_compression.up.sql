@@ -0,0 +1,5 @@
+-- compression of the large payloads, see compression.go
+-- a compressed event keeps {} in payload_json, the payload is compressed in
+-- payload_data with payload_codec, payload_size is the size of its JSON
+ALTER TABLE events ADD COLUMN payload_codec TEXT;
+ALTER TABLE events ADD COLUMN payload_size INTEGER;
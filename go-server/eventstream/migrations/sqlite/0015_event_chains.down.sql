@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS event_chains;
+DROP INDEX IF EXISTS events_chain_id_chain_seq_idx;
+ALTER TABLE events DROP COLUMN chain_data_hash;
+ALTER TABLE events DROP COLUMN chain_hash;
+ALTER TABLE events DROP COLUMN chain_prev_hash;
+ALTER TABLE events DROP COLUMN chain_seq;
+ALTER TABLE events DROP COLUMN chain_id;
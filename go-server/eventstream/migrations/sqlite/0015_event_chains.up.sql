@@ -0,0 +1,18 @@
+-- hash chains of the events, see chain.go
+-- chain_hash covers the event and chain_prev_hash, chain_data_hash covers
+-- the payload, event_subtype and origin_group_id and stays after an erasure
+ALTER TABLE events ADD COLUMN chain_id TEXT;
+ALTER TABLE events ADD COLUMN chain_seq INTEGER;
+ALTER TABLE events ADD COLUMN chain_prev_hash TEXT;
+ALTER TABLE events ADD COLUMN chain_hash TEXT;
+ALTER TABLE events ADD COLUMN chain_data_hash TEXT;
+
+CREATE INDEX IF NOT EXISTS events_chain_id_chain_seq_idx ON events (chain_id, chain_seq) WHERE chain_id IS NOT NULL;
+
+-- the last link of every chain
+CREATE TABLE IF NOT EXISTS event_chains
+(
+    chain_id TEXT NOT NULL PRIMARY KEY,
+    seq INTEGER NOT NULL,
+    hash TEXT NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE events DROP COLUMN signature;
+ALTER TABLE origins DROP COLUMN public_key;
@@ -0,0 +1,5 @@
+-- signed events, see signature.go
+-- an origin with a public_key (base64 Ed25519) signs its events, the
+-- signature is kept with the event so the consumers can verify it
+ALTER TABLE origins ADD COLUMN public_key TEXT;
+ALTER TABLE events ADD COLUMN signature TEXT;
@@ -0,0 +1,10 @@
+-- the EventIds of the events deleted by retention, so a late retry of an
+-- origin is not saved again, see ErrEventDeleted
+-- Postgresql keeps them in event_keys
+CREATE TABLE IF NOT EXISTS deleted_event_keys
+(
+    origin_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    id INTEGER NOT NULL,
+    PRIMARY KEY (origin_id, event_id)
+);
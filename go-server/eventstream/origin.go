@@ -8,28 +8,9 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-/*
-CREATE TABLE public.origins
-(
-    id character varying(128) NOT NULL,
-    added_iter bigserial NOT NULL,
-    added_timestamp TIMESTAMP WITHOUT TIME ZONE DEFAULT CURRENT_TIMESTAMP NOT NULL,
-    type character varying(128) NOT NULL,
-    version character varying(128) NOT NULL,
-    pass_hash character varying(128),
-    owner_email character varying(512),
-    PRIMARY KEY (id)
-);
-
-ALTER TABLE public.origins
-    OWNER to "eventstreamAdmin";
-
-GRANT SELECT ON TABLE public.origins TO "eventstream";
-*/
+// the origins table is created by the migrations, see migrate.go
 
 type Origin struct {
 	Id       string
@@ -37,18 +18,26 @@ type Origin struct {
 }
 
 type Secure struct {
-	sync.Mutex
+	sync.RWMutex
 
-	Conn              *pgxpool.Pool
+	Store             OriginStore
 	LastRefreshed     int64
 	MaxRequestsPerMin int64
 
+	// (optional) deadline of loading the origins, 0 waits for the store
+	QueryTimeout time.Duration
+
+	// a batch of events counts as one request per BatchEventsPerRequest
+	// events, 0 counts every batch as a single request
+	BatchEventsPerRequest int64
+
 	Origins map[string]*SecureOrigin
 }
 
 type SecureOrigin struct {
 	Id          string
 	PassHash    string
+	PublicKey   string // base64 Ed25519, "" if the origin does not sign its events
 	ReqsLastMin int64
 }
 
@@ -58,22 +47,27 @@ func (s *Secure) ReloadOriginsChron() {
 
 		origins := make(map[string]*SecureOrigin)
 
-		// load all origins from database into a SecureOrigin map
-		rows, err := s.Conn.Query(context.Background(),
-			"SELECT id, COALESCE(pass_hash, '') as pass_hash FROM origins")
+		// load all origins from the store into a SecureOrigin map
+		ctx, cancel := s.queryContext(context.Background())
+		loaded, err := s.Store.LoadOrigins(ctx)
+		cancel()
+		if err != nil && s.Origins == nil {
+			panic(fmt.Sprintln("could not load origins for security", err))
+		}
 		if err != nil {
-			panic("could not load origins for security")
+			// keep the origins of the last refresh
+			fmt.Println("ERROR! could not refresh origins for security", err)
+			time.Sleep(60 * time.Second)
+			continue
 		}
-		for rows.Next() {
-			origin := SecureOrigin{}
-			err := rows.Scan(
-				&origin.Id,
-				&origin.PassHash,
-			)
-			if err != nil {
-				panic("could not load SecureOrigin")
+		for i := range loaded {
+			if loaded[i].PublicKey != "" {
+				if _, err := ParsePublicKey(loaded[i].PublicKey); err != nil {
+					// its events are refused until the key is fixed
+					fmt.Println("ERROR! origin", loaded[i].Id, err)
+				}
 			}
-			origins[origin.Id] = &origin
+			origins[loaded[i].Id] = &loaded[i]
 		}
 
 		// replace origins in with the refreshed list
@@ -81,21 +75,37 @@ func (s *Secure) ReloadOriginsChron() {
 		s.Origins = origins
 		s.Unlock()
 		s.LastRefreshed = time.Now().Unix()
-		fmt.Println("refreshed origins for security, got", len(s.Origins), "origins in", time.Since(start))
+		fmt.Println("refreshed origins for security, got", len(origins), "origins in", time.Since(start))
 
 		time.Sleep(60 * time.Second)
 	}
-	panic("origins reload chron stopped")
+}
+
+// queryContext limits ctx to the QueryTimeout
+func (s *Secure) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.QueryTimeout > 0 {
+		return context.WithTimeout(ctx, s.QueryTimeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 func (s *Secure) Check(id, pass string) (bool, error, string) {
-	// check if this originId is valid
+	return s.CheckWeighted(id, pass, 1)
+}
+
+// CheckWeighted is Check for a request that counts as weight requests, for
+// instance a batch of events, see BatchWeight, it is blocked if it would
+// take the origin over its limit
+func (s *Secure) CheckWeighted(id, pass string, weight int64) (bool, error, string) {
+	// check if this originId is valid, ReloadOriginsChron swaps the map
+	s.RLock()
 	d, ok := s.Origins[id]
+	s.RUnlock()
 	if !ok {
 		return false, nil, "BLOCKED: unknown origin id"
 	}
 	// check if the origin has not reached its requests limit
-	if d.ReqsLastMin > s.MaxRequestsPerMin {
+	if atomic.LoadInt64(&d.ReqsLastMin)+weight > s.MaxRequestsPerMin {
 		return false, errors.New("maximum requests reached"), "BLOCKED: maximum number of requests reached"
 	}
 	// check if the provided password is correct
@@ -106,8 +116,28 @@ func (s *Secure) Check(id, pass string) (bool, error, string) {
 			return false, errors.New("invalid password"), "BLOCKED: invalid password"
 		}
 	}
-	// add one request to the counter
-	atomic.AddInt64(&d.ReqsLastMin, 1)
+	// add the requests to the counter
+	atomic.AddInt64(&d.ReqsLastMin, weight)
 	// you are good to go
 	return true, nil, ""
 }
+
+// BatchWeight is the number of requests a batch of n events counts for
+func (s *Secure) BatchWeight(n int) int64 {
+	if s.BatchEventsPerRequest <= 0 || n <= 0 {
+		return 1
+	}
+	return (int64(n) + s.BatchEventsPerRequest - 1) / s.BatchEventsPerRequest
+}
+
+// PublicKey returns the public key of an origin, the events of an unknown
+// origin are not signed
+func (s *Secure) PublicKey(originId string) string {
+	s.RLock()
+	defer s.RUnlock()
+	d, ok := s.Origins[originId]
+	if !ok {
+		return ""
+	}
+	return d.PublicKey
+}
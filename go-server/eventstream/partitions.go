@@ -0,0 +1,346 @@
+package eventstream
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// partitions of the events table
+//
+// In Postgresql the events table is partitioned by range on
+// creation_time_unix_sec (migration 0009). The server creates the
+// partitions ahead of time, and detaches or drops the partitions of which
+// every event is past its retention.
+//
+// The queries page on the id, which is not the partition key, so
+// PostgresStore keeps the id range of every partition and adds the matching
+// creation time range to the queries, which lets Postgresql prune the
+// partitions that cannot hold the ids.
+
+// Partitioner is implemented by the stores that partition the events table
+type Partitioner interface {
+	// ManagePartitions creates and removes partitions, maxAgeDays is the
+	// age after which every event is expired, 0 keeps them all
+	ManagePartitions(ctx context.Context, conf PartitionConf, maxAgeDays int) (PartitionReport, error)
+}
+
+// PartitionConf sets the size of the partitions and how they are managed
+type PartitionConf struct {
+	IntervalDays int  // the creation time range of a partition
+	Ahead        int  // the number of future partitions to keep ready
+	Detach       bool // detach expired partitions, to archive them, instead of dropping them
+
+	// (optional) deadline of a run of PartitionsChron, 0 waits for the store,
+	// a run that waits for the locks of the events table gives up, so the
+	// queries do not queue up behind it
+	Timeout time.Duration
+}
+
+// PartitionReport is what ManagePartitions changed
+type PartitionReport struct {
+	Created  []string
+	Detached []string
+	Dropped  []string
+}
+
+// PartitionsChron manages the partitions every interval
+func PartitionsChron(p Partitioner, conf PartitionConf, maxAgeDays int, interval time.Duration) {
+	for {
+		start := time.Now()
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if conf.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), conf.Timeout)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+		report, err := p.ManagePartitions(ctx, conf, maxAgeDays)
+		cancel()
+		if err != nil {
+			fmt.Println("ERROR! managing partitions failed", err)
+		}
+		for _, name := range report.Created {
+			fmt.Println("created partition", name)
+		}
+		for _, name := range report.Detached {
+			fmt.Println("detached expired partition", name)
+		}
+		for _, name := range report.Dropped {
+			fmt.Println("dropped expired partition", name)
+		}
+		fmt.Println("managed partitions in", time.Since(start))
+
+		time.Sleep(interval)
+	}
+}
+
+// pgPartitionLockKey makes sure only one server at a time changes partitions
+const pgPartitionLockKey = 5464782002
+
+// pgPartitionGrace is how long after its end a partition can still get
+// events, from saves that were in progress
+const pgPartitionGrace = int64(time.Hour / time.Second)
+
+type pgPartition struct {
+	Name    string
+	From    int64 // math.MinInt64 for MINVALUE
+	To      int64 // math.MaxInt64 for MAXVALUE
+	Default bool
+
+	MinId int64 // 0 if the partition is empty
+	MaxId int64
+	Open  bool // new events can still be saved in it, MaxId will grow
+}
+
+type pgPartitionCache struct {
+	sync.RWMutex
+	partitions []pgPartition
+	loaded     bool
+}
+
+// creationTimeBounds returns the creation time range of the partitions that
+// can hold events with newestId < id < lastId, to is 0 if it is open ended,
+// ok is false if the partitions do not narrow it down
+func (pc *pgPartitionCache) creationTimeBounds(newestId, lastId int64) (from, to int64, ok bool) {
+	pc.RLock()
+	defer pc.RUnlock()
+
+	if !pc.loaded || (newestId <= 0 && lastId <= 0) {
+		return 0, 0, false
+	}
+
+	from, to = math.MaxInt64, math.MinInt64
+	open := false
+	maxId := int64(0)
+	for _, p := range pc.partitions {
+		if p.MaxId > maxId {
+			maxId = p.MaxId
+		}
+		if p.MinId == 0 && !p.Open {
+			continue
+		}
+		if lastId > 0 && p.MinId != 0 && p.MinId >= lastId {
+			continue
+		}
+		if newestId > 0 && !p.Open && p.MaxId <= newestId {
+			continue
+		}
+		if p.Default {
+			// the default partition has no range
+			return 0, 0, false
+		}
+		if p.From < from {
+			from = p.From
+		}
+		if p.To > to {
+			to = p.To
+		}
+		open = open || p.Open
+	}
+	if from > to {
+		return 0, 0, false
+	}
+	if from == math.MinInt64 {
+		from = 0
+	}
+	// events can be saved in partitions created after the last refresh, by
+	// this server or another one, their ids are above the cached ids
+	if open || to == math.MaxInt64 || lastId <= 0 || lastId > maxId {
+		to = 0
+	}
+	return from, to, true
+}
+
+// pgPartitionBound parses the bound of a partition from pg_get_expr
+var pgPartitionBound = regexp.MustCompile(`FROM \((MINVALUE|'?(-?\d+)'?)\) TO \((MAXVALUE|'?(-?\d+)'?)\)`)
+
+// pgListPartitions returns the partitions of events, ordered by From
+func pgListPartitions(ctx context.Context, q pgQuerier) ([]pgPartition, error) {
+	rows, err := q.Query(ctx,
+		"SELECT c.relname, pg_get_expr(c.relpartbound, c.oid) FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'events'::regclass")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := []pgPartition{}
+	for rows.Next() {
+		var name, bound string
+		if err := rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		p := pgPartition{Name: name, From: math.MinInt64, To: math.MaxInt64}
+		if bound == "DEFAULT" {
+			p.Default = true
+			partitions = append(partitions, p)
+			continue
+		}
+		m := pgPartitionBound.FindStringSubmatch(bound)
+		if m == nil {
+			return nil, fmt.Errorf("cannot parse the bound of partition %s: %s", name, bound)
+		}
+		if m[1] != "MINVALUE" {
+			p.From, _ = strconv.ParseInt(m[2], 10, 64)
+		}
+		if m[3] != "MAXVALUE" {
+			p.To, _ = strconv.ParseInt(m[4], 10, 64)
+		}
+		partitions = append(partitions, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(partitions); i++ {
+		for j := i; j > 0 && partitions[j].From < partitions[j-1].From; j-- {
+			partitions[j], partitions[j-1] = partitions[j-1], partitions[j]
+		}
+	}
+	return partitions, nil
+}
+
+// ManagePartitions
+func (ps *PostgresStore) ManagePartitions(ctx context.Context, conf PartitionConf, maxAgeDays int) (PartitionReport, error) {
+	report := PartitionReport{}
+
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback(ctx)
+
+	// another server is at it, only refresh the id ranges
+	var locked bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", pgPartitionLockKey).Scan(&locked); err != nil {
+		return report, err
+	}
+	if locked {
+		report, err = pgChangePartitions(ctx, tx, conf, maxAgeDays)
+		if err != nil {
+			return report, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return PartitionReport{}, err
+	}
+
+	if err := ps.refreshPartitions(ctx); err != nil {
+		// the partitions might have changed, do not narrow the queries
+		// down with the old ranges
+		ps.partitions.Lock()
+		ps.partitions.loaded = false
+		ps.partitions.Unlock()
+		return report, err
+	}
+	return report, nil
+}
+
+// pgChangePartitions creates the next partitions and removes the expired ones
+func pgChangePartitions(ctx context.Context, tx pgx.Tx, conf PartitionConf, maxAgeDays int) (PartitionReport, error) {
+	report := PartitionReport{}
+	size := int64(conf.IntervalDays) * 24 * 60 * 60
+	now := time.Now().Unix()
+
+	partitions, err := pgListPartitions(ctx, tx)
+	if err != nil {
+		return report, err
+	}
+
+	// continue after the last partition, and after the events that ended up
+	// in the default partition, a new range cannot overlap with those
+	next := now / size * size
+	for _, p := range partitions {
+		if p.Default {
+			var defaultMax *int64
+			err := tx.QueryRow(ctx, "SELECT max(creation_time_unix_sec) FROM "+pgx.Identifier{p.Name}.Sanitize()).Scan(&defaultMax)
+			if err != nil {
+				return report, err
+			}
+			if defaultMax != nil && *defaultMax >= next {
+				next = (*defaultMax/size + 1) * size
+			}
+		} else if p.To != math.MaxInt64 && p.To > next {
+			next = p.To
+		}
+	}
+	for next < now+int64(conf.Ahead)*size {
+		end := (next/size + 1) * size
+		name := "events_p" + time.Unix(next, 0).UTC().Format("20060102")
+		_, err := tx.Exec(ctx, fmt.Sprintf("CREATE TABLE %s PARTITION OF events FOR VALUES FROM (%d) TO (%d)", pgx.Identifier{name}.Sanitize(), next, end))
+		if err != nil {
+			return report, fmt.Errorf("cannot create partition %s: %w", name, err)
+		}
+		report.Created = append(report.Created, name)
+		next = end
+	}
+
+	if maxAgeDays <= 0 {
+		return report, nil
+	}
+	expired := now - int64(maxAgeDays)*24*60*60
+	for _, p := range partitions {
+		if p.Default || p.To > expired {
+			continue
+		}
+		table := pgx.Identifier{p.Name}.Sanitize()
+		if conf.Detach {
+			_, err = tx.Exec(ctx, "ALTER TABLE events DETACH PARTITION "+table)
+			report.Detached = append(report.Detached, p.Name)
+		} else {
+			_, err = tx.Exec(ctx, "DROP TABLE "+table)
+			report.Dropped = append(report.Dropped, p.Name)
+		}
+		if err != nil {
+			return report, fmt.Errorf("cannot remove partition %s: %w", p.Name, err)
+		}
+		// the event_keys rows are kept, the EventIds stay taken like after
+		// a retention run, see ErrEventDeleted
+		var destIds, eventTypes []string
+		err = tx.QueryRow(ctx,
+			"WITH stale AS (DELETE FROM latest_events WHERE creation_time_unix_sec >= $1 AND creation_time_unix_sec < $2 RETURNING destination_id, event_type) SELECT COALESCE(array_agg(destination_id), '{}'), COALESCE(array_agg(event_type), '{}') FROM stale",
+			p.From, p.To,
+		).Scan(&destIds, &eventTypes)
+		if err != nil {
+			return report, err
+		}
+		if err := pgRecomputeLatest(ctx, tx, destIds, eventTypes); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// refreshPartitions reloads the partitions and their id ranges
+func (ps *PostgresStore) refreshPartitions(ctx context.Context) error {
+	partitions, err := pgListPartitions(ctx, ps.Conn)
+	if err != nil {
+		return err
+	}
+
+	closed := time.Now().Unix() - pgPartitionGrace
+	for i := range partitions {
+		p := &partitions[i]
+		var minId, maxId *int64
+		err := ps.Conn.QueryRow(ctx, "SELECT min(id), max(id) FROM "+pgx.Identifier{p.Name}.Sanitize()).Scan(&minId, &maxId)
+		if err != nil {
+			return err
+		}
+		if minId != nil {
+			p.MinId, p.MaxId = *minId, *maxId
+		}
+		p.Open = p.Default || p.To > closed
+	}
+
+	ps.partitions.Lock()
+	ps.partitions.partitions = partitions
+	ps.partitions.loaded = true
+	ps.partitions.Unlock()
+	return nil
+}
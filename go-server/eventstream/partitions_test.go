@@ -0,0 +1,42 @@
+package eventstream
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCreationTimeBounds(t *testing.T) {
+	cache := pgPartitionCache{loaded: true, partitions: []pgPartition{
+		{Name: "events_legacy", From: math.MinInt64, To: 100, MinId: 1, MaxId: 10},
+		{Name: "events_p1", From: 100, To: 200, MinId: 11, MaxId: 20},
+		{Name: "events_p2", From: 200, To: 300, MinId: 21, MaxId: 30},
+	}}
+
+	tests := []struct {
+		name             string
+		newestId, lastId int64
+		from, to         int64
+		ok               bool
+	}{
+		{"no pagination", -1, 0, 0, 0, false},
+		{"page in the middle", -1, 15, 0, 200, true},
+		{"page in the oldest", -1, 5, 0, 100, true},
+		{"newer than a partition", 12, 25, 100, 300, true},
+		{"first page is open ended", 15, 0, 100, 0, true},
+		{"ids of partitions created since the refresh", 15, 40, 100, 0, true},
+		{"newer than all cached ids", 35, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, ok := cache.creationTimeBounds(tt.newestId, tt.lastId)
+			if ok != tt.ok || (ok && (from != tt.from || to != tt.to)) {
+				t.Errorf("creationTimeBounds(%d, %d) = %d, %d, %v, want %d, %d, %v", tt.newestId, tt.lastId, from, to, ok, tt.from, tt.to, tt.ok)
+			}
+		})
+	}
+
+	stale := pgPartitionCache{partitions: cache.partitions}
+	if _, _, ok := stale.creationTimeBounds(-1, 15); ok {
+		t.Error("a cache that is not loaded should not narrow the query down")
+	}
+}
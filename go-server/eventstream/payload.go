@@ -0,0 +1,351 @@
+package eventstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// PayloadFilter selects events on a value in their JSON payload,
+// for instance all battery events with payload.level < 20.
+//
+// The text form, as used by the HTTP API, is
+//
+//	level<20                    comparisons: = != < <= > >=
+//	status=low                  a value that is not JSON is a string
+//	battery.cells.0.volt>=3.2   a path of keys and array indexes
+//	gps.fix exists              the path is in the payload, also when it is null
+//	status in ["low","empty"]   the value is one of a JSON array
+//
+// The semantics are those of Postgresql jsonb: = and != compare JSON values,
+// numbers by value, so 20 = 20.0 but 20 != "20", and != is false if the path
+// is not in the payload. < <= > >= compare numbers with numbers and strings
+// with strings (byte order), other types never match.
+type PayloadFilter struct {
+	Path  []string        // keys, or array indexes, from the root of the payload
+	Op    string          // one of the PayloadOps
+	Value json.RawMessage // the JSON value to compare with, for in a JSON array
+}
+
+// PayloadOps are the operators of a PayloadFilter
+var PayloadOps = []string{"=", "!=", "<", "<=", ">", ">=", "exists", "in"}
+
+// ParsePayloadFilter parses the text form of a PayloadFilter
+func ParsePayloadFilter(s string) (PayloadFilter, error) {
+	s = strings.TrimSpace(s)
+	f := PayloadFilter{}
+	path := ""
+
+	// the first operator is the one, the value can contain anything
+	i := strings.IndexAny(s, "!<>=")
+	in := strings.Index(s, " in ")
+	if in >= 0 && (i < 0 || in < i) {
+		path = s[:in]
+		f.Op = "in"
+		f.Value = json.RawMessage(strings.TrimSpace(s[in+len(" in "):]))
+	} else if i < 0 && strings.HasSuffix(s, " exists") {
+		path = strings.TrimSuffix(s, " exists")
+		f.Op = "exists"
+	} else {
+		if i < 0 {
+			return f, fmt.Errorf("no operator in payload filter %q", s)
+		}
+		path = s[:i]
+		f.Op = s[i : i+1]
+		if i+1 < len(s) && s[i+1] == '=' && f.Op != "=" {
+			f.Op += "="
+		}
+		value := strings.TrimSpace(s[i+len(f.Op):])
+		if json.Valid([]byte(value)) {
+			f.Value = json.RawMessage(value)
+		} else {
+			f.Value, _ = json.Marshal(value)
+		}
+	}
+
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return f, fmt.Errorf("no path in payload filter %q", s)
+	}
+	f.Path = strings.Split(path, ".")
+
+	return f, f.Check()
+}
+
+// Check validates the filter, so it can be matched and translated to SQL
+func (f *PayloadFilter) Check() error {
+	if len(f.Path) == 0 {
+		return errors.New("payload filter has no path")
+	}
+	for _, key := range f.Path {
+		if key == "" {
+			return fmt.Errorf("payload filter path %q has an empty key", strings.Join(f.Path, "."))
+		}
+	}
+
+	switch f.Op {
+	case "exists":
+		return nil
+	case "=", "!=":
+		if !json.Valid(f.Value) {
+			return fmt.Errorf("payload filter value %s is not valid JSON", f.Value)
+		}
+	case "<", "<=", ">", ">=":
+		value, err := decodePayload(f.Value)
+		if err != nil {
+			return fmt.Errorf("payload filter value %s is not valid JSON", f.Value)
+		}
+		switch value.(type) {
+		case json.Number, string:
+		default:
+			return fmt.Errorf("payload filter %s compares with a number or a string, not %s", f.Op, f.Value)
+		}
+	case "in":
+		values := []json.RawMessage{}
+		if err := json.Unmarshal(f.Value, &values); err != nil {
+			return fmt.Errorf("payload filter in needs a JSON array, not %s", f.Value)
+		}
+	default:
+		return fmt.Errorf("unknown payload filter operator %q", f.Op)
+	}
+	return nil
+}
+
+// Match reports if the payload passes the filter
+func (f *PayloadFilter) Match(payload json.RawMessage) bool {
+	root, err := decodePayload(payload)
+	if err != nil {
+		return false
+	}
+	return f.matchValue(root)
+}
+
+// matchValue is Match on a payload decoded with decodePayload
+func (f *PayloadFilter) matchValue(root interface{}) bool {
+	value, ok := payloadPath(root, f.Path)
+	if !ok {
+		return false
+	}
+	if f.Op == "exists" {
+		return true
+	}
+
+	if f.Op == "in" {
+		values := []json.RawMessage{}
+		json.Unmarshal(f.Value, &values)
+		for _, v := range values {
+			other, err := decodePayload(v)
+			if err == nil && jsonEqual(value, other) {
+				return true
+			}
+		}
+		return false
+	}
+
+	other, err := decodePayload(f.Value)
+	if err != nil {
+		return false
+	}
+	switch f.Op {
+	case "=":
+		return jsonEqual(value, other)
+	case "!=":
+		return !jsonEqual(value, other)
+	}
+
+	cmp := 0
+	switch o := other.(type) {
+	case json.Number:
+		v, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		cmp = jsonNumber(v).Cmp(jsonNumber(o))
+	case string:
+		v, ok := value.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(v, o)
+	default:
+		return false
+	}
+	switch f.Op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// decodePayload decodes JSON with the numbers as json.Number,
+// so they are compared exactly like jsonb does
+func decodePayload(data json.RawMessage) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+// payloadPath follows path into a decoded payload, like the jsonb #> operator,
+// array indexes can be negative to count from the end
+func payloadPath(value interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, false
+			}
+			if i < 0 {
+				i += len(v)
+			}
+			if i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// payloadRemove removes the value at path from a decoded payload, like the
+// jsonb #- operator, it returns false if the path is not in the payload
+func payloadRemove(value interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return value, false
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		next, ok := v[path[0]]
+		if !ok {
+			return value, false
+		}
+		if len(path) == 1 {
+			delete(v, path[0])
+			return v, true
+		}
+		next, removed := payloadRemove(next, path[1:])
+		v[path[0]] = next
+		return v, removed
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil {
+			return value, false
+		}
+		if i < 0 {
+			i += len(v)
+		}
+		if i < 0 || i >= len(v) {
+			return value, false
+		}
+		if len(path) == 1 {
+			return append(v[:i:i], v[i+1:]...), true
+		}
+		next, removed := payloadRemove(v[i], path[1:])
+		v[i] = next
+		return v, removed
+	}
+	return value, false
+}
+
+// jsonNumber converts a json.Number to an exact rational
+func jsonNumber(n json.Number) *big.Rat {
+	r, ok := new(big.Rat).SetString(string(n))
+	if !ok {
+		return new(big.Rat)
+	}
+	return r
+}
+
+// jsonEqual compares decoded JSON values like jsonb =
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		return ok && jsonNumber(a).Cmp(jsonNumber(b)) == 0
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		// string, bool and nil
+		return a == b
+	}
+}
+
+// pgSQL translates the filter into a jsonb predicate on payload_json,
+// arg adds a parameter and returns its placeholder
+func (f *PayloadFilter) pgSQL(arg func(value interface{}) string) string {
+	values := []json.RawMessage{}
+	if f.Op == "in" {
+		json.Unmarshal(f.Value, &values)
+		if len(values) == 0 {
+			// every parameter must be used, so no path here
+			return "FALSE"
+		}
+	}
+
+	pathArg := arg(f.Path) + "::text[]"
+	path := "payload_json #> " + pathArg
+
+	switch f.Op {
+	case "exists":
+		return path + " IS NOT NULL"
+	case "=":
+		return path + " = " + arg(string(f.Value)) + "::jsonb"
+	case "!=":
+		return path + " <> " + arg(string(f.Value)) + "::jsonb"
+	case "in":
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			placeholders[i] = arg(string(v)) + "::jsonb"
+		}
+		return path + " IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	// < <= > >= only compare values of the same type,
+	// strings in byte order like Go does
+	value, _ := decodePayload(f.Value)
+	if s, ok := value.(string); ok {
+		return "(jsonb_typeof(" + path + ") = 'string' AND (payload_json #>> " + pathArg + ") COLLATE \"C\" " + f.Op + " " + arg(s) + ")"
+	}
+	return "(jsonb_typeof(" + path + ") = 'number' AND " + path + " " + f.Op + " " + arg(string(f.Value)) + "::jsonb)"
+}
@@ -0,0 +1,1273 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PostgresStore is the EventStore, OriginStore, SchemaStore, Eraser and PayloadStore
+// backed by Postgresql
+// the tables are created by the migrations in migrations/postgres
+type PostgresStore struct {
+	Conn *pgxpool.Pool
+
+	// the id ranges of the partitions of events, see partitions.go
+	partitions pgPartitionCache
+}
+
+// pgMigrationLockKey is the advisory lock that makes sure only one server
+// at a time runs migrations on the same database
+const pgMigrationLockKey = 5464782001
+
+// Migrations
+func (ps *PostgresStore) Migrations() ([]Migration, error) {
+	return LoadMigrations("postgres")
+}
+
+// AppliedMigrations
+func (ps *PostgresStore) AppliedMigrations(ctx context.Context) (map[int64]int64, error) {
+	applied := make(map[int64]int64)
+
+	_, err := ps.Conn.Exec(ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, name character varying(256) NOT NULL, applied_time_unix_sec bigint NOT NULL)")
+	if err != nil {
+		return applied, err
+	}
+
+	rows, err := ps.Conn.Query(ctx, "SELECT version, applied_time_unix_sec FROM schema_migrations")
+	if err != nil {
+		return applied, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version, appliedTime int64
+		if err := rows.Scan(&version, &appliedTime); err != nil {
+			return applied, err
+		}
+		applied[version] = appliedTime
+	}
+	return applied, rows.Err()
+}
+
+// ApplyMigration
+func (ps *PostgresStore) ApplyMigration(ctx context.Context, m Migration, up bool) error {
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", pgMigrationLockKey); err != nil {
+		return err
+	}
+	// another server might have migrated while we waited for the lock
+	var applied bool
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version=$1)", m.Version).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied == up {
+		return nil
+	}
+
+	// without arguments Exec uses the simple protocol, which allows multiple statements
+	if up {
+		if _, err := tx.Exec(ctx, m.Up); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, applied_time_unix_sec) VALUES ($1, $2, $3)", m.Version, m.Name, time.Now().Unix())
+	} else {
+		if _, err := tx.Exec(ctx, m.Down); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version=$1", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// InsertEvent
+// an event that was already saved by its origin is not inserted again,
+// then the original Id is returned together with ErrDuplicateEvent
+//
+// OriginIter and DestinationIter are assigned in the same transaction as the
+// insert, the stream_iters row locks serialize the inserts per origin and
+// destination, and a failed insert rolls back its iters, so there are no gaps
+func (ps *PostgresStore) InsertEvent(ctx context.Context, em EventMessage) (EventMessage, error) {
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return em, err
+	}
+	defer tx.Rollback(ctx)
+
+	saved, err := pgInsertEvent(ctx, tx, em)
+	if errors.Is(err, errConcurrentDuplicate) {
+		// roll back our iters and return the original
+		tx.Rollback(ctx)
+		return pgFindOriginal(ctx, ps.Conn, em)
+	}
+	if err != nil {
+		return saved, err
+	}
+
+	return saved, tx.Commit(ctx)
+}
+
+// InsertEvents
+// the batch is first saved with one multi-row insert, if an event of the
+// batch fails or is a duplicate, the batch is saved again event by event
+func (ps *PostgresStore) InsertEvents(ctx context.Context, ems []EventMessage) ([]SaveResult, error) {
+	results, err := ps.insertEventsMultiRow(ctx, ems)
+	if err == nil || ctx.Err() != nil {
+		return results, err
+	}
+	return ps.insertEventsOneByOne(ctx, ems)
+}
+
+// insertEventsMultiRow saves all events with a single insert statement,
+// it fails as a whole when one of the events cannot be inserted
+func (ps *PostgresStore) insertEventsMultiRow(ctx context.Context, ems []EventMessage) ([]SaveResult, error) {
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	iters, err := pgLockIters(ctx, tx, ems)
+	if err != nil {
+		return nil, err
+	}
+
+	// the iters are set on a copy, the slow path might need the originals
+	ems = append([]EventMessage(nil), ems...)
+
+	// duplicates take the slow path, so they do not use up iters
+	n := len(ems)
+	eventIds := make([]string, n)
+	originIds := make([]string, n)
+	seen := make(map[string]bool)
+	for i, em := range ems {
+		eventIds[i] = em.EventId
+		originIds[i] = em.OriginId
+		key := em.OriginId + " " + em.EventId
+		if seen[key] {
+			return nil, ErrDuplicateEvent
+		}
+		seen[key] = true
+	}
+	var duplicates int
+	err = tx.QueryRow(ctx,
+		"SELECT count(*) FROM event_keys e JOIN unnest($1::text[], $2::text[]) AS k(origin_id, event_id) ON e.origin_id = k.origin_id AND e.event_id = k.event_id",
+		originIds,
+		eventIds,
+	).Scan(&duplicates)
+	if err != nil {
+		return nil, err
+	}
+	if duplicates > 0 {
+		return nil, ErrDuplicateEvent
+	}
+
+	// assign the iters in the order of the batch
+	creationTimes := make([]int64, n)
+	for i := range ems {
+		em := &ems[i]
+		iters["origin "+em.OriginId]++
+		em.OriginIter = iters["origin "+em.OriginId]
+		iters["destination "+em.DestinationId]++
+		em.DestinationIter = iters["destination "+em.DestinationId]
+		creationTimes[i] = em.CreationTimeUnixSec
+		// a wrong version takes the slow path, which fails only that event
+		if err := checkVersion(*em, em.DestinationIter-1); err != nil {
+			return nil, err
+		}
+	}
+	heads, err := pgLockChains(ctx, tx, ems)
+	if err != nil {
+		return nil, err
+	}
+	linkChains(heads, ems)
+
+	// claim the keys first, a concurrent retry blocks on them
+	rows, err := tx.Query(ctx,
+		`INSERT INTO event_keys (origin_id, event_id, id, creation_time_unix_sec)
+		SELECT origin_id, event_id, nextval('events_id_seq'), creation_time_unix_sec
+		FROM unnest($1::text[], $2::text[], $3::bigint[]) AS k(origin_id, event_id, creation_time_unix_sec)
+		ON CONFLICT (origin_id, event_id) DO NOTHING
+		RETURNING id, origin_id, event_id`,
+		originIds, eventIds, creationTimes,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var originId, eventId string
+		if err := rows.Scan(&id, &originId, &eventId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids[originId+" "+eventId] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) != n {
+		return nil, errConcurrentDuplicate
+	}
+
+	for i := range ems {
+		ems[i].Id = ids[ems[i].OriginId+" "+ems[i].EventId]
+	}
+	if err := pgInsertRows(ctx, tx, ems); err != nil {
+		return nil, err
+	}
+	if err := pgSaveChains(ctx, tx, heads); err != nil {
+		return nil, err
+	}
+
+	// save the last iters
+	streamTypes := []string{}
+	streamIds := []string{}
+	lastIters := []int64{}
+	for key, iter := range iters {
+		parts := strings.SplitN(key, " ", 2)
+		streamTypes = append(streamTypes, parts[0])
+		streamIds = append(streamIds, parts[1])
+		lastIters = append(lastIters, iter)
+	}
+	_, err = tx.Exec(ctx,
+		"UPDATE stream_iters AS s SET iter = v.iter FROM unnest($1::text[], $2::text[], $3::bigint[]) AS v(stream_type, stream_id, iter) WHERE s.stream_type = v.stream_type AND s.stream_id = v.stream_id",
+		streamTypes,
+		streamIds,
+		lastIters,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	results := make([]SaveResult, n)
+	for i, em := range ems {
+		results[i] = SaveResult{Event: em}
+	}
+	return results, nil
+}
+
+// pgInsertRows inserts events of which the Id and iters are set
+// with a single statement
+func pgInsertRows(ctx context.Context, tx pgx.Tx, ems []EventMessage) error {
+	n := len(ems)
+	ids := make([]int64, n)
+	eventIds := make([]string, n)
+	creationTimes := make([]int64, n)
+	originIds := make([]string, n)
+	originIters := make([]int64, n)
+	groupIds := make([]string, n)
+	buildVersions := make([]string, n)
+	destIds := make([]string, n)
+	destIters := make([]int64, n)
+	eventTimes := make([]int64, n)
+	eventTypes := make([]string, n)
+	eventSubtypes := make([]string, n)
+	eventVersions := make([]string, n)
+	payloads := make([]string, n)
+	redactedTimes := make([]int64, n)
+	payloadData := make([][]byte, n)
+	payloadKeyIds := make([]string, n)
+	payloadCodecs := make([]string, n)
+	payloadSizes := make([]int64, n)
+	chainIds := make([]string, n)
+	chainSeqs := make([]int64, n)
+	chainPrevHashes := make([]string, n)
+	chainHashes := make([]string, n)
+	chainDataHashes := make([]string, n)
+	signatures := make([]string, n)
+	for i, em := range ems {
+		ids[i] = em.Id
+		eventIds[i] = em.EventId
+		creationTimes[i] = em.CreationTimeUnixSec
+		originIds[i] = em.OriginId
+		originIters[i] = em.OriginIter
+		groupIds[i] = em.OriginGroupId
+		buildVersions[i] = em.OriginBuildVersion
+		destIds[i] = em.DestinationId
+		destIters[i] = em.DestinationIter
+		eventTimes[i] = em.EventTimeUnixSec
+		eventTypes[i] = em.EventType
+		eventSubtypes[i] = em.EventSubtype
+		eventVersions[i] = em.EventVersion
+		payloads[i] = string(em.PayloadJson)
+		redactedTimes[i] = em.RedactedUnixSec
+		payloadData[i] = em.payloadData
+		payloadKeyIds[i] = em.payloadKeyId
+		payloadCodecs[i] = em.payloadCodec
+		payloadSizes[i] = em.payloadSize
+		signatures[i] = em.Signature
+		if em.Chain != nil {
+			chainIds[i] = em.Chain.Id
+			chainSeqs[i] = em.Chain.Seq
+			chainPrevHashes[i] = em.Chain.PrevHash
+			chainHashes[i] = em.Chain.Hash
+			chainDataHashes[i] = em.Chain.DataHash
+		}
+	}
+
+	_, err := tx.Exec(ctx,
+		`INSERT INTO events (id, event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, destination_iter, event_time_unix_sec, event_type, event_subtype, event_version, payload_json, redacted_time_unix_sec, payload_data, payload_key_id, payload_codec, payload_size, chain_id, chain_seq, chain_prev_hash, chain_hash, chain_data_hash, signature)
+		SELECT id, event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, destination_iter, event_time_unix_sec, event_type, event_subtype, event_version, payload_json::jsonb, NULLIF(redacted_time_unix_sec, 0), payload_data, NULLIF(payload_key_id, ''), NULLIF(payload_codec, ''), NULLIF(payload_size, 0), NULLIF(chain_id, ''), NULLIF(chain_seq, 0), NULLIF(chain_prev_hash, ''), NULLIF(chain_hash, ''), NULLIF(chain_data_hash, ''), NULLIF(signature, '')
+		FROM unnest($1::bigint[], $2::text[], $3::bigint[], $4::text[], $5::bigint[], $6::text[], $7::text[], $8::text[], $9::bigint[], $10::bigint[], $11::text[], $12::text[], $13::text[], $14::text[], $15::bigint[], $16::bytea[], $17::text[], $18::text[], $19::bigint[], $20::text[], $21::bigint[], $22::text[], $23::text[], $24::text[], $25::text[])
+		AS t(id, event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, destination_iter, event_time_unix_sec, event_type, event_subtype, event_version, payload_json, redacted_time_unix_sec, payload_data, payload_key_id, payload_codec, payload_size, chain_id, chain_seq, chain_prev_hash, chain_hash, chain_data_hash, signature)`,
+		ids, eventIds, creationTimes, originIds, originIters, groupIds, buildVersions, destIds, destIters, eventTimes, eventTypes, eventSubtypes, eventVersions, payloads, redactedTimes, payloadData, payloadKeyIds, payloadCodecs, payloadSizes, chainIds, chainSeqs, chainPrevHashes, chainHashes, chainDataHashes, signatures,
+	)
+	if err != nil {
+		return err
+	}
+	return pgUpdateLatest(ctx, tx, ems)
+}
+
+// pgUpdateLatest moves latest_events to the newest of ems per destination
+// and event type, the rows are locked in sorted order
+func pgUpdateLatest(ctx context.Context, tx pgx.Tx, ems []EventMessage) error {
+	latest := make(map[string]*EventMessage)
+	for i := range ems {
+		em := &ems[i]
+		if em.EventType == "" {
+			continue
+		}
+		key := em.DestinationId + " " + em.EventType
+		if latest[key] == nil || em.Id > latest[key].Id {
+			latest[key] = em
+		}
+	}
+	if len(latest) == 0 {
+		return nil
+	}
+
+	destIds := []string{}
+	eventTypes := []string{}
+	ids := []int64{}
+	creationTimes := []int64{}
+	for _, em := range latest {
+		destIds = append(destIds, em.DestinationId)
+		eventTypes = append(eventTypes, em.EventType)
+		ids = append(ids, em.Id)
+		creationTimes = append(creationTimes, em.CreationTimeUnixSec)
+	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO latest_events (destination_id, event_type, id, creation_time_unix_sec)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::bigint[], $4::bigint[]) AS l(destination_id, event_type, id, creation_time_unix_sec)
+		ORDER BY destination_id, event_type
+		ON CONFLICT (destination_id, event_type) DO UPDATE SET id = EXCLUDED.id, creation_time_unix_sec = EXCLUDED.creation_time_unix_sec
+		WHERE latest_events.id < EXCLUDED.id`,
+		destIds, eventTypes, ids, creationTimes,
+	)
+	return err
+}
+
+// pgRecomputeLatest sets latest_events of the destinations and event types
+// to their newest event, after the latest ones were deleted
+func pgRecomputeLatest(ctx context.Context, tx pgx.Tx, destIds, eventTypes []string) error {
+	if len(destIds) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx,
+		`INSERT INTO latest_events (destination_id, event_type, id, creation_time_unix_sec)
+		SELECT k.destination_id, k.event_type, e.id, e.creation_time_unix_sec
+		FROM unnest($1::text[], $2::text[]) AS k(destination_id, event_type)
+		CROSS JOIN LATERAL (SELECT id, creation_time_unix_sec FROM events WHERE destination_id = k.destination_id AND event_type = k.event_type ORDER BY id DESC LIMIT 1) AS e
+		ORDER BY k.destination_id, k.event_type
+		ON CONFLICT (destination_id, event_type) DO UPDATE SET id = EXCLUDED.id, creation_time_unix_sec = EXCLUDED.creation_time_unix_sec
+		WHERE latest_events.id < EXCLUDED.id`,
+		destIds, eventTypes,
+	)
+	return err
+}
+
+// insertEventsOneByOne inserts every event in its own savepoint,
+// so a failing event only rolls back itself and its iters
+func (ps *PostgresStore) insertEventsOneByOne(ctx context.Context, ems []EventMessage) ([]SaveResult, error) {
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := pgLockIters(ctx, tx, ems); err != nil {
+		return nil, err
+	}
+
+	results := make([]SaveResult, len(ems))
+	for i, em := range ems {
+		savepoint, err := tx.Begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		saved, err := pgInsertEvent(ctx, savepoint, em)
+		if err != nil {
+			savepoint.Rollback(ctx)
+			if errors.Is(err, errConcurrentDuplicate) {
+				saved, err = pgFindOriginal(ctx, tx, em)
+			}
+			results[i] = SaveResult{Event: saved, Err: err}
+			continue
+		}
+		if err := savepoint.Commit(ctx); err != nil {
+			return nil, err
+		}
+		results[i] = SaveResult{Event: saved}
+	}
+
+	return results, tx.Commit(ctx)
+}
+
+// errConcurrentDuplicate means a concurrent retry of the same event was
+// inserted first, the transaction has to be rolled back to undo the iters
+var errConcurrentDuplicate = errors.New("event was inserted concurrently")
+
+// pgInsertEvent assigns the iters and inserts em in tx
+func pgInsertEvent(ctx context.Context, tx pgx.Tx, em EventMessage) (EventMessage, error) {
+	// a retry should not use up iters, so check for it first
+	original, err := pgFindOriginal(ctx, tx, em)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return original, err
+	}
+
+	em.OriginIter, err = pgNextIter(ctx, tx, "origin", em.OriginId)
+	if err != nil {
+		return em, err
+	}
+	em.DestinationIter, err = pgNextIter(ctx, tx, "destination", em.DestinationId)
+	if err != nil {
+		return em, err
+	}
+	if err := checkVersion(em, em.DestinationIter-1); err != nil {
+		// a retry that waited here for its original is a duplicate
+		if original, findErr := pgFindOriginal(ctx, tx, em); !errors.Is(findErr, pgx.ErrNoRows) {
+			return original, findErr
+		}
+		return em, err
+	}
+	heads, err := pgLockChains(ctx, tx, []EventMessage{em})
+	if err != nil {
+		return em, err
+	}
+	chain := &ChainLink{}
+	if em.Chain != nil {
+		heads[em.Chain.Id].link(&em)
+		chain = em.Chain
+	}
+
+	// (origin_id, event_id) is kept unique in event_keys, a concurrent
+	// retry blocks here until the first one is committed
+	err = tx.QueryRow(
+		ctx,
+		"INSERT INTO event_keys (origin_id, event_id, id, creation_time_unix_sec) VALUES ($1, $2, nextval('events_id_seq'), $3) ON CONFLICT (origin_id, event_id) DO NOTHING RETURNING id",
+		em.OriginId,
+		em.EventId,
+		em.CreationTimeUnixSec,
+	).Scan(
+		&em.Id,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return em, errConcurrentDuplicate
+	}
+	if err != nil {
+		return em, err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO events (id, event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, destination_iter, event_time_unix_sec, event_type, event_subtype, event_version, payload_json, payload_data, payload_key_id, payload_codec, payload_size, chain_id, chain_seq, chain_prev_hash, chain_hash, chain_data_hash, signature) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, NULLIF($16, ''), NULLIF($17, ''), NULLIF($18, 0), NULLIF($19, ''), NULLIF($20, 0), NULLIF($21, ''), NULLIF($22, ''), NULLIF($23, ''), NULLIF($24, ''))",
+
+		em.Id,
+		em.EventId,
+		em.CreationTimeUnixSec,
+		em.OriginId,
+		em.OriginIter,
+		em.OriginGroupId,
+		em.OriginBuildVersion,
+		em.DestinationId,
+		em.DestinationIter,
+		em.EventTimeUnixSec,
+		em.EventType,
+		em.EventSubtype,
+		em.EventVersion,
+		string(em.PayloadJson),
+		em.payloadData,
+		em.payloadKeyId,
+		em.payloadCodec,
+		em.payloadSize,
+		chain.Id,
+		chain.Seq,
+		chain.PrevHash,
+		chain.Hash,
+		chain.DataHash,
+		em.Signature,
+	)
+	if err != nil {
+		return em, err
+	}
+	if err := pgSaveChains(ctx, tx, heads); err != nil {
+		return em, err
+	}
+	return em, pgUpdateLatest(ctx, tx, []EventMessage{em})
+}
+
+// pgFindOriginal returns the original of em with ErrDuplicateEvent, or em
+// with the Id of the original with ErrEventDeleted if it was deleted since,
+// or pgx.ErrNoRows if the origin did not save the EventId before
+func pgFindOriginal(ctx context.Context, q pgQuerier, em EventMessage) (EventMessage, error) {
+	original, err := pgFindByEventId(ctx, q, em.OriginId, em.EventId)
+	if err == nil {
+		return original, ErrDuplicateEvent
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return em, err
+	}
+	// the event_keys row of a deleted event is kept
+	err = q.QueryRow(ctx, "SELECT id FROM event_keys WHERE origin_id=$1 AND event_id=$2", em.OriginId, em.EventId).Scan(&em.Id)
+	if err != nil {
+		return em, err
+	}
+	return em, ErrEventDeleted
+}
+
+// pgLockIters locks the stream_iters rows of a batch up front, all origins
+// then all destinations, sorted, the same order as a single insert takes
+// them, so concurrent batches and inserts cannot deadlock.
+// It returns the current iters by "<stream type> <stream id>"
+func pgLockIters(ctx context.Context, tx pgx.Tx, ems []EventMessage) (map[string]int64, error) {
+	originIds := make(map[string]bool)
+	destIds := make(map[string]bool)
+	for _, em := range ems {
+		originIds[em.OriginId] = true
+		destIds[em.DestinationId] = true
+	}
+
+	iters := make(map[string]int64)
+	for _, stream := range []struct {
+		streamType string
+		ids        map[string]bool
+	}{{"origin", originIds}, {"destination", destIds}} {
+		ids := make([]string, 0, len(stream.ids))
+		for id := range stream.ids {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		// the no-op update locks the rows that already exist
+		rows, err := tx.Query(ctx,
+			"INSERT INTO stream_iters (stream_type, stream_id, iter) SELECT $1::text, unnest($2::text[]), 0 ON CONFLICT (stream_type, stream_id) DO UPDATE SET iter = stream_iters.iter RETURNING stream_id, iter",
+			stream.streamType,
+			ids,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var streamId string
+			var iter int64
+			if err := rows.Scan(&streamId, &iter); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			iters[stream.streamType+" "+streamId] = iter
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return iters, nil
+}
+
+// pgLockChains locks the heads of the chains of ems, in sorted order, a new
+// chain starts at Seq 0. The iters are locked before the chains, so the
+// inserts cannot deadlock.
+func pgLockChains(ctx context.Context, tx pgx.Tx, ems []EventMessage) (map[string]*ChainHead, error) {
+	heads := make(map[string]*ChainHead)
+	ids := chainIds(ems)
+	if len(ids) == 0 {
+		return heads, nil
+	}
+
+	// the no-op update locks the rows that already exist
+	rows, err := tx.Query(ctx,
+		"INSERT INTO event_chains (chain_id, seq, hash) SELECT unnest($1::text[]), 0, '' ON CONFLICT (chain_id) DO UPDATE SET seq = event_chains.seq RETURNING chain_id, seq, hash",
+		ids,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		head := &ChainHead{}
+		if err := rows.Scan(&head.ChainId, &head.Seq, &head.Hash); err != nil {
+			return nil, err
+		}
+		heads[head.ChainId] = head
+	}
+	return heads, rows.Err()
+}
+
+// pgSaveChains moves the chains to their heads, locked by pgLockChains
+func pgSaveChains(ctx context.Context, tx pgx.Tx, heads map[string]*ChainHead) error {
+	if len(heads) == 0 {
+		return nil
+	}
+	ids := []string{}
+	seqs := []int64{}
+	hashes := []string{}
+	for _, head := range heads {
+		ids = append(ids, head.ChainId)
+		seqs = append(seqs, head.Seq)
+		hashes = append(hashes, head.Hash)
+	}
+	_, err := tx.Exec(ctx,
+		"UPDATE event_chains AS c SET seq = v.seq, hash = v.hash FROM unnest($1::text[], $2::bigint[], $3::text[]) AS v(chain_id, seq, hash) WHERE c.chain_id = v.chain_id",
+		ids,
+		seqs,
+		hashes,
+	)
+	return err
+}
+
+// pgQuerier is the part of pgxpool.Pool and pgx.Tx used by the helpers below
+type pgQuerier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// pgFindByEventId returns pgx.ErrNoRows if the origin has no such event
+func pgFindByEventId(ctx context.Context, q pgQuerier, originId, eventId string) (EventMessage, error) {
+	// the creation time from event_keys prunes the other partitions
+	rows, err := q.Query(ctx, pgSelectEvents+" WHERE id = (SELECT id FROM event_keys WHERE origin_id=$1 AND event_id=$2) AND creation_time_unix_sec = (SELECT creation_time_unix_sec FROM event_keys WHERE origin_id=$1 AND event_id=$2)", originId, eventId)
+	if err != nil {
+		return EventMessage{}, err
+	}
+	ms, err := ParseRows(rows)
+	if err != nil {
+		return EventMessage{}, err
+	}
+	if len(ms) == 0 {
+		return EventMessage{}, pgx.ErrNoRows
+	}
+	return ms[0], nil
+}
+
+// pgNextIter increments and returns the iter of an origin or destination stream
+func pgNextIter(ctx context.Context, q pgQuerier, streamType, streamId string) (int64, error) {
+	var iter int64
+	err := q.QueryRow(ctx,
+		"INSERT INTO stream_iters (stream_type, stream_id, iter) VALUES ($1, $2, 1) ON CONFLICT (stream_type, stream_id) DO UPDATE SET iter = stream_iters.iter + 1 RETURNING iter",
+		streamType,
+		streamId,
+	).Scan(&iter)
+	return iter, err
+}
+
+// Ping
+func (ps *PostgresStore) Ping(ctx context.Context) error {
+	var postgresTest string
+	return ps.Conn.QueryRow(ctx, "select 'OK'").Scan(&postgresTest)
+}
+
+// LoadOrigins
+func (ps *PostgresStore) LoadOrigins(ctx context.Context) ([]SecureOrigin, error) {
+	origins := []SecureOrigin{}
+
+	rows, err := ps.Conn.Query(ctx,
+		"SELECT id, COALESCE(pass_hash, '') as pass_hash, COALESCE(public_key, '') as public_key FROM origins")
+	if err != nil {
+		return origins, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		origin := SecureOrigin{}
+		err := rows.Scan(
+			&origin.Id,
+			&origin.PassHash,
+			&origin.PublicKey,
+		)
+		if err != nil {
+			return origins, err
+		}
+		origins = append(origins, origin)
+	}
+
+	return origins, rows.Err()
+}
+
+// LoadSchemas
+func (ps *PostgresStore) LoadSchemas(ctx context.Context) ([]EventSchema, error) {
+	schemas := []EventSchema{}
+
+	rows, err := ps.Conn.Query(ctx,
+		"SELECT event_type, event_version, schema_json, added_time_unix_sec FROM event_schemas ORDER BY event_type, event_version")
+	if err != nil {
+		return schemas, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := EventSchema{}
+		schema := ""
+		if err := rows.Scan(&s.EventType, &s.EventVersion, &schema, &s.AddedUnixSec); err != nil {
+			return schemas, err
+		}
+		s.Schema = json.RawMessage(schema)
+		schemas = append(schemas, s)
+	}
+
+	return schemas, rows.Err()
+}
+
+// LoadSchemaModes
+func (ps *PostgresStore) LoadSchemaModes(ctx context.Context) (map[string]string, error) {
+	modes := make(map[string]string)
+
+	rows, err := ps.Conn.Query(ctx, "SELECT event_type, mode FROM event_schema_modes")
+	if err != nil {
+		return modes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		eventType, mode := "", ""
+		if err := rows.Scan(&eventType, &mode); err != nil {
+			return modes, err
+		}
+		modes[eventType] = mode
+	}
+
+	return modes, rows.Err()
+}
+
+// SaveSchema
+func (ps *PostgresStore) SaveSchema(ctx context.Context, s EventSchema) error {
+	_, err := ps.Conn.Exec(ctx,
+		"INSERT INTO event_schemas (event_type, event_version, schema_json, added_time_unix_sec) VALUES ($1, $2, $3, $4) ON CONFLICT (event_type, event_version) DO UPDATE SET schema_json = EXCLUDED.schema_json, added_time_unix_sec = EXCLUDED.added_time_unix_sec",
+		s.EventType, s.EventVersion, string(s.Schema), s.AddedUnixSec)
+	return err
+}
+
+// DeleteSchema
+func (ps *PostgresStore) DeleteSchema(ctx context.Context, eventType, eventVersion string) error {
+	tag, err := ps.Conn.Exec(ctx,
+		"DELETE FROM event_schemas WHERE event_type = $1 AND event_version = $2", eventType, eventVersion)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSchemaNotFound
+	}
+	return nil
+}
+
+// SetSchemaMode
+func (ps *PostgresStore) SetSchemaMode(ctx context.Context, eventType, mode string) error {
+	_, err := ps.Conn.Exec(ctx,
+		"INSERT INTO event_schema_modes (event_type, mode) VALUES ($1, $2) ON CONFLICT (event_type) DO UPDATE SET mode = EXCLUDED.mode",
+		eventType, mode)
+	return err
+}
+
+// EraseEvents
+func (ps *PostgresStore) EraseEvents(ctx context.Context, req ErasureRequest) (Erasure, error) {
+	if err := req.Check(); err != nil {
+		return Erasure{}, err
+	}
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return Erasure{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	originIds := []string{req.OriginId}
+	if req.OwnerEmail != "" {
+		originIds = []string{}
+		err := tx.QueryRow(ctx,
+			"SELECT COALESCE(array_agg(id ORDER BY id), '{}') FROM origins WHERE owner_email = $1", req.OwnerEmail,
+		).Scan(&originIds)
+		if err != nil {
+			return Erasure{}, err
+		}
+	}
+	erasure := req.erasure(originIds, time.Now().Unix())
+
+	if len(originIds) > 0 && len(req.Paths) > 0 {
+		sql, args := sqlOpaqueOrigins("postgres", originIds)
+		opaque := payloadPlain
+		if err := tx.QueryRow(ctx, sql, args...).Scan(&opaque); err != nil {
+			return Erasure{}, err
+		}
+		if err := opaquePayloadError(opaque); err != nil {
+			return Erasure{}, fmt.Errorf("%w, their paths cannot be redacted, erase the whole payloads", err)
+		}
+	}
+	if len(originIds) > 0 {
+		sql, args := req.sqlErase("postgres", originIds, erasure.TimeUnixSec)
+		sql = "WITH erased AS (" + sql + ") SELECT count(*), COALESCE(min(id), 0), COALESCE(max(id), 0) FROM erased"
+		if err := tx.QueryRow(ctx, sql, args...).Scan(&erasure.Events, &erasure.MinId, &erasure.MaxId); err != nil {
+			return Erasure{}, err
+		}
+	}
+
+	origins, _ := json.Marshal(erasure.OriginIds)
+	paths, _ := json.Marshal(erasure.Paths)
+	err = tx.QueryRow(ctx,
+		"INSERT INTO erasures (time_unix_sec, erased_by, reason, origin_ids, owner_email, paths, events, min_id, max_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id",
+		erasure.TimeUnixSec, erasure.By, erasure.Reason, string(origins), erasure.OwnerEmail, string(paths), erasure.Events, erasure.MinId, erasure.MaxId,
+	).Scan(&erasure.Id)
+	if err != nil {
+		return Erasure{}, err
+	}
+	return erasure, tx.Commit(ctx)
+}
+
+// Erasures
+func (ps *PostgresStore) Erasures(ctx context.Context) ([]Erasure, error) {
+	erasures := []Erasure{}
+
+	rows, err := ps.Conn.Query(ctx,
+		"SELECT id, time_unix_sec, erased_by, reason, origin_ids, owner_email, paths, events, min_id, max_id FROM erasures ORDER BY id")
+	if err != nil {
+		return erasures, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := Erasure{}
+		origins, paths := "", ""
+		if err := rows.Scan(&e.Id, &e.TimeUnixSec, &e.By, &e.Reason, &origins, &e.OwnerEmail, &paths, &e.Events, &e.MinId, &e.MaxId); err != nil {
+			return erasures, err
+		}
+		json.Unmarshal([]byte(origins), &e.OriginIds)
+		json.Unmarshal([]byte(paths), &e.Paths)
+		erasures = append(erasures, e)
+	}
+
+	return erasures, rows.Err()
+}
+
+// StalePayloads
+func (ps *PostgresStore) StalePayloads(ctx context.Context, keyId string, afterId int64, limit int) ([]EventMessage, error) {
+	return ps.query(ctx, pgSelectEvents+" WHERE id > $1 AND COALESCE(payload_key_id, '') <> $2 AND NOT (payload_data IS NULL AND payload_json = '{}') ORDER BY id ASC LIMIT $3",
+		afterId,
+		keyId,
+		limit,
+	)
+}
+
+// UpdatePayloads
+func (ps *PostgresStore) UpdatePayloads(ctx context.Context, stale, ems []EventMessage) (int64, error) {
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	updated := int64(0)
+	for i := range ems {
+		tag, err := tx.Exec(ctx,
+			"UPDATE events SET payload_json = $1, payload_data = $2, payload_key_id = NULLIF($3, ''), payload_codec = NULLIF($4, ''), payload_size = NULLIF($5, 0) WHERE id = $6 AND creation_time_unix_sec = $7 AND COALESCE(payload_key_id, '') = $8 AND COALESCE(redacted_time_unix_sec, 0) = $9",
+			string(ems[i].PayloadJson),
+			ems[i].payloadData,
+			ems[i].payloadKeyId,
+			ems[i].payloadCodec,
+			ems[i].payloadSize,
+			stale[i].Id,
+			stale[i].CreationTimeUnixSec,
+			stale[i].payloadKeyId,
+			stale[i].RedactedUnixSec,
+		)
+		if err != nil {
+			return 0, err
+		}
+		updated += tag.RowsAffected()
+	}
+	return updated, tx.Commit(ctx)
+}
+
+// PayloadStats
+// the stored bytes are those of pg_column_size, after the compression of
+// Postgresql itself
+func (ps *PostgresStore) PayloadStats(ctx context.Context) ([]PayloadStats, error) {
+	stats := []PayloadStats{}
+
+	rows, err := ps.Conn.Query(ctx,
+		`SELECT COALESCE(payload_codec, ''), payload_key_id IS NOT NULL, count(*),
+			COALESCE(sum(CASE WHEN payload_data IS NULL THEN octet_length(payload_json::text) ELSE COALESCE(payload_size, octet_length(payload_data)) END), 0),
+			COALESCE(sum(COALESCE(pg_column_size(payload_data), pg_column_size(payload_json))), 0)
+		FROM events GROUP BY 1, 2 ORDER BY 1, 2`)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := PayloadStats{}
+		if err := rows.Scan(&s.Codec, &s.Encrypted, &s.Events, &s.Bytes, &s.StoredBytes); err != nil {
+			return stats, err
+		}
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
+
+// ChainHeads
+func (ps *PostgresStore) ChainHeads(ctx context.Context) ([]ChainHead, error) {
+	heads := []ChainHead{}
+
+	rows, err := ps.Conn.Query(ctx, "SELECT chain_id, seq, hash FROM event_chains WHERE seq > 0 ORDER BY chain_id")
+	if err != nil {
+		return heads, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		head := ChainHead{}
+		if err := rows.Scan(&head.ChainId, &head.Seq, &head.Hash); err != nil {
+			return heads, err
+		}
+		heads = append(heads, head)
+	}
+
+	return heads, rows.Err()
+}
+
+// ChainEvents
+func (ps *PostgresStore) ChainEvents(ctx context.Context, chainId string, fromSeq int64, limit int) ([]EventMessage, error) {
+	return ps.query(ctx, pgSelectEvents+" WHERE chain_id = $1 AND chain_seq >= $2 ORDER BY chain_seq ASC LIMIT $3",
+		chainId,
+		fromSeq,
+		limit,
+	)
+}
+
+const pgSelectEvents = "SELECT id, event_id, COALESCE(creation_time_unix_sec, 0), COALESCE(origin_id, ''), COALESCE(origin_iter, 0), COALESCE(origin_group_id, ''), COALESCE(origin_build_version, ''), COALESCE(destination_id, ''), COALESCE(destination_iter, 0), COALESCE(event_time_unix_sec, 0), COALESCE(event_type, ''), COALESCE(event_subtype, ''), COALESCE(event_version, ''), COALESCE(payload_json, '{}'), COALESCE(redacted_time_unix_sec, 0), payload_data, COALESCE(payload_key_id, ''), COALESCE(payload_codec, ''), COALESCE(payload_size, 0), COALESCE(chain_id, ''), COALESCE(chain_seq, 0), COALESCE(chain_prev_hash, ''), COALESCE(chain_hash, ''), COALESCE(chain_data_hash, ''), COALESCE(signature, '') FROM events"
+
+// ParseRows scans rows selected with pgSelectEvents
+func ParseRows(rows pgx.Rows) ([]EventMessage, error) {
+	ms := []EventMessage{}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		m := EventMessage{}
+		payload := ""
+		chain := ChainLink{}
+		err := rows.Scan(
+			&m.Id,
+			&m.EventId,
+			&m.CreationTimeUnixSec,
+			&m.OriginId,
+			&m.OriginIter,
+			&m.OriginGroupId,
+			&m.OriginBuildVersion,
+			&m.DestinationId,
+			&m.DestinationIter,
+			&m.EventTimeUnixSec,
+			&m.EventType,
+			&m.EventSubtype,
+			&m.EventVersion,
+			&payload,
+			&m.RedactedUnixSec,
+			&m.payloadData,
+			&m.payloadKeyId,
+			&m.payloadCodec,
+			&m.payloadSize,
+			&chain.Id,
+			&chain.Seq,
+			&chain.PrevHash,
+			&chain.Hash,
+			&chain.DataHash,
+			&m.Signature,
+		)
+		if err != nil {
+			return []EventMessage{}, err
+		}
+		m.PayloadJson = json.RawMessage(payload)
+		if chain.Id != "" {
+			m.Chain = &chain
+		}
+		if err := inflatePayload(&m); err != nil {
+			return []EventMessage{}, err
+		}
+		ms = append(ms, m)
+	}
+
+	return ms, rows.Err()
+}
+
+func (ps *PostgresStore) query(ctx context.Context, sql string, args ...interface{}) ([]EventMessage, error) {
+	rows, err := ps.Conn.Query(ctx, sql, args...)
+	if err != nil {
+		return []EventMessage{}, err
+	}
+	return ParseRows(rows)
+}
+
+// QueryEvents
+func (ps *PostgresStore) QueryEvents(ctx context.Context, q EventQuery) ([]EventMessage, error) {
+	// limit the creation time to the partitions that can hold the ids,
+	// so Postgresql prunes the others
+	if from, to, ok := ps.partitions.creationTimeBounds(q.NewestId, q.LastId); ok {
+		if from > q.CreationTimeFrom {
+			q.CreationTimeFrom = from
+		}
+		if to != 0 && (q.CreationTimeTo == 0 || to < q.CreationTimeTo) {
+			q.CreationTimeTo = to
+		}
+	}
+	if len(q.Payload) > 0 {
+		if err := ps.checkOpaquePayloads(ctx, q); err != nil {
+			return []EventMessage{}, fmt.Errorf("%w, they cannot be filtered on", err)
+		}
+	}
+	where, args := q.sqlWhere("postgres")
+	return ps.query(ctx, pgSelectEvents+where, args...)
+}
+
+// checkOpaquePayloads returns an error if an event with a payload
+// Postgresql cannot look into could change the result of q, see
+// sqlOpaquePayloads
+func (ps *PostgresStore) checkOpaquePayloads(ctx context.Context, q EventQuery) error {
+	sql, args := q.sqlOpaquePayloads("postgres")
+	opaque := payloadPlain
+	if err := ps.Conn.QueryRow(ctx, sql, args...).Scan(&opaque); err != nil {
+		return err
+	}
+	return opaquePayloadError(opaque)
+}
+
+// DeleteEvents
+// the event_keys rows of the deleted events are kept, so their EventIds
+// stay taken, and latest_events moves back to the newest event that is left
+func (ps *PostgresStore) DeleteEvents(ctx context.Context, q EventQuery, except []EventQuery, limit int) (int64, error) {
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	sql, args := sqlDelete("postgres", q, except, limit)
+	sql = `WITH deleted AS (` + sql + ` RETURNING id, creation_time_unix_sec),
+	stale AS (DELETE FROM latest_events l USING deleted d WHERE l.id = d.id AND l.creation_time_unix_sec = d.creation_time_unix_sec RETURNING l.destination_id, l.event_type)
+	SELECT (SELECT count(*) FROM deleted), COALESCE(array_agg(destination_id), '{}'), COALESCE(array_agg(event_type), '{}') FROM stale`
+	var deleted int64
+	var destIds, eventTypes []string
+	if err := tx.QueryRow(ctx, sql, args...).Scan(&deleted, &destIds, &eventTypes); err != nil {
+		return 0, err
+	}
+	if err := pgRecomputeLatest(ctx, tx, destIds, eventTypes); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// AggregateEvents
+func (ps *PostgresStore) AggregateEvents(ctx context.Context, aq AggregateQuery) ([]AggregateBucket, error) {
+	if aq.payload() {
+		if err := ps.checkOpaquePayloads(ctx, aq.query()); err != nil {
+			return nil, fmt.Errorf("%w, they cannot be aggregated", err)
+		}
+	}
+	sql, args := aq.sql("postgres")
+	rows, err := ps.Conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []AggregateBucket{}
+	for rows.Next() {
+		b := AggregateBucket{}
+		if err := rows.Scan(aq.scanFields(&b)...); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// LatestEvents
+func (ps *PostgresStore) LatestEvents(ctx context.Context, destIds []string) ([]EventMessage, error) {
+	return ps.query(ctx, pgSelectEvents+" WHERE (id, creation_time_unix_sec) IN (SELECT id, creation_time_unix_sec FROM latest_events WHERE destination_id = ANY($1::text[])) ORDER BY destination_id, event_type", destIds)
+}
+
+// RestoreEvents
+// the events keep their Id, so the id sequence and the iters are moved past
+// them, and the id ranges of the partitions are refreshed
+func (ps *PostgresStore) RestoreEvents(ctx context.Context, ems []EventMessage) (int64, error) {
+	tx, err := ps.Conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// skip the Ids that are already saved
+	ids := make([]int64, len(ems))
+	for i, em := range ems {
+		ids[i] = em.Id
+	}
+	rows, err := tx.Query(ctx, "SELECT id FROM events WHERE id = ANY($1::bigint[])", ids)
+	if err != nil {
+		return 0, err
+	}
+	existing := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		existing[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// and the EventIds, the key of a deleted event has its Id
+	restore := []EventMessage{}
+	for _, em := range ems {
+		if existing[em.Id] {
+			continue
+		}
+		existing[em.Id] = true
+		tag, err := tx.Exec(ctx,
+			"INSERT INTO event_keys (origin_id, event_id, id, creation_time_unix_sec) VALUES ($1, $2, $3, $4) ON CONFLICT (origin_id, event_id) DO UPDATE SET creation_time_unix_sec = EXCLUDED.creation_time_unix_sec WHERE event_keys.id = EXCLUDED.id",
+			em.OriginId, em.EventId, em.Id, em.CreationTimeUnixSec,
+		)
+		if err != nil {
+			return 0, err
+		}
+		if tag.RowsAffected() == 1 {
+			restore = append(restore, em)
+		}
+	}
+	if len(restore) == 0 {
+		return 0, nil
+	}
+
+	// new events continue after the restored ones, the iters are
+	// locked first and in sorted order like pgLockIters does
+	maxId := int64(0)
+	iters := make(map[string]int64)
+	for _, em := range restore {
+		if em.Id > maxId {
+			maxId = em.Id
+		}
+		if em.OriginIter > iters["origin "+em.OriginId] {
+			iters["origin "+em.OriginId] = em.OriginIter
+		}
+		if em.DestinationIter > iters["destination "+em.DestinationId] {
+			iters["destination "+em.DestinationId] = em.DestinationIter
+		}
+	}
+	keys := make([]string, 0, len(iters))
+	for key := range iters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		// the origins first
+		if strings.HasPrefix(keys[i], "origin ") != strings.HasPrefix(keys[j], "origin ") {
+			return strings.HasPrefix(keys[i], "origin ")
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		parts := strings.SplitN(key, " ", 2)
+		_, err := tx.Exec(ctx,
+			"INSERT INTO stream_iters (stream_type, stream_id, iter) VALUES ($1, $2, $3) ON CONFLICT (stream_type, stream_id) DO UPDATE SET iter = GREATEST(stream_iters.iter, EXCLUDED.iter)",
+			parts[0], parts[1], iters[key],
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := pgInsertRows(ctx, tx, restore); err != nil {
+		return 0, err
+	}
+
+	// and the chains, in sorted order like pgLockChains does
+	heads := restoredHeads(restore)
+	for _, chainId := range chainIds(restore) {
+		_, err := tx.Exec(ctx,
+			"INSERT INTO event_chains (chain_id, seq, hash) VALUES ($1, $2, $3) ON CONFLICT (chain_id) DO UPDATE SET seq = EXCLUDED.seq, hash = EXCLUDED.hash WHERE event_chains.seq < EXCLUDED.seq",
+			chainId, heads[chainId].Seq, heads[chainId].Hash,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, "SELECT setval('events_id_seq', $1::bigint) WHERE $1::bigint >= (SELECT last_value FROM events_id_seq)", maxId)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	// the restored ids can be outside the cached ranges
+	ps.partitions.RLock()
+	loaded := ps.partitions.loaded
+	ps.partitions.RUnlock()
+	if loaded {
+		if err := ps.refreshPartitions(ctx); err != nil {
+			return int64(len(restore)), err
+		}
+	}
+	return int64(len(restore)), nil
+}
+
+// GetByEventId
+func (ps *PostgresStore) GetByEventId(ctx context.Context, originId, eventId string) (EventMessage, error) {
+	em, err := pgFindByEventId(ctx, ps.Conn, originId, eventId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return em, ErrEventNotFound
+	}
+	return em, err
+}
+
+// GetByOriginIdSinceIter
+func (ps *PostgresStore) GetByOriginIdSinceIter(ctx context.Context, originId string, sinceIter int64, limit int) ([]EventMessage, error) {
+	return ps.query(ctx, pgSelectEvents+" WHERE origin_id=$1 AND origin_iter > $2 ORDER BY origin_iter ASC LIMIT $3",
+		originId,
+		sinceIter,
+		limit,
+	)
+}
+
+// GetByDestinationIdSinceIter
+func (ps *PostgresStore) GetByDestinationIdSinceIter(ctx context.Context, destId string, sinceIter int64, limit int) ([]EventMessage, error) {
+	return ps.query(ctx, pgSelectEvents+" WHERE destination_id=$1 AND destination_iter > $2 ORDER BY destination_iter ASC LIMIT $3",
+		destId,
+		sinceIter,
+		limit,
+	)
+}
@@ -0,0 +1,264 @@
+package eventstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// EventQuery selects events on any combination of fields,
+// an empty field (or 0 for the times) does not filter.
+// The events are returned from new to old (id DESC).
+type EventQuery struct {
+	OriginId           string
+	DestinationId      string
+	OriginGroupId      string
+	EventType          string
+	EventSubtype       string
+	EventVersion       string
+	OriginBuildVersion string
+
+	// time ranges in unix seconds, From is inclusive and To is exclusive
+	EventTimeFrom    int64
+	EventTimeTo      int64
+	CreationTimeFrom int64
+	CreationTimeTo   int64
+
+	// filters on the JSON payload, all of them have to match
+	Payload []PayloadFilter
+
+	// pagination, only events with NewestId < Id < LastId are returned,
+	// use 0 (or -1) for NewestId to start from zero and 0 for LastId for
+	// the first page, a Limit of 0 returns all events
+	NewestId int64
+	LastId   int64
+	Limit    int
+}
+
+// Match reports if em passes the filters of the query, the pagination
+// (NewestId, LastId, Limit) is not checked
+func (q *EventQuery) Match(em *EventMessage) bool {
+	switch {
+	case q.OriginId != "" && em.OriginId != q.OriginId:
+		return false
+	case q.DestinationId != "" && em.DestinationId != q.DestinationId:
+		return false
+	case q.OriginGroupId != "" && em.OriginGroupId != q.OriginGroupId:
+		return false
+	case q.EventType != "" && em.EventType != q.EventType:
+		return false
+	case q.EventSubtype != "" && em.EventSubtype != q.EventSubtype:
+		return false
+	case q.EventVersion != "" && em.EventVersion != q.EventVersion:
+		return false
+	case q.OriginBuildVersion != "" && em.OriginBuildVersion != q.OriginBuildVersion:
+		return false
+	case q.EventTimeFrom != 0 && em.EventTimeUnixSec < q.EventTimeFrom:
+		return false
+	case q.EventTimeTo != 0 && em.EventTimeUnixSec >= q.EventTimeTo:
+		return false
+	case q.CreationTimeFrom != 0 && em.CreationTimeUnixSec < q.CreationTimeFrom:
+		return false
+	case q.CreationTimeTo != 0 && em.CreationTimeUnixSec >= q.CreationTimeTo:
+		return false
+	}
+
+	if len(q.Payload) == 0 {
+		return true
+	}
+	payload, err := decodePayload(em.PayloadJson)
+	if err != nil {
+		return false
+	}
+	for i := range q.Payload {
+		if !q.Payload[i].matchValue(payload) {
+			return false
+		}
+	}
+	return true
+}
+
+// sqlArgs collects the parameters of a query, in the SQL dialect of the
+// store: postgres or sqlite
+type sqlArgs struct {
+	dialect string
+	args    []interface{}
+
+	// the payload filters also pass the events of which the database cannot
+	// look into the payload, see sqlOpaquePayloads
+	opaque bool
+}
+
+// add adds a parameter and returns its placeholder, $1 for Postgresql
+// and ? for SQLite where the parameters are positional
+func (a *sqlArgs) add(value interface{}) string {
+	a.args = append(a.args, value)
+	if a.dialect == "postgres" {
+		return fmt.Sprint("$", len(a.args))
+	}
+	return "?"
+}
+
+// sqlConditions translates the filters and the NewestId and LastId of the
+// query into conditions on the events table, to be joined with AND
+func (q *EventQuery) sqlConditions(a *sqlArgs) []string {
+	conditions := []string{}
+	add := func(condition string, value interface{}) {
+		conditions = append(conditions, condition+a.add(value))
+	}
+
+	if q.OriginId != "" {
+		add("origin_id=", q.OriginId)
+	}
+	if q.DestinationId != "" {
+		add("destination_id=", q.DestinationId)
+	}
+	if q.OriginGroupId != "" {
+		add("origin_group_id=", q.OriginGroupId)
+	}
+	if q.EventType != "" {
+		add("event_type=", q.EventType)
+	}
+	if q.EventSubtype != "" {
+		add("event_subtype=", q.EventSubtype)
+	}
+	if q.EventVersion != "" {
+		add("event_version=", q.EventVersion)
+	}
+	if q.OriginBuildVersion != "" {
+		add("origin_build_version=", q.OriginBuildVersion)
+	}
+	if q.EventTimeFrom != 0 {
+		add("event_time_unix_sec >= ", q.EventTimeFrom)
+	}
+	if q.EventTimeTo != 0 {
+		add("event_time_unix_sec < ", q.EventTimeTo)
+	}
+	if q.CreationTimeFrom != 0 {
+		add("creation_time_unix_sec >= ", q.CreationTimeFrom)
+	}
+	if q.CreationTimeTo != 0 {
+		add("creation_time_unix_sec < ", q.CreationTimeTo)
+	}
+	payload := []string{}
+	for i := range q.Payload {
+		if a.dialect == "postgres" {
+			payload = append(payload, "("+q.Payload[i].pgSQL(a.add)+")")
+		} else {
+			// SQLite calls PayloadFilter.Match, see sqlite.go
+			filter, _ := json.Marshal(&q.Payload[i])
+			payload = append(payload, "kex_payload_match(payload_json, "+a.add(string(filter))+")")
+		}
+	}
+	if len(payload) > 0 && a.opaque {
+		conditions = append(conditions, "("+sqlOpaquePayload+" OR ("+strings.Join(payload, " AND ")+"))")
+	} else {
+		conditions = append(conditions, payload...)
+	}
+	if q.NewestId > 0 {
+		add("id > ", q.NewestId)
+	}
+	if q.LastId > 0 {
+		add("id < ", q.LastId)
+	}
+	return conditions
+}
+
+// sqlWhere builds the WHERE, ORDER BY and LIMIT of the query for the
+// events table, in the SQL dialect of the store: postgres or sqlite
+func (q *EventQuery) sqlWhere(dialect string) (string, []interface{}) {
+	a := &sqlArgs{dialect: dialect}
+	conditions := q.sqlConditions(a)
+
+	sql := ""
+	if len(conditions) > 0 {
+		sql = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		sql += " LIMIT " + a.add(q.Limit)
+	}
+	return sql, a.args
+}
+
+// the payloads the database cannot look into, by how they are stored
+const (
+	payloadPlain = iota
+	payloadCompressed
+	payloadEncrypted
+)
+
+// sqlOpaquePayload is the condition of the events of which the database
+// cannot look into the payload
+const sqlOpaquePayload = "(payload_key_id IS NOT NULL OR payload_codec IS NOT NULL)"
+
+// sqlOpaqueLevel is the payloadPlain, payloadCompressed or payloadEncrypted
+// of an event
+const sqlOpaqueLevel = "CASE WHEN payload_key_id IS NOT NULL THEN 2 WHEN payload_codec IS NOT NULL THEN 1 ELSE 0 END"
+
+// sqlOpaquePayloads builds the query of the highest sqlOpaqueLevel of the
+// events that could change the result of q, the page of q when the payload
+// filters also pass the events with a payload the database cannot look into
+func (q *EventQuery) sqlOpaquePayloads(dialect string) (string, []interface{}) {
+	a := &sqlArgs{dialect: dialect, opaque: true}
+	conditions := q.sqlConditions(a)
+
+	sql := "SELECT " + sqlOpaqueLevel + " AS opaque FROM events"
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		sql += " LIMIT " + a.add(q.Limit)
+	}
+	return "SELECT COALESCE(max(opaque), 0) FROM (" + sql + ") AS page", a.args
+}
+
+// opaquePayloadError is the error of a query on the payloads, when opaque,
+// the highest level of the events that could change its result, is not
+// payloadPlain
+func opaquePayloadError(opaque int) error {
+	switch opaque {
+	case payloadEncrypted:
+		return ErrPayloadEncrypted
+	case payloadCompressed:
+		return ErrPayloadCompressed
+	}
+	return nil
+}
+
+// payloadOpaqueLevel is the level of em like sqlOpaqueLevel
+func payloadOpaqueLevel(em *EventMessage) int {
+	if em.payloadKeyId != "" {
+		return payloadEncrypted
+	}
+	if em.payloadCodec != "" {
+		return payloadCompressed
+	}
+	return payloadPlain
+}
+
+// sqlDelete builds the DELETE of at most limit events that match q and none
+// of except, oldest first
+func sqlDelete(dialect string, q EventQuery, except []EventQuery, limit int) (string, []interface{}) {
+	a := &sqlArgs{dialect: dialect}
+	conditions := q.sqlConditions(a)
+	for i := range except {
+		exceptConditions := except[i].sqlConditions(a)
+		if len(exceptConditions) == 0 {
+			// matches every event
+			conditions = append(conditions, "FALSE")
+			continue
+		}
+		// a NULL column does not match, like an empty field in Match
+		conditions = append(conditions, "COALESCE(NOT ("+strings.Join(exceptConditions, " AND ")+"), TRUE)")
+	}
+
+	// with the creation time Postgresql finds the partition of every row
+	sql := "SELECT id, creation_time_unix_sec FROM events"
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += " ORDER BY id ASC LIMIT " + a.add(limit)
+	return "DELETE FROM events WHERE (id, creation_time_unix_sec) IN (" + sql + ")", a.args
+}
@@ -0,0 +1,157 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestQueryEvents(t *testing.T) {
+	events := []struct {
+		eventId, originId, destId string
+		eventType, subtype, group string
+		eventTime                 int64
+		payload                   string
+	}{
+		{"e1", "o1", "", "status", "a", "g1", 100, `{"level":10,"name":"alpha","tags":["x","y"],"pos":{"x":1.5}}`},
+		{"e2", "o1", "", "status", "b", "", 200, `{"level":2,"name":"beta","pos":{"x":-3}}`},
+		{"e3", "o2", "", "alarm", "", "", 300, `{"level":10.0,"name":"gamma","ok":true}`},
+		{"e4", "o2", "d1", "status", "", "", 400, `{"level":"10","tags":[]}`},
+		{"e5", "o1", "", "alarm", "", "", 500, `{"name":null}`},
+	}
+
+	type queryTest struct {
+		name    string
+		q       EventQuery
+		payload []string // filters in their text form, see ParsePayloadFilter
+		want    string   // the EventIds, new to old
+	}
+	tests := []queryTest{
+		{"all", EventQuery{}, nil, "e5 e4 e3 e2 e1"},
+		{"origin", EventQuery{OriginId: "o1"}, nil, "e5 e2 e1"},
+		{"destination", EventQuery{DestinationId: "d1"}, nil, "e4"},
+		{"type", EventQuery{EventType: "status"}, nil, "e4 e2 e1"},
+		{"subtype", EventQuery{EventSubtype: "a"}, nil, "e1"},
+		{"group", EventQuery{OriginGroupId: "g1"}, nil, "e1"},
+		{"event time", EventQuery{EventTimeFrom: 200, EventTimeTo: 400}, nil, "e3 e2"},
+		{"equal number", EventQuery{}, []string{"level=10"}, "e3 e1"},
+		{"equal string", EventQuery{}, []string{`level="10"`}, "e4"},
+		{"unquoted string", EventQuery{}, []string{"name=alpha"}, "e1"},
+		{"greater number", EventQuery{}, []string{"level>5"}, "e3 e1"},
+		{"less or equal number", EventQuery{}, []string{"level<=2"}, "e2"},
+		{"less string", EventQuery{}, []string{`name<"c"`}, "e2 e1"},
+		{"exists", EventQuery{}, []string{"name exists"}, "e5 e3 e2 e1"},
+		{"null", EventQuery{}, []string{"name=null"}, "e5"},
+		{"not equal needs the path", EventQuery{}, []string{"name!=alpha"}, "e5 e3 e2"},
+		{"in", EventQuery{}, []string{`name in ["alpha","gamma"]`}, "e3 e1"},
+		{"array index", EventQuery{}, []string{"tags.0=x"}, "e1"},
+		{"negative array index", EventQuery{}, []string{"tags.-1=y"}, "e1"},
+		{"empty array", EventQuery{}, []string{"tags=[]"}, "e4"},
+		{"nested", EventQuery{}, []string{"pos.x<0"}, "e2"},
+		{"bool", EventQuery{}, []string{"ok=true"}, "e3"},
+		{"object", EventQuery{}, []string{`pos={"x":-3.0}`}, "e2"},
+		{"filters and fields", EventQuery{EventType: "status"}, []string{"level>=2", "name exists"}, "e2 e1"},
+		{"limit", EventQuery{Limit: 2}, nil, "e5 e4"},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ids := map[string]int64{}
+			all := []EventMessage{}
+			for _, e := range events {
+				em := testEvent(e.originId, e.eventId, e.payload)
+				em.DestinationId = e.destId
+				em.EventType, em.EventSubtype, em.OriginGroupId = e.eventType, e.subtype, e.group
+				em.EventTimeUnixSec = e.eventTime
+				saved, err := (&EventStream{Store: store}).SaveMessage(ctx, em)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[e.eventId] = saved.Id
+				all = append([]EventMessage{saved}, all...)
+			}
+
+			// the pages of a query, by the Ids of the events
+			pages := append(tests[:len(tests):len(tests)],
+				queryTest{"next page", EventQuery{LastId: ids["e4"], Limit: 2}, nil, "e3 e2"},
+				queryTest{"newer than", EventQuery{NewestId: ids["e3"]}, nil, "e5 e4"},
+			)
+
+			for _, tt := range pages {
+				q := tt.q
+				for _, s := range tt.payload {
+					f, err := ParsePayloadFilter(s)
+					if err != nil {
+						t.Fatal(err)
+					}
+					q.Payload = append(q.Payload, f)
+				}
+				got, err := store.QueryEvents(ctx, q)
+				if err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				if eventIds(got) != tt.want {
+					t.Errorf("%s: got %s, want %s", tt.name, eventIds(got), tt.want)
+				}
+
+				// the store filters like EventQuery.Match does in Go
+				if q.NewestId != 0 || q.LastId != 0 || q.Limit != 0 {
+					continue
+				}
+				matched := []EventMessage{}
+				for i := range all {
+					if q.Match(&all[i]) {
+						matched = append(matched, all[i])
+					}
+				}
+				if eventIds(matched) != eventIds(got) {
+					t.Errorf("%s: Match gives %s, the store %s", tt.name, eventIds(matched), eventIds(got))
+				}
+			}
+		})
+	}
+}
+
+// eventIds joins the EventIds of ems
+func eventIds(ems []EventMessage) string {
+	ids := make([]string, len(ems))
+	for i := range ems {
+		ids[i] = ems[i].EventId
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestParsePayloadFilter(t *testing.T) {
+	tests := []struct {
+		s    string
+		want PayloadFilter
+		err  bool
+	}{
+		{"level>=5", PayloadFilter{Path: []string{"level"}, Op: ">=", Value: json.RawMessage("5")}, false},
+		{"pos.x != -1", PayloadFilter{Path: []string{"pos", "x"}, Op: "!=", Value: json.RawMessage("-1")}, false},
+		{"name=alpha", PayloadFilter{Path: []string{"name"}, Op: "=", Value: json.RawMessage(`"alpha"`)}, false},
+		{"note=a=b", PayloadFilter{Path: []string{"note"}, Op: "=", Value: json.RawMessage(`"a=b"`)}, false},
+		{"tags exists", PayloadFilter{Path: []string{"tags"}, Op: "exists"}, false},
+		{`name in ["a", "b"]`, PayloadFilter{Path: []string{"name"}, Op: "in", Value: json.RawMessage(`["a", "b"]`)}, false},
+		{"name in a", PayloadFilter{}, true},
+		{"level>true", PayloadFilter{}, true},
+		{"=5", PayloadFilter{}, true},
+		{"pos..x=1", PayloadFilter{}, true},
+		{"level", PayloadFilter{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePayloadFilter(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("ParsePayloadFilter(%q) error %v, want error %v", tt.s, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if strings.Join(got.Path, ".") != strings.Join(tt.want.Path, ".") || got.Op != tt.want.Op || string(got.Value) != string(tt.want.Value) {
+			t.Errorf("ParsePayloadFilter(%q) = %v %s %s, want %v %s %s", tt.s, got.Path, got.Op, got.Value, tt.want.Path, tt.want.Op, tt.want.Value)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package eventstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RetentionRule sets how long the events it matches are kept.
+// An empty field matches everything, so a rule without fields is a default.
+type RetentionRule struct {
+	EventType     string
+	OriginGroupId string
+	OriginId      string
+	Days          int // 0 keeps the events forever
+}
+
+// Retention deletes the events that are older than their RetentionRule.
+// The rules are checked in order and the first rule that matches an event
+// decides, events that match no rule are kept forever.
+type Retention struct {
+	sync.Mutex
+
+	Store     EventStore
+	Rules     []RetentionRule
+	Interval  time.Duration // time between two prune runs
+	BatchSize int           // events deleted per statement, so the table is never locked for long
+
+	// (optional) deadline of every delete statement, 0 waits for the store
+	QueryTimeout time.Duration
+
+	LastReport RetentionReport
+}
+
+// RetentionReport is what a prune run removed
+type RetentionReport struct {
+	StartUnixSec int64
+	DurationMs   int64
+	Removed      []int64 // per rule, in the order of Rules
+	Total        int64
+	Error        string
+}
+
+// CheckRules validates the rules, before the pruner is started
+func (r *Retention) CheckRules() error {
+	for i, rule := range r.Rules {
+		if rule.Days < 0 {
+			return fmt.Errorf("retention rule %d has negative days", i+1)
+		}
+	}
+	if r.BatchSize <= 0 {
+		return errors.New("retention batch size must be more than 0")
+	}
+	return nil
+}
+
+// MaxAgeDays returns the age after which every event is expired, so whole
+// partitions can be dropped, 0 if some events are kept forever
+func (r *Retention) MaxAgeDays() int {
+	maxDays := 0
+	for _, rule := range r.Rules {
+		if rule.Days == 0 {
+			return 0
+		}
+		if rule.Days > maxDays {
+			maxDays = rule.Days
+		}
+		if rule.EventType == "" && rule.OriginGroupId == "" && rule.OriginId == "" {
+			return maxDays
+		}
+	}
+	// the events that match no rule are kept forever
+	return 0
+}
+
+// PruneChron prunes the events every Interval
+func (r *Retention) PruneChron() {
+	for {
+		r.Prune(context.Background())
+		time.Sleep(r.Interval)
+	}
+}
+
+// Prune deletes the expired events of every rule in batches of BatchSize,
+// until ctx ends
+func (r *Retention) Prune(ctx context.Context) RetentionReport {
+	start := time.Now()
+	report := RetentionReport{
+		StartUnixSec: start.Unix(),
+		Removed:      make([]int64, len(r.Rules)),
+	}
+
+	// the events of the earlier rules are decided by those rules
+	earlier := []EventQuery{}
+	for i, rule := range r.Rules {
+		q := EventQuery{
+			EventType:     rule.EventType,
+			OriginGroupId: rule.OriginGroupId,
+			OriginId:      rule.OriginId,
+		}
+		if rule.Days > 0 {
+			q.CreationTimeTo = start.Add(-time.Duration(rule.Days) * 24 * time.Hour).Unix()
+			err := r.pruneRule(ctx, q, earlier, &report.Removed[i])
+			if err != nil {
+				report.Error = fmt.Sprint("retention rule ", i+1, ": ", err)
+				fmt.Println("ERROR! pruning events failed,", report.Error)
+				break
+			}
+			if report.Removed[i] > 0 {
+				fmt.Printf("pruned %d events older than %d days of retention rule %d %+v\n", report.Removed[i], rule.Days, i+1, rule)
+			}
+		}
+		report.Total += report.Removed[i]
+
+		q.CreationTimeTo = 0
+		earlier = append(earlier, q)
+	}
+
+	report.DurationMs = time.Since(start).Milliseconds()
+	fmt.Println("pruned", report.Total, "expired events in", time.Since(start))
+
+	r.Lock()
+	r.LastReport = report
+	r.Unlock()
+	return report
+}
+
+// pruneRule deletes batches until there is nothing left to delete
+func (r *Retention) pruneRule(ctx context.Context, q EventQuery, earlier []EventQuery, removed *int64) error {
+	for {
+		deleteCtx, cancel := r.queryContext(ctx)
+		deleted, err := r.Store.DeleteEvents(deleteCtx, q, earlier, r.BatchSize)
+		err = ctxErr(deleteCtx, err)
+		cancel()
+		*removed += deleted
+		if err != nil {
+			return err
+		}
+		if deleted < int64(r.BatchSize) {
+			return nil
+		}
+	}
+}
+
+// queryContext limits ctx to the QueryTimeout
+func (r *Retention) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.QueryTimeout > 0 {
+		return context.WithTimeout(ctx, r.QueryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Report returns the report of the last prune run
+func (r *Retention) Report() RetentionReport {
+	r.Lock()
+	defer r.Unlock()
+	return r.LastReport
+}
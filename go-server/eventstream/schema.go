@@ -0,0 +1,293 @@
+package eventstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// the event_schemas and event_schema_modes tables are created by the
+// migrations, see migrate.go
+
+// the schema modes of an EventType
+const (
+	SchemaEnforce = "enforce" // an event that does not match is rejected
+	SchemaWarn    = "warn"    // an event that does not match is logged and saved
+	SchemaOff     = "off"     // the events are not checked
+)
+
+// ErrSchemaNotFound is returned when deleting a schema that is not registered
+var ErrSchemaNotFound = errors.New("schema not found")
+
+// EventSchema is the JSON Schema of the payloads of an EventType and EventVersion
+type EventSchema struct {
+	EventType    string
+	EventVersion string
+	Schema       json.RawMessage
+	AddedUnixSec int64
+}
+
+// SchemaStore keeps the registered schemas and the schema modes per EventType
+type SchemaStore interface {
+	LoadSchemas(ctx context.Context) ([]EventSchema, error)
+	LoadSchemaModes(ctx context.Context) (map[string]string, error)
+
+	// SaveSchema adds a schema, or replaces the schema of its type and version
+	SaveSchema(ctx context.Context, s EventSchema) error
+	// DeleteSchema returns ErrSchemaNotFound if there is no such schema
+	DeleteSchema(ctx context.Context, eventType, eventVersion string) error
+	SetSchemaMode(ctx context.Context, eventType, mode string) error
+}
+
+// SchemaError is the error of a payload that does not match its schema
+type SchemaError struct {
+	EventType    string
+	EventVersion string
+	Violations   []SchemaViolation
+}
+
+// SchemaViolation is one part of the payload that does not match
+type SchemaViolation struct {
+	Path    string // JSON Pointer into the payload, "" is the root
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	msg := fmt.Sprintf("%v: PayloadJson does not match the schema of %s version %s", ErrInvalidEvent, e.EventType, e.EventVersion)
+	if len(e.Violations) > 0 {
+		msg += fmt.Sprintf(", at '%s': %s", e.Violations[0].Path, e.Violations[0].Message)
+	}
+	return msg
+}
+
+// Unwrap makes errors.Is(err, ErrInvalidEvent) true
+func (e *SchemaError) Unwrap() error {
+	return ErrInvalidEvent
+}
+
+type schemaKey struct {
+	eventType    string
+	eventVersion string
+}
+
+// SchemaRegistry validates the payloads of the events against the JSON
+// Schema of their EventType and EventVersion.
+// Events of a type and version without a schema are not checked.
+type SchemaRegistry struct {
+	sync.RWMutex
+
+	Store         SchemaStore
+	DefaultMode   string // of the event types without a mode, SchemaEnforce if empty
+	LastRefreshed int64
+
+	// (optional) deadline of the reloads of ReloadChron, 0 waits for the store
+	QueryTimeout time.Duration
+
+	schemas  map[schemaKey]*jsonschema.Schema
+	modes    map[string]string
+	registry []EventSchema
+}
+
+// CompileSchema compiles a JSON Schema, references to other documents are
+// not loaded, so a schema cannot read files or urls
+func CompileSchema(schema json.RawMessage) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("cannot load %s, a schema has to be self contained", url)
+	}
+	if err := compiler.AddResource("kex:///schema.json", bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("kex:///schema.json")
+}
+
+// Reload loads the schemas and modes from the store
+func (sr *SchemaRegistry) Reload(ctx context.Context) error {
+	loaded, err := sr.Store.LoadSchemas(ctx)
+	if err != nil {
+		return err
+	}
+	modes, err := sr.Store.LoadSchemaModes(ctx)
+	if err != nil {
+		return err
+	}
+
+	schemas := make(map[schemaKey]*jsonschema.Schema)
+	for _, s := range loaded {
+		compiled, err := CompileSchema(s.Schema)
+		if err != nil {
+			// checked when it was added, so the events are not blocked on it
+			fmt.Println("ERROR! cannot compile the schema of", s.EventType, "version", s.EventVersion, err)
+			continue
+		}
+		schemas[schemaKey{s.EventType, s.EventVersion}] = compiled
+	}
+
+	sr.Lock()
+	sr.schemas = schemas
+	sr.modes = modes
+	sr.registry = loaded
+	sr.LastRefreshed = time.Now().Unix()
+	sr.Unlock()
+	return nil
+}
+
+// ReloadChron reloads the schemas every minute, for the changes made
+// through the other servers
+func (sr *SchemaRegistry) ReloadChron() {
+	for {
+		time.Sleep(60 * time.Second)
+		ctx, cancel := sr.queryContext(context.Background())
+		err := sr.Reload(ctx)
+		cancel()
+		if err != nil {
+			fmt.Println("ERROR! could not reload the event schemas", err)
+		}
+	}
+}
+
+// queryContext limits ctx to the QueryTimeout
+func (sr *SchemaRegistry) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sr.QueryTimeout > 0 {
+		return context.WithTimeout(ctx, sr.QueryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Mode returns the schema mode of an EventType
+func (sr *SchemaRegistry) Mode(eventType string) string {
+	sr.RLock()
+	defer sr.RUnlock()
+	return sr.modeLocked(eventType)
+}
+
+func (sr *SchemaRegistry) modeLocked(eventType string) string {
+	if mode, ok := sr.modes[eventType]; ok {
+		return mode
+	}
+	if sr.DefaultMode != "" {
+		return sr.DefaultMode
+	}
+	return SchemaEnforce
+}
+
+// Validate checks the payload of em against its schema, it returns a
+// *SchemaError if it does not match and the mode of its type is enforce
+func (sr *SchemaRegistry) Validate(em EventMessage) error {
+	sr.RLock()
+	schema := sr.schemas[schemaKey{em.EventType, em.EventVersion}]
+	mode := sr.modeLocked(em.EventType)
+	sr.RUnlock()
+	if schema == nil || mode == SchemaOff {
+		return nil
+	}
+
+	payload, err := decodePayload(em.PayloadJson)
+	if err != nil {
+		return fmt.Errorf("%w: PayloadJson is not valid JSON", ErrInvalidEvent)
+	}
+	err = schema.Validate(payload)
+	if err == nil {
+		return nil
+	}
+	validationError := &jsonschema.ValidationError{}
+	if !errors.As(err, &validationError) {
+		return err
+	}
+
+	schemaError := &SchemaError{EventType: em.EventType, EventVersion: em.EventVersion}
+	schemaError.Violations = schemaViolations(validationError, schemaError.Violations)
+	if mode == SchemaWarn {
+		fmt.Println("WARNING! event", em.EventId, "of", em.OriginId, "is saved,", schemaError)
+		return nil
+	}
+	return schemaError
+}
+
+// schemaViolations collects the causes of a validation error, the leaves
+// of the tree say what is wrong
+func schemaViolations(ve *jsonschema.ValidationError, violations []SchemaViolation) []SchemaViolation {
+	if len(ve.Causes) == 0 {
+		return append(violations, SchemaViolation{Path: ve.InstanceLocation, Message: ve.Message})
+	}
+	for _, cause := range ve.Causes {
+		violations = schemaViolations(cause, violations)
+	}
+	return violations
+}
+
+// Schemas returns the registered schemas and the modes per EventType
+func (sr *SchemaRegistry) Schemas() ([]EventSchema, map[string]string) {
+	sr.RLock()
+	defer sr.RUnlock()
+
+	schemas := make([]EventSchema, len(sr.registry))
+	copy(schemas, sr.registry)
+	modes := make(map[string]string)
+	for eventType, mode := range sr.modes {
+		modes[eventType] = mode
+	}
+	return schemas, modes
+}
+
+// AddSchema checks and saves a schema, the events are checked against it
+// right away
+func (sr *SchemaRegistry) AddSchema(ctx context.Context, s EventSchema) error {
+	if s.EventType == "" || s.EventVersion == "" {
+		return errors.New("EventType or EventVersion not set")
+	}
+	if _, err := CompileSchema(s.Schema); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	compact := bytes.Buffer{}
+	if err := json.Compact(&compact, s.Schema); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	s.Schema = compact.Bytes()
+	s.AddedUnixSec = time.Now().Unix()
+
+	if err := sr.Store.SaveSchema(ctx, s); err != nil {
+		return err
+	}
+	return sr.Reload(ctx)
+}
+
+// DeleteSchema removes a schema, the events of its type and version are
+// no longer checked
+func (sr *SchemaRegistry) DeleteSchema(ctx context.Context, eventType, eventVersion string) error {
+	if err := sr.Store.DeleteSchema(ctx, eventType, eventVersion); err != nil {
+		return err
+	}
+	return sr.Reload(ctx)
+}
+
+// SetMode switches the schema mode of an EventType
+func (sr *SchemaRegistry) SetMode(ctx context.Context, eventType, mode string) error {
+	if eventType == "" {
+		return errors.New("EventType not set")
+	}
+	if err := CheckSchemaMode(mode); err != nil {
+		return err
+	}
+	if err := sr.Store.SetSchemaMode(ctx, eventType, mode); err != nil {
+		return err
+	}
+	return sr.Reload(ctx)
+}
+
+// CheckSchemaMode returns an error if mode is not one of the schema modes
+func CheckSchemaMode(mode string) error {
+	switch mode {
+	case SchemaEnforce, SchemaWarn, SchemaOff:
+		return nil
+	}
+	return fmt.Errorf("unknown schema mode %q, use %s", mode, strings.Join([]string{SchemaEnforce, SchemaWarn, SchemaOff}, ", "))
+}
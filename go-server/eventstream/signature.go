@@ -0,0 +1,137 @@
+package eventstream
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// signed events
+//
+// An origin with an Ed25519 public key in the origins table (public_key,
+// base64) has to sign its events: the Signature of an event is the base64
+// Ed25519 signature of its SignedBytes, sent with the event. The events of
+// that origin without a valid Signature are refused, so the password of an
+// origin alone is no longer enough to post as it. The Signature is stored
+// with the event, and returned with it, so the consumers can verify the
+// author with VerifySignature and the public key of the origin.
+//
+// The SignedBytes are the fields the origin sets, as an object with the keys
+// in sorted order, without spaces and with the numbers written like
+// JavaScript does (RFC 8785), the integers beyond 2^53 exact, the same
+// canonical JSON as the hash chains:
+//
+//	{"DestinationId":"robot-1","EventId":"e1","EventSubtype":"","EventTimeUnixSec":1700000000,"EventType":"status","EventVersion":"1","OriginBuildVersion":"1.0","OriginGroupId":"","OriginId":"robot-1","PayloadJson":{"level":10}}
+//
+// Without destId the DestinationId is the OriginId. The signature of an
+// origin without public key is not stored, as it cannot be checked. An
+// erasure changes the signed fields, an erased event cannot be verified.
+
+// ErrInvalidSignature is returned for an event of an origin with a public
+// key, without a valid Signature
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// PublicKeys gives the public keys of the origins, see Secure
+type PublicKeys interface {
+	// PublicKey returns the base64 Ed25519 public key of an origin, "" if
+	// its events are not signed
+	PublicKey(originId string) string
+}
+
+// SignedBytes are the bytes of em that the origin signs
+func SignedBytes(em EventMessage) ([]byte, error) {
+	payload, err := normalizePayload(em.PayloadJson)
+	if err != nil {
+		return nil, fmt.Errorf("PayloadJson %v", err)
+	}
+	decoded, err := canonicalPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	destinationId := em.DestinationId
+	if destinationId == "" {
+		destinationId = em.OriginId
+	}
+	// the fields are in sorted order
+	return canonicalJSON(struct {
+		DestinationId      string
+		EventId            string
+		EventSubtype       string
+		EventTimeUnixSec   int64
+		EventType          string
+		EventVersion       string
+		OriginBuildVersion string
+		OriginGroupId      string
+		OriginId           string
+		PayloadJson        interface{}
+	}{
+		DestinationId:      destinationId,
+		EventId:            em.EventId,
+		EventSubtype:       em.EventSubtype,
+		EventTimeUnixSec:   em.EventTimeUnixSec,
+		EventType:          em.EventType,
+		EventVersion:       em.EventVersion,
+		OriginBuildVersion: em.OriginBuildVersion,
+		OriginGroupId:      em.OriginGroupId,
+		OriginId:           em.OriginId,
+		PayloadJson:        decoded,
+	})
+}
+
+// SignEvent sets the Signature of em with the private key of its origin
+func SignEvent(em EventMessage, privateKey ed25519.PrivateKey) (EventMessage, error) {
+	signed, err := SignedBytes(em)
+	if err != nil {
+		return em, err
+	}
+	em.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, signed))
+	return em, nil
+}
+
+// VerifySignature checks the Signature of em against the base64 Ed25519
+// public key of its origin
+func VerifySignature(em EventMessage, publicKey string) error {
+	key, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if em.Signature == "" {
+		return fmt.Errorf("%w: the events of %s must be signed", ErrInvalidSignature, em.OriginId)
+	}
+	signature, err := base64.StdEncoding.DecodeString(em.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: Signature is not base64", ErrInvalidSignature)
+	}
+	signed, err := SignedBytes(em)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if !ed25519.Verify(key, signed, signature) {
+		return fmt.Errorf("%w: the Signature does not match the event", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key
+func ParsePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key %q is not a base64 Ed25519 key", publicKey)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// checkSignature verifies the Signature of em if its origin has a public
+// key, and otherwise drops it
+func checkSignature(keys PublicKeys, em *EventMessage) error {
+	publicKey := ""
+	if keys != nil {
+		publicKey = keys.PublicKey(em.OriginId)
+	}
+	if publicKey == "" {
+		em.Signature = ""
+		return nil
+	}
+	return VerifySignature(*em, publicKey)
+}
@@ -0,0 +1,119 @@
+package eventstream
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSignedBytes(t *testing.T) {
+	em := EventMessage{
+		EventId:            "e1",
+		OriginId:           "robot-1",
+		OriginBuildVersion: "1.0",
+		EventTimeUnixSec:   1700000000,
+		EventType:          "status",
+		EventVersion:       "1",
+		PayloadJson:        json.RawMessage(`{ "level": 10.0 }`),
+	}
+	signed, err := SignedBytes(em)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the example of signature.go and the README
+	want := `{"DestinationId":"robot-1","EventId":"e1","EventSubtype":"","EventTimeUnixSec":1700000000,"EventType":"status","EventVersion":"1","OriginBuildVersion":"1.0","OriginGroupId":"","OriginId":"robot-1","PayloadJson":{"level":10}}`
+	if string(signed) != want {
+		t.Errorf("SignedBytes = %s, want %s", signed, want)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(publicKey)
+	otherKey, _, _ := ed25519.GenerateKey(nil)
+
+	signed, err := SignEvent(testEvent("o1", "e1", `{"b":[1,2],"a":"x"}`), privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		change    func(em *EventMessage)
+		publicKey string
+		ok        bool
+	}{
+		{"signed", func(em *EventMessage) {}, encodedKey, true},
+		{"payload written otherwise", func(em *EventMessage) { em.PayloadJson = json.RawMessage(`{"a": "x", "b": [1.0, 2]}`) }, encodedKey, true},
+		{"destination of the origin", func(em *EventMessage) { em.DestinationId = "o1" }, encodedKey, true},
+		{"changed payload", func(em *EventMessage) { em.PayloadJson = json.RawMessage(`{"a":"y","b":[1,2]}`) }, encodedKey, false},
+		{"another destination", func(em *EventMessage) { em.DestinationId = "o2" }, encodedKey, false},
+		{"another EventId", func(em *EventMessage) { em.EventId = "e2" }, encodedKey, false},
+		{"another event time", func(em *EventMessage) { em.EventTimeUnixSec++ }, encodedKey, false},
+		{"unsigned", func(em *EventMessage) { em.Signature = "" }, encodedKey, false},
+		{"not base64", func(em *EventMessage) { em.Signature = "%%" }, encodedKey, false},
+		{"key of another origin", func(em *EventMessage) {}, base64.StdEncoding.EncodeToString(otherKey), false},
+		{"invalid key", func(em *EventMessage) {}, "abc", false},
+	}
+	for _, tt := range tests {
+		em := signed
+		tt.change(&em)
+		err := VerifySignature(em, tt.publicKey)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestSaveMessageSigned(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &Secure{Origins: map[string]*SecureOrigin{
+		"o1": {Id: "o1", PublicKey: base64.StdEncoding.EncodeToString(publicKey)},
+		"o2": {Id: "o2"},
+	}}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			es := &EventStream{Store: store, PublicKeys: keys}
+
+			if _, err := es.SaveMessage(ctx, testEvent("o1", "e1", `{}`)); !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("an unsigned event of an origin with a key got %v", err)
+			}
+			signed, err := SignEvent(testEvent("o1", "e1", `{"level":1}`), privateKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved, err := es.SaveMessage(ctx, signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the stored event can be verified by the consumers
+			read, err := es.GetByEventId(ctx, "o1", "e1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if read.Id != saved.Id || VerifySignature(read, keys.PublicKey("o1")) != nil {
+				t.Errorf("the stored event %d does not verify", read.Id)
+			}
+
+			// the signature of an origin without key is dropped
+			em := signed
+			em.OriginId = "o2"
+			saved, err = es.SaveMessage(ctx, em)
+			if err != nil || saved.Signature != "" {
+				t.Errorf("event of an origin without key: %v, Signature %q", err, saved.Signature)
+			}
+		})
+	}
+}
@@ -0,0 +1,961 @@
+package eventstream
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite" // pure go sqlite driver, no cgo needed to cross compile for robots
+)
+
+func init() {
+	// payload filters of EventQuery, with the same semantics as MemoryStore
+	sqlite.MustRegisterDeterministicScalarFunction("kex_payload_match", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		payload, ok := args[0].(string)
+		if !ok {
+			return false, nil
+		}
+		filter := PayloadFilter{}
+		if err := json.Unmarshal([]byte(args[1].(string)), &filter); err != nil {
+			return nil, err
+		}
+		return filter.Match(json.RawMessage(payload)), nil
+	})
+	// the numeric payload value of AggregateQuery
+	sqlite.MustRegisterDeterministicScalarFunction("kex_payload_number", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		payload, ok := args[0].(string)
+		if !ok {
+			return nil, nil
+		}
+		path := []string{}
+		if err := json.Unmarshal([]byte(args[1].(string)), &path); err != nil {
+			return nil, err
+		}
+		value, ok := payloadNumber(json.RawMessage(payload), path)
+		if !ok {
+			return nil, nil
+		}
+		return value, nil
+	})
+	// the redaction of ErasureRequest.Paths, NULL if nothing was redacted
+	sqlite.MustRegisterDeterministicScalarFunction("kex_payload_redact", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		payload, ok := args[0].(string)
+		if !ok {
+			return nil, nil
+		}
+		paths := [][]string{}
+		if err := json.Unmarshal([]byte(args[1].(string)), &paths); err != nil {
+			return nil, err
+		}
+		redacted, ok := redactPayload(json.RawMessage(payload), paths)
+		if !ok {
+			return nil, nil
+		}
+		return string(redacted), nil
+	})
+}
+
+const sqliteSelectEvents = "SELECT id, event_id, COALESCE(creation_time_unix_sec, 0), COALESCE(origin_id, ''), COALESCE(origin_iter, 0), COALESCE(origin_group_id, ''), COALESCE(origin_build_version, ''), COALESCE(destination_id, ''), COALESCE(destination_iter, 0), COALESCE(event_time_unix_sec, 0), COALESCE(event_type, ''), COALESCE(event_subtype, ''), COALESCE(event_version, ''), COALESCE(payload_json, '{}'), COALESCE(redacted_time_unix_sec, 0), payload_data, COALESCE(payload_key_id, ''), COALESCE(payload_codec, ''), COALESCE(payload_size, 0), COALESCE(chain_id, ''), COALESCE(chain_seq, 0), COALESCE(chain_prev_hash, ''), COALESCE(chain_hash, ''), COALESCE(chain_data_hash, ''), COALESCE(signature, '') FROM events"
+
+// SQLiteStore is the EventStore, OriginStore, SchemaStore, Eraser and
+// PayloadStore backed by an embedded SQLite database file, for single robot
+// and edge deployments without Postgresql
+type SQLiteStore struct {
+	DB *sql.DB
+}
+
+// OpenSQLiteStore opens (or creates) the SQLite database at path,
+// the tables are created by the migrations in migrations/sqlite
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, a single connection
+	// serializes the writes instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	return &SQLiteStore{DB: db}, nil
+}
+
+// Migrations
+func (ss *SQLiteStore) Migrations() ([]Migration, error) {
+	return LoadMigrations("sqlite")
+}
+
+// AppliedMigrations
+func (ss *SQLiteStore) AppliedMigrations(ctx context.Context) (map[int64]int64, error) {
+	applied := make(map[int64]int64)
+
+	_, err := ss.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, applied_time_unix_sec INTEGER NOT NULL)")
+	if err != nil {
+		return applied, err
+	}
+
+	rows, err := ss.DB.QueryContext(ctx, "SELECT version, applied_time_unix_sec FROM schema_migrations")
+	if err != nil {
+		return applied, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version, appliedTime int64
+		if err := rows.Scan(&version, &appliedTime); err != nil {
+			return applied, err
+		}
+		applied[version] = appliedTime
+	}
+	return applied, rows.Err()
+}
+
+// ApplyMigration
+func (ss *SQLiteStore) ApplyMigration(ctx context.Context, m Migration, up bool) error {
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_time_unix_sec) VALUES (?, ?, ?)", m.Version, m.Name, time.Now().Unix())
+	} else {
+		if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version=?", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the database
+func (ss *SQLiteStore) Close() error {
+	return ss.DB.Close()
+}
+
+// InsertEvent
+// an event that was already saved by its origin is not inserted again,
+// then the original Id is returned together with ErrDuplicateEvent
+// OriginIter and DestinationIter are assigned in the same transaction
+func (ss *SQLiteStore) InsertEvent(ctx context.Context, em EventMessage) (EventMessage, error) {
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return em, err
+	}
+	defer tx.Rollback()
+
+	saved, err := sqliteInsertEvent(ctx, tx, em)
+	if err != nil {
+		return saved, err
+	}
+	return saved, tx.Commit()
+}
+
+// InsertEvents
+// every event is inserted in its own savepoint, so a failing event
+// only rolls back itself and its iters
+func (ss *SQLiteStore) InsertEvents(ctx context.Context, ems []EventMessage) ([]SaveResult, error) {
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]SaveResult, len(ems))
+	for i, em := range ems {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT insert_event"); err != nil {
+			return nil, err
+		}
+		saved, err := sqliteInsertEvent(ctx, tx, em)
+		if err != nil {
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO insert_event"); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE insert_event"); err != nil {
+			return nil, err
+		}
+		results[i] = SaveResult{Event: saved, Err: err}
+	}
+
+	return results, tx.Commit()
+}
+
+// sqliteInsertEvent assigns the iters and inserts em in tx
+func sqliteInsertEvent(ctx context.Context, tx *sql.Tx, em EventMessage) (EventMessage, error) {
+	original, err := sqliteFindByEventId(ctx, tx, em.OriginId, em.EventId)
+	if err == nil {
+		return original, ErrDuplicateEvent
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return em, err
+	}
+	deletedId, err := sqliteFindDeletedKey(ctx, tx, em.OriginId, em.EventId)
+	if err == nil {
+		em.Id = deletedId
+		return em, ErrEventDeleted
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return em, err
+	}
+
+	em.OriginIter, err = sqliteNextIter(ctx, tx, "origin", em.OriginId)
+	if err != nil {
+		return em, err
+	}
+	em.DestinationIter, err = sqliteNextIter(ctx, tx, "destination", em.DestinationId)
+	if err != nil {
+		return em, err
+	}
+	if err := checkVersion(em, em.DestinationIter-1); err != nil {
+		return em, err
+	}
+	chain := &ChainLink{}
+	if em.Chain != nil {
+		head, err := sqliteChainHead(ctx, tx, em.Chain.Id)
+		if err != nil {
+			return em, err
+		}
+		head.link(&em)
+		chain = em.Chain
+	}
+
+	res, err := tx.ExecContext(ctx,
+		"INSERT INTO events (event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, destination_iter, event_time_unix_sec, event_type, event_subtype, event_version, payload_json, payload_data, payload_key_id, payload_codec, payload_size, chain_id, chain_seq, chain_prev_hash, chain_hash, chain_data_hash, signature) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''))",
+
+		em.EventId,
+		em.CreationTimeUnixSec,
+		em.OriginId,
+		em.OriginIter,
+		em.OriginGroupId,
+		em.OriginBuildVersion,
+		em.DestinationId,
+		em.DestinationIter,
+		em.EventTimeUnixSec,
+		em.EventType,
+		em.EventSubtype,
+		em.EventVersion,
+		string(em.PayloadJson),
+		em.payloadData,
+		em.payloadKeyId,
+		em.payloadCodec,
+		em.payloadSize,
+		chain.Id,
+		chain.Seq,
+		chain.PrevHash,
+		chain.Hash,
+		chain.DataHash,
+		em.Signature,
+	)
+	if err != nil {
+		return em, err
+	}
+	em.Id, err = res.LastInsertId()
+	if err != nil {
+		return em, err
+	}
+	if em.Chain != nil {
+		if err := sqliteSaveChain(ctx, tx, &ChainHead{ChainId: chain.Id, Seq: chain.Seq, Hash: chain.Hash}); err != nil {
+			return em, err
+		}
+	}
+	return em, sqliteUpdateLatest(ctx, tx, em)
+}
+
+// sqliteUpdateLatest moves latest_events to em if it is newer
+func sqliteUpdateLatest(ctx context.Context, tx *sql.Tx, em EventMessage) error {
+	if em.EventType == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO latest_events (destination_id, event_type, id) VALUES (?, ?, ?) ON CONFLICT (destination_id, event_type) DO UPDATE SET id = excluded.id WHERE excluded.id > latest_events.id",
+		em.DestinationId,
+		em.EventType,
+		em.Id,
+	)
+	return err
+}
+
+// sqliteQuerier is the part of sql.DB and sql.Tx used by the helpers below
+// with a single connection, queries during a transaction must use the sql.Tx
+type sqliteQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqliteChainHead returns the head of a chain, a new chain starts at Seq 0.
+// The iters were incremented before, so tx is already the only writer and
+// the head cannot change until it ends.
+func sqliteChainHead(ctx context.Context, q sqliteQuerier, chainId string) (*ChainHead, error) {
+	head := &ChainHead{ChainId: chainId}
+	err := q.QueryRowContext(ctx, "SELECT seq, hash FROM event_chains WHERE chain_id=?", chainId).Scan(&head.Seq, &head.Hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return head, nil
+	}
+	return head, err
+}
+
+// sqliteSaveChain moves a chain to its head, a restored head only moves it
+// forward
+func sqliteSaveChain(ctx context.Context, tx *sql.Tx, head *ChainHead) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO event_chains (chain_id, seq, hash) VALUES (?, ?, ?) ON CONFLICT (chain_id) DO UPDATE SET seq = excluded.seq, hash = excluded.hash WHERE excluded.seq > seq",
+		head.ChainId,
+		head.Seq,
+		head.Hash,
+	)
+	return err
+}
+
+// sqliteFindByEventId returns sql.ErrNoRows if the origin has no such event
+func sqliteFindByEventId(ctx context.Context, q sqliteQuerier, originId, eventId string) (EventMessage, error) {
+	rows, err := q.QueryContext(ctx, sqliteSelectEvents+" WHERE origin_id=? AND event_id=?", originId, eventId)
+	if err != nil {
+		return EventMessage{}, err
+	}
+	ms, err := parseSQLiteRows(rows)
+	if err != nil {
+		return EventMessage{}, err
+	}
+	if len(ms) == 0 {
+		return EventMessage{}, sql.ErrNoRows
+	}
+	return ms[0], nil
+}
+
+// sqliteFindDeletedKey returns the Id of the deleted event an origin saved
+// with eventId, sql.ErrNoRows if there is none
+func sqliteFindDeletedKey(ctx context.Context, q sqliteQuerier, originId, eventId string) (int64, error) {
+	var id int64
+	err := q.QueryRowContext(ctx, "SELECT id FROM deleted_event_keys WHERE origin_id=? AND event_id=?", originId, eventId).Scan(&id)
+	return id, err
+}
+
+// sqliteNextIter increments and returns the iter of an origin or destination stream
+func sqliteNextIter(ctx context.Context, q sqliteQuerier, streamType, streamId string) (int64, error) {
+	var iter int64
+	err := q.QueryRowContext(ctx,
+		"INSERT INTO stream_iters (stream_type, stream_id, iter) VALUES (?, ?, 1) ON CONFLICT (stream_type, stream_id) DO UPDATE SET iter = iter + 1 RETURNING iter",
+		streamType,
+		streamId,
+	).Scan(&iter)
+	return iter, err
+}
+
+// Ping
+func (ss *SQLiteStore) Ping(ctx context.Context) error {
+	return ss.DB.PingContext(ctx)
+}
+
+// LoadOrigins
+func (ss *SQLiteStore) LoadOrigins(ctx context.Context) ([]SecureOrigin, error) {
+	origins := []SecureOrigin{}
+
+	rows, err := ss.DB.QueryContext(ctx, "SELECT id, COALESCE(pass_hash, '') as pass_hash, COALESCE(public_key, '') as public_key FROM origins")
+	if err != nil {
+		return origins, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		origin := SecureOrigin{}
+		err := rows.Scan(
+			&origin.Id,
+			&origin.PassHash,
+			&origin.PublicKey,
+		)
+		if err != nil {
+			return origins, err
+		}
+		origins = append(origins, origin)
+	}
+
+	return origins, rows.Err()
+}
+
+// LoadSchemas
+func (ss *SQLiteStore) LoadSchemas(ctx context.Context) ([]EventSchema, error) {
+	schemas := []EventSchema{}
+
+	rows, err := ss.DB.QueryContext(ctx, "SELECT event_type, event_version, schema_json, added_time_unix_sec FROM event_schemas ORDER BY event_type, event_version")
+	if err != nil {
+		return schemas, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := EventSchema{}
+		schema := ""
+		if err := rows.Scan(&s.EventType, &s.EventVersion, &schema, &s.AddedUnixSec); err != nil {
+			return schemas, err
+		}
+		s.Schema = json.RawMessage(schema)
+		schemas = append(schemas, s)
+	}
+
+	return schemas, rows.Err()
+}
+
+// LoadSchemaModes
+func (ss *SQLiteStore) LoadSchemaModes(ctx context.Context) (map[string]string, error) {
+	modes := make(map[string]string)
+
+	rows, err := ss.DB.QueryContext(ctx, "SELECT event_type, mode FROM event_schema_modes")
+	if err != nil {
+		return modes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		eventType, mode := "", ""
+		if err := rows.Scan(&eventType, &mode); err != nil {
+			return modes, err
+		}
+		modes[eventType] = mode
+	}
+
+	return modes, rows.Err()
+}
+
+// SaveSchema
+func (ss *SQLiteStore) SaveSchema(ctx context.Context, s EventSchema) error {
+	_, err := ss.DB.ExecContext(ctx,
+		"INSERT INTO event_schemas (event_type, event_version, schema_json, added_time_unix_sec) VALUES (?, ?, ?, ?) ON CONFLICT (event_type, event_version) DO UPDATE SET schema_json = excluded.schema_json, added_time_unix_sec = excluded.added_time_unix_sec",
+		s.EventType, s.EventVersion, string(s.Schema), s.AddedUnixSec)
+	return err
+}
+
+// DeleteSchema
+func (ss *SQLiteStore) DeleteSchema(ctx context.Context, eventType, eventVersion string) error {
+	result, err := ss.DB.ExecContext(ctx, "DELETE FROM event_schemas WHERE event_type = ? AND event_version = ?", eventType, eventVersion)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrSchemaNotFound
+	}
+	return nil
+}
+
+// SetSchemaMode
+func (ss *SQLiteStore) SetSchemaMode(ctx context.Context, eventType, mode string) error {
+	_, err := ss.DB.ExecContext(ctx,
+		"INSERT INTO event_schema_modes (event_type, mode) VALUES (?, ?) ON CONFLICT (event_type) DO UPDATE SET mode = excluded.mode",
+		eventType, mode)
+	return err
+}
+
+// EraseEvents
+func (ss *SQLiteStore) EraseEvents(ctx context.Context, req ErasureRequest) (Erasure, error) {
+	if err := req.Check(); err != nil {
+		return Erasure{}, err
+	}
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Erasure{}, err
+	}
+	defer tx.Rollback()
+
+	originIds := []string{req.OriginId}
+	if req.OwnerEmail != "" {
+		originIds, err = sqliteOwnerOrigins(ctx, tx, req.OwnerEmail)
+		if err != nil {
+			return Erasure{}, err
+		}
+	}
+	erasure := req.erasure(originIds, time.Now().Unix())
+
+	if len(originIds) > 0 && len(req.Paths) > 0 {
+		query, args := sqlOpaqueOrigins("sqlite", originIds)
+		opaque := payloadPlain
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&opaque); err != nil {
+			return Erasure{}, err
+		}
+		if err := opaquePayloadError(opaque); err != nil {
+			return Erasure{}, fmt.Errorf("%w, their paths cannot be redacted, erase the whole payloads", err)
+		}
+	}
+	if len(originIds) > 0 {
+		query, args := req.sqlErase("sqlite", originIds, erasure.TimeUnixSec)
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return Erasure{}, err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return Erasure{}, err
+			}
+			erasure.add(id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return Erasure{}, err
+		}
+	}
+
+	origins, _ := json.Marshal(erasure.OriginIds)
+	paths, _ := json.Marshal(erasure.Paths)
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO erasures (time_unix_sec, erased_by, reason, origin_ids, owner_email, paths, events, min_id, max_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id",
+		erasure.TimeUnixSec, erasure.By, erasure.Reason, string(origins), erasure.OwnerEmail, string(paths), erasure.Events, erasure.MinId, erasure.MaxId,
+	).Scan(&erasure.Id)
+	if err != nil {
+		return Erasure{}, err
+	}
+	return erasure, tx.Commit()
+}
+
+// sqliteOwnerOrigins returns the ids of the origins of an owner
+func sqliteOwnerOrigins(ctx context.Context, q sqliteQuerier, ownerEmail string) ([]string, error) {
+	originIds := []string{}
+	rows, err := q.QueryContext(ctx, "SELECT id FROM origins WHERE owner_email = ? ORDER BY id", ownerEmail)
+	if err != nil {
+		return originIds, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		id := ""
+		if err := rows.Scan(&id); err != nil {
+			return originIds, err
+		}
+		originIds = append(originIds, id)
+	}
+	return originIds, rows.Err()
+}
+
+// Erasures
+func (ss *SQLiteStore) Erasures(ctx context.Context) ([]Erasure, error) {
+	erasures := []Erasure{}
+
+	rows, err := ss.DB.QueryContext(ctx, "SELECT id, time_unix_sec, erased_by, reason, origin_ids, owner_email, paths, events, min_id, max_id FROM erasures ORDER BY id")
+	if err != nil {
+		return erasures, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := Erasure{}
+		origins, paths := "", ""
+		if err := rows.Scan(&e.Id, &e.TimeUnixSec, &e.By, &e.Reason, &origins, &e.OwnerEmail, &paths, &e.Events, &e.MinId, &e.MaxId); err != nil {
+			return erasures, err
+		}
+		json.Unmarshal([]byte(origins), &e.OriginIds)
+		json.Unmarshal([]byte(paths), &e.Paths)
+		erasures = append(erasures, e)
+	}
+
+	return erasures, rows.Err()
+}
+
+// StalePayloads
+func (ss *SQLiteStore) StalePayloads(ctx context.Context, keyId string, afterId int64, limit int) ([]EventMessage, error) {
+	return ss.query(ctx, sqliteSelectEvents+" WHERE id > ? AND COALESCE(payload_key_id, '') <> ? AND NOT (payload_data IS NULL AND payload_json = '{}') ORDER BY id ASC LIMIT ?",
+		afterId,
+		keyId,
+		limit,
+	)
+}
+
+// UpdatePayloads
+func (ss *SQLiteStore) UpdatePayloads(ctx context.Context, stale, ems []EventMessage) (int64, error) {
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	updated := int64(0)
+	for i := range ems {
+		res, err := tx.ExecContext(ctx,
+			"UPDATE events SET payload_json = ?, payload_data = ?, payload_key_id = NULLIF(?, ''), payload_codec = NULLIF(?, ''), payload_size = NULLIF(?, 0) WHERE id = ? AND COALESCE(payload_key_id, '') = ? AND COALESCE(redacted_time_unix_sec, 0) = ?",
+			string(ems[i].PayloadJson),
+			ems[i].payloadData,
+			ems[i].payloadKeyId,
+			ems[i].payloadCodec,
+			ems[i].payloadSize,
+			stale[i].Id,
+			stale[i].payloadKeyId,
+			stale[i].RedactedUnixSec,
+		)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		updated += n
+	}
+	return updated, tx.Commit()
+}
+
+// PayloadStats
+func (ss *SQLiteStore) PayloadStats(ctx context.Context) ([]PayloadStats, error) {
+	stats := []PayloadStats{}
+
+	rows, err := ss.DB.QueryContext(ctx,
+		`SELECT COALESCE(payload_codec, ''), payload_key_id IS NOT NULL, count(*),
+			COALESCE(sum(CASE WHEN payload_data IS NULL THEN length(CAST(payload_json AS BLOB)) ELSE COALESCE(payload_size, length(payload_data)) END), 0),
+			COALESCE(sum(COALESCE(length(payload_data), length(CAST(payload_json AS BLOB)))), 0)
+		FROM events GROUP BY 1, 2 ORDER BY 1, 2`)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s := PayloadStats{}
+		if err := rows.Scan(&s.Codec, &s.Encrypted, &s.Events, &s.Bytes, &s.StoredBytes); err != nil {
+			return stats, err
+		}
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
+
+// ChainHeads
+func (ss *SQLiteStore) ChainHeads(ctx context.Context) ([]ChainHead, error) {
+	heads := []ChainHead{}
+
+	rows, err := ss.DB.QueryContext(ctx, "SELECT chain_id, seq, hash FROM event_chains WHERE seq > 0 ORDER BY chain_id")
+	if err != nil {
+		return heads, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		head := ChainHead{}
+		if err := rows.Scan(&head.ChainId, &head.Seq, &head.Hash); err != nil {
+			return heads, err
+		}
+		heads = append(heads, head)
+	}
+
+	return heads, rows.Err()
+}
+
+// ChainEvents
+func (ss *SQLiteStore) ChainEvents(ctx context.Context, chainId string, fromSeq int64, limit int) ([]EventMessage, error) {
+	return ss.query(ctx, sqliteSelectEvents+" WHERE chain_id = ? AND chain_seq >= ? ORDER BY chain_seq ASC LIMIT ?",
+		chainId,
+		fromSeq,
+		limit,
+	)
+}
+
+// parseSQLiteRows is the database/sql version of ParseRows
+func parseSQLiteRows(rows *sql.Rows) ([]EventMessage, error) {
+	ms := []EventMessage{}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		m := EventMessage{}
+		payload := ""
+		chain := ChainLink{}
+		err := rows.Scan(
+			&m.Id,
+			&m.EventId,
+			&m.CreationTimeUnixSec,
+			&m.OriginId,
+			&m.OriginIter,
+			&m.OriginGroupId,
+			&m.OriginBuildVersion,
+			&m.DestinationId,
+			&m.DestinationIter,
+			&m.EventTimeUnixSec,
+			&m.EventType,
+			&m.EventSubtype,
+			&m.EventVersion,
+			&payload,
+			&m.RedactedUnixSec,
+			&m.payloadData,
+			&m.payloadKeyId,
+			&m.payloadCodec,
+			&m.payloadSize,
+			&chain.Id,
+			&chain.Seq,
+			&chain.PrevHash,
+			&chain.Hash,
+			&chain.DataHash,
+			&m.Signature,
+		)
+		if err != nil {
+			return []EventMessage{}, err
+		}
+		m.PayloadJson = json.RawMessage(payload)
+		if chain.Id != "" {
+			m.Chain = &chain
+		}
+		if err := inflatePayload(&m); err != nil {
+			return []EventMessage{}, err
+		}
+		ms = append(ms, m)
+	}
+
+	return ms, rows.Err()
+}
+
+func (ss *SQLiteStore) query(ctx context.Context, query string, args ...interface{}) ([]EventMessage, error) {
+	rows, err := ss.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return []EventMessage{}, err
+	}
+	return parseSQLiteRows(rows)
+}
+
+// QueryEvents
+func (ss *SQLiteStore) QueryEvents(ctx context.Context, q EventQuery) ([]EventMessage, error) {
+	if len(q.Payload) > 0 {
+		if err := ss.checkOpaquePayloads(ctx, q); err != nil {
+			return []EventMessage{}, fmt.Errorf("%w, they cannot be filtered on", err)
+		}
+	}
+	where, args := q.sqlWhere("sqlite")
+	return ss.query(ctx, sqliteSelectEvents+where, args...)
+}
+
+// checkOpaquePayloads returns an error if an event with a payload SQLite
+// cannot look into could change the result of q, see sqlOpaquePayloads
+func (ss *SQLiteStore) checkOpaquePayloads(ctx context.Context, q EventQuery) error {
+	query, args := q.sqlOpaquePayloads("sqlite")
+	opaque := payloadPlain
+	if err := ss.DB.QueryRowContext(ctx, query, args...).Scan(&opaque); err != nil {
+		return err
+	}
+	return opaquePayloadError(opaque)
+}
+
+// DeleteEvents
+// the EventIds of the deleted events are kept in deleted_event_keys, and
+// latest_events moves back to the newest event that is left
+func (ss *SQLiteStore) DeleteEvents(ctx context.Context, q EventQuery, except []EventQuery, limit int) (int64, error) {
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query, args := sqlDelete("sqlite", q, except, limit)
+	rows, err := tx.QueryContext(ctx, query+" RETURNING id, origin_id, event_id, destination_id, COALESCE(event_type, '')", args...)
+	if err != nil {
+		return 0, err
+	}
+	deletedKeys := []EventMessage{}
+	keys := make(map[[2]string]bool)
+	for rows.Next() {
+		em := EventMessage{}
+		if err := rows.Scan(&em.Id, &em.OriginId, &em.EventId, &em.DestinationId, &em.EventType); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		deletedKeys = append(deletedKeys, em)
+		if em.EventType != "" {
+			keys[[2]string{em.DestinationId, em.EventType}] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	deleted := int64(len(deletedKeys))
+
+	for _, em := range deletedKeys {
+		_, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO deleted_event_keys (origin_id, event_id, id) VALUES (?, ?, ?)", em.OriginId, em.EventId, em.Id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for key := range keys {
+		res, err := tx.ExecContext(ctx, "DELETE FROM latest_events WHERE destination_id=? AND event_type=? AND NOT EXISTS (SELECT 1 FROM events WHERE events.id = latest_events.id)", key[0], key[1])
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO latest_events (destination_id, event_type, id) SELECT destination_id, event_type, max(id) FROM events WHERE destination_id=? AND event_type=? GROUP BY destination_id, event_type", key[0], key[1])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return deleted, tx.Commit()
+}
+
+// RestoreEvents
+// AUTOINCREMENT moves past the restored ids by itself
+func (ss *SQLiteStore) RestoreEvents(ctx context.Context, ems []EventMessage) (int64, error) {
+	tx, err := ss.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	restored := int64(0)
+	for _, em := range ems {
+		// a deleted event is restored with the Id it had
+		deletedId, err := sqliteFindDeletedKey(ctx, tx, em.OriginId, em.EventId)
+		if err == nil && deletedId != em.Id {
+			continue
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+
+		chain := &ChainLink{}
+		if em.Chain != nil {
+			chain = em.Chain
+		}
+		// the conflicts on the id and on (origin_id, event_id) are ignored
+		res, err := tx.ExecContext(ctx,
+			"INSERT OR IGNORE INTO events (id, event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, destination_iter, event_time_unix_sec, event_type, event_subtype, event_version, payload_json, redacted_time_unix_sec, payload_data, payload_key_id, payload_codec, payload_size, chain_id, chain_seq, chain_prev_hash, chain_hash, chain_data_hash, signature) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''))",
+
+			em.Id,
+			em.EventId,
+			em.CreationTimeUnixSec,
+			em.OriginId,
+			em.OriginIter,
+			em.OriginGroupId,
+			em.OriginBuildVersion,
+			em.DestinationId,
+			em.DestinationIter,
+			em.EventTimeUnixSec,
+			em.EventType,
+			em.EventSubtype,
+			em.EventVersion,
+			string(em.PayloadJson),
+			em.RedactedUnixSec,
+			em.payloadData,
+			em.payloadKeyId,
+			em.payloadCodec,
+			em.payloadSize,
+			chain.Id,
+			chain.Seq,
+			chain.PrevHash,
+			chain.Hash,
+			chain.DataHash,
+			em.Signature,
+		)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		restored++
+		_, err = tx.ExecContext(ctx, "DELETE FROM deleted_event_keys WHERE origin_id=? AND event_id=?", em.OriginId, em.EventId)
+		if err != nil {
+			return 0, err
+		}
+		if err := sqliteUpdateLatest(ctx, tx, em); err != nil {
+			return 0, err
+		}
+		if em.Chain != nil {
+			if err := sqliteSaveChain(ctx, tx, &ChainHead{ChainId: chain.Id, Seq: chain.Seq, Hash: chain.Hash}); err != nil {
+				return 0, err
+			}
+		}
+
+		for _, iter := range []struct {
+			streamType, streamId string
+			iter                 int64
+		}{{"origin", em.OriginId, em.OriginIter}, {"destination", em.DestinationId, em.DestinationIter}} {
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO stream_iters (stream_type, stream_id, iter) VALUES (?, ?, ?) ON CONFLICT (stream_type, stream_id) DO UPDATE SET iter = max(iter, excluded.iter)",
+				iter.streamType,
+				iter.streamId,
+				iter.iter,
+			)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return restored, tx.Commit()
+}
+
+// AggregateEvents
+func (ss *SQLiteStore) AggregateEvents(ctx context.Context, aq AggregateQuery) ([]AggregateBucket, error) {
+	if aq.payload() {
+		if err := ss.checkOpaquePayloads(ctx, aq.query()); err != nil {
+			return nil, fmt.Errorf("%w, they cannot be aggregated", err)
+		}
+	}
+	query, args := aq.sql("sqlite")
+	rows, err := ss.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []AggregateBucket{}
+	for rows.Next() {
+		b := AggregateBucket{}
+		if err := rows.Scan(aq.scanFields(&b)...); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// LatestEvents
+func (ss *SQLiteStore) LatestEvents(ctx context.Context, destIds []string) ([]EventMessage, error) {
+	if len(destIds) == 0 {
+		return []EventMessage{}, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(destIds)), ", ")
+	args := make([]interface{}, len(destIds))
+	for i, destId := range destIds {
+		args[i] = destId
+	}
+	return ss.query(ctx, sqliteSelectEvents+" WHERE id IN (SELECT id FROM latest_events WHERE destination_id IN ("+placeholders+")) ORDER BY destination_id, event_type", args...)
+}
+
+// GetByEventId
+func (ss *SQLiteStore) GetByEventId(ctx context.Context, originId, eventId string) (EventMessage, error) {
+	em, err := sqliteFindByEventId(ctx, ss.DB, originId, eventId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return em, ErrEventNotFound
+	}
+	return em, err
+}
+
+// GetByOriginIdSinceIter
+func (ss *SQLiteStore) GetByOriginIdSinceIter(ctx context.Context, originId string, sinceIter int64, limit int) ([]EventMessage, error) {
+	return ss.query(ctx, sqliteSelectEvents+" WHERE origin_id=? AND origin_iter > ? ORDER BY origin_iter ASC LIMIT ?",
+		originId,
+		sinceIter,
+		limit,
+	)
+}
+
+// GetByDestinationIdSinceIter
+func (ss *SQLiteStore) GetByDestinationIdSinceIter(ctx context.Context, destId string, sinceIter int64, limit int) ([]EventMessage, error) {
+	return ss.query(ctx, sqliteSelectEvents+" WHERE destination_id=? AND destination_iter > ? ORDER BY destination_iter ASC LIMIT ?",
+		destId,
+		sinceIter,
+		limit,
+	)
+}
@@ -0,0 +1,87 @@
+package eventstream
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDuplicateEvent is returned when an origin saves an EventId it already
+// saved before, for instance when it retries after a timeout.
+// The returned EventMessage has the Id of the original event.
+var ErrDuplicateEvent = errors.New("duplicate event, EventId was already saved by this origin")
+
+// ErrEventDeleted is returned when an origin saves an EventId of which the
+// event was saved before and has since been deleted, by retention or with its
+// partition. The EventIds stay taken, so a late retry is not saved again.
+// The returned EventMessage has the Id the original event had.
+var ErrEventDeleted = errors.New("event was already saved and has since been deleted")
+
+// ErrEventNotFound is returned by GetByEventId if there is no such event
+var ErrEventNotFound = errors.New("event not found")
+
+// ErrInvalidEvent is wrapped by the errors for events that cannot be saved
+// because of their content, the message tells the client what is wrong
+var ErrInvalidEvent = errors.New("invalid event")
+
+// EventStore is the storage backend of an EventStream.
+// Implementations must be safe for concurrent use, and stop waiting on the
+// database when the ctx of a call is canceled or past its deadline.
+//
+// PostgresStore is the production backend, SQLiteStore is an embedded
+// database for single robot and edge deployments and MemoryStore keeps
+// everything in-process for tests and development.
+type EventStore interface {
+	// InsertEvent saves a validated EventMessage and returns it with its Id set
+	// (origin_id, event_id) is unique, see ErrDuplicateEvent
+	// the store assigns OriginIter and DestinationIter atomically with the
+	// insert, counting up from 1 per origin and per destination without gaps
+	InsertEvent(ctx context.Context, em EventMessage) (EventMessage, error)
+
+	// InsertEvents saves a batch in a single transaction, with a result per
+	// event in the same order, a failing event does not stop the others
+	// the error is set if the transaction failed and nothing was saved
+	InsertEvents(ctx context.Context, ems []EventMessage) ([]SaveResult, error)
+
+	// QueryEvents returns the events that match q, from new to old (id DESC)
+	QueryEvents(ctx context.Context, q EventQuery) ([]EventMessage, error)
+
+	// AggregateEvents counts the events of aq per bucket, EventType and the
+	// GroupBy fields, ordered by those, aq has passed Check
+	AggregateEvents(ctx context.Context, aq AggregateQuery) ([]AggregateBucket, error)
+
+	// LatestEvents returns the latest event of every event type of the
+	// destinations, ordered by destination and event type, it reads the
+	// latest_events projection that is updated together with the inserts
+	LatestEvents(ctx context.Context, destIds []string) ([]EventMessage, error)
+
+	// GetByEventId returns the event an origin saved with its EventId,
+	// or ErrEventNotFound
+	GetByEventId(ctx context.Context, originId, eventId string) (EventMessage, error)
+
+	// the since queries return events from old to new (iter ASC)
+	GetByOriginIdSinceIter(ctx context.Context, originId string, sinceIter int64, limit int) ([]EventMessage, error)
+	GetByDestinationIdSinceIter(ctx context.Context, destId string, sinceIter int64, limit int) ([]EventMessage, error)
+
+	// DeleteEvents deletes at most limit events, oldest first, that match q
+	// and none of except, and returns how many were deleted, it is used by
+	// Retention so the pagination fields of q are not used
+	// the EventIds of the deleted events stay taken, see ErrEventDeleted
+	DeleteEvents(ctx context.Context, q EventQuery, except []EventQuery, limit int) (int64, error)
+
+	// RestoreEvents saves events from an archive as they are, with their Id
+	// and iters, an event of which the Id or (OriginId, EventId) is already
+	// saved is skipped, so a restore can be repeated, a deleted event with
+	// the same Id is restored
+	// the iters of the streams are raised to the restored iters, new events
+	// continue after them, returns the number of events saved
+	RestoreEvents(ctx context.Context, ems []EventMessage) (int64, error)
+
+	// Ping checks if the backend is reachable
+	Ping(ctx context.Context) error
+}
+
+// OriginStore provides the origins that are allowed to use the EventStream,
+// it is used by Secure to refresh its list of origins
+type OriginStore interface {
+	LoadOrigins(ctx context.Context) ([]SecureOrigin, error)
+}
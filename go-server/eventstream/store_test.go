@@ -0,0 +1,79 @@
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// openTestSQLite opens a migrated SQLiteStore in a temporary directory
+func openTestSQLite(t *testing.T) *SQLiteStore {
+	t.Helper()
+	ss, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ss.Close() })
+	if _, err := MigrateUp(context.Background(), ss); err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+// testStores are the stores the tests run against, the ones that need no
+// database server
+func testStores(t *testing.T) map[string]EventStore {
+	return map[string]EventStore{
+		"memory": &MemoryStore{},
+		"sqlite": openTestSQLite(t),
+	}
+}
+
+// testEvent is an event of origin that is ready to be saved
+func testEvent(originId, eventId, payload string) EventMessage {
+	return EventMessage{
+		EventId:            eventId,
+		OriginId:           originId,
+		OriginBuildVersion: "1.0",
+		EventTimeUnixSec:   1700000000,
+		EventType:          "status",
+		EventVersion:       "1",
+		PayloadJson:        json.RawMessage(payload),
+	}
+}
+
+func TestInsertEventsFailingEvent(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			// the second event fails in the store, after the first one took
+			// its iters, the events after it still get the next iters
+			conflict := testEvent("o1", "e2", `{}`)
+			conflict.expectVersion, conflict.expectedVersion = true, 5
+			ems := []EventMessage{testEvent("o1", "e1", `{}`), conflict, testEvent("o1", "e3", `{}`)}
+			for i := range ems {
+				ems[i].DestinationId = "o1"
+			}
+			results, err := store.InsertEvents(ctx, ems)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			versionErr := &VersionError{}
+			if results[0].Err != nil || !errors.As(results[1].Err, &versionErr) || results[2].Err != nil {
+				t.Fatalf("got %v, %v, %v, want only the second event to fail", results[0].Err, results[1].Err, results[2].Err)
+			}
+			for i, want := range []int64{1, 0, 2} {
+				if want > 0 && (results[i].Event.OriginIter != want || results[i].Event.DestinationIter != want) {
+					t.Errorf("event %d got iters %d and %d, want %d", i, results[i].Event.OriginIter, results[i].Event.DestinationIter, want)
+				}
+			}
+			if _, err := store.GetByEventId(ctx, "o1", "e2"); !errors.Is(err, ErrEventNotFound) {
+				t.Errorf("the failed event was saved: %v", err)
+			}
+		})
+	}
+}
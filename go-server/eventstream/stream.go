@@ -1,42 +1,16 @@
 package eventstream
 
-/*
-CREATE TABLE public.events
-(
-    id bigint NOT NULL GENERATED ALWAYS AS IDENTITY ( INCREMENT 1 START 1 MINVALUE 1 MAXVALUE 9223372036854775807 CACHE 1 ),
-    event_id character varying(256) COLLATE pg_catalog."default" NOT NULL,
-    creation_time_unix_sec bigint,
-    origin_id character varying(256) COLLATE pg_catalog."default" NOT NULL,
-    origin_iter bigint,
-    origin_group_id character varying(256) COLLATE pg_catalog."default",
-    origin_build_version character varying(256) COLLATE pg_catalog."default",
-    destination_id character varying(256) COLLATE pg_catalog."default" NOT NULL,
-    destination_iter bigint,
-    event_time_unix_sec bigint,
-    event_type character varying(256) COLLATE pg_catalog."default",
-    event_subtype character varying(256) COLLATE pg_catalog."default",
-    event_version character varying(256) COLLATE pg_catalog."default",
-    payload_json json,
-    CONSTRAINT events_pkey PRIMARY KEY (id)
-)
-
-TABLESPACE pg_default;
-
-ALTER TABLE public.events
-    OWNER to postgres;
-*/
-
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 // EventMessage is the format used to send Events around
@@ -49,11 +23,14 @@ type EventMessage struct {
 	CreationTimeUnixSec int64
 
 	// info about the origin
+	// the iters count the events per origin and per destination,
+	// they are assigned by the server: 1, 2, 3, ... without gaps
 	OriginId           string
 	OriginIter         int64
 	OriginGroupId      string
 	OriginBuildVersion string
 	DestinationId      string
+	DestinationIter    int64
 
 	// the time this event happened
 	EventTimeUnixSec int64
@@ -63,16 +40,72 @@ type EventMessage struct {
 	EventSubtype string
 	EventVersion string
 
-	// content of the message
-	PayloadJson string
+	// content of the message, nested JSON
+	// the old form, with the JSON encoded in a string, is still accepted
+	PayloadJson json.RawMessage
+
+	// the time the personal data of the event was erased or redacted, the
+	// event stays as a tombstone, see erasure.go, 0 if it was not
+	RedactedUnixSec int64
+
+	// the place of the event in its hash chain, see chain.go, nil if the
+	// events are not chained
+	Chain *ChainLink
+
+	// the base64 Ed25519 signature of the origin, see signature.go, only
+	// kept for the origins with a public key
+	Signature string
+
+	// the encrypted or compressed payload as it is stored, PayloadJson is {}
+	// while it is set, see encryption.go and compression.go
+	payloadData  []byte
+	payloadKeyId string
+	payloadCodec string
+	payloadSize  int64 // of the JSON of a payload in payloadData
+
+	// the version the destination has to be at, see SaveExpected
+	expectVersion   bool
+	expectedVersion int64
 }
 
 type EventStream struct {
-	Conn       *pgxpool.Pool
+	Store      EventStore   // storage backend, see store.go
 	MqttClient *mqtt.Client // (optional) MQTT client to notify when a new event is added
 
 	EventStreamId string
 	eventIdIter   uint64
+
+	// (optional) group commit, see batcher.go: concurrent saves are collected
+	// for BatchWindow, or until BatchMaxEvents, and saved in one transaction
+	BatchWindow    time.Duration
+	BatchMaxEvents int
+	batchOnce      sync.Once
+	saveQueue      chan saveRequest
+
+	// (optional) JSON Schemas the payloads are validated against, see schema.go
+	Schemas *SchemaRegistry
+
+	// (optional) conversions of old EventVersions on read, see upcast.go
+	Upcasters *Upcasters
+
+	// (optional) encryption of the payloads at rest, see encryption.go
+	Keys *PayloadKeys
+
+	// (optional) compression of the large payloads, see compression.go
+	Compression *PayloadCompression
+
+	// (optional) public keys of the origins that sign their events, see
+	// signature.go
+	PublicKeys PublicKeys
+
+	// (optional) hash chain of the saved events, ChainDestination or
+	// ChainGlobal, see chain.go
+	ChainScope string
+
+	// (optional) deadlines of the store calls, on top of the deadline of the
+	// ctx of the caller, 0 waits as long as the caller does
+	QueryTimeout  time.Duration
+	InsertTimeout time.Duration
 }
 
 type Status struct {
@@ -90,46 +123,45 @@ func (es *EventStream) GenStreamEventId() string {
 }
 
 // SaveMessage
-func (es *EventStream) SaveMessage(em EventMessage) (EventMessage, error) {
-	// check if eventId is set
-	if em.EventId == "" {
-		return em, errors.New("EventId not set")
-	}
-
-	// check if origin information is set
-	if em.OriginId == "" || em.OriginBuildVersion == "" {
-		return em, errors.New("OriginId or OriginBuildVersion not set")
+// validates and saves an EventMessage, then notifies MQTT
+// saving the same EventId of an origin twice returns the original Id
+// together with ErrDuplicateEvent, or ErrEventDeleted if the original was
+// deleted since, and does not notify again
+// if ctx ends before the insert is done the event can still be saved, a
+// retry of the origin then gets the original Id
+func (es *EventStream) SaveMessage(ctx context.Context, em EventMessage) (EventMessage, error) {
+	em, err := es.prepareMessage(em)
+	if err != nil {
+		return em, err
 	}
-	if em.EventType == "" || em.EventVersion == "" {
-		return em, errors.New("EventType or EventVersion not set")
+	em, err = es.Compression.Compress(em)
+	if err != nil {
+		return em, err
 	}
-	if em.DestinationId == "" {
-		em.DestinationId = em.OriginId
+	em, err = es.Keys.Seal(em)
+	if err != nil {
+		return em, err
 	}
 
-	// generate EventStream values for in the database
-	em.CreationTimeUnixSec = time.Now().Unix()
-
 	// try to save into the database
-	err := es.Conn.QueryRow(
-		context.Background(),
-		"INSERT INTO events (event_id, creation_time_unix_sec, origin_id, origin_iter, origin_group_id, origin_build_version, destination_id, event_time_unix_sec, event_type, event_subtype, event_version, payload_json) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id;",
-
-		em.EventId,
-		em.CreationTimeUnixSec,
-		em.OriginId,
-		em.OriginIter,
-		em.OriginGroupId,
-		em.OriginBuildVersion,
-		em.DestinationId,
-		em.EventTimeUnixSec,
-		em.EventType,
-		em.EventSubtype,
-		em.EventVersion,
-		em.PayloadJson,
-	).Scan(
-		&em.Id,
-	)
+	if es.BatchWindow > 0 {
+		em, err = es.insertBatched(ctx, em)
+	} else {
+		insertCtx, cancel := es.insertContext(ctx)
+		em, err = es.Store.InsertEvent(insertCtx, em)
+		err = ctxErr(insertCtx, err)
+		cancel()
+	}
+	// also the original of a duplicate is returned as it was saved
+	em, openErr := es.Keys.Open(em)
+	if err == nil {
+		err = openErr
+	}
+	if errors.Is(err, ErrDuplicateEvent) || errors.Is(err, ErrEventDeleted) {
+		// the origin retried, it already got notified about the original
+		fmt.Println("duplicate event", em.EventId, "of", em.OriginId, "has id:", em.Id)
+		return em, err
+	}
 	if err != nil {
 		fmt.Println(err)
 		return em, err
@@ -139,135 +171,301 @@ func (es *EventStream) SaveMessage(em EventMessage) (EventMessage, error) {
 	}
 	fmt.Println("inserted event with id:", em.Id)
 
-	// If MQTT is used for live updates, publish the latest eventMessage
-	if es.MqttClient != nil {
-		data, _ := json.Marshal(&em)
+	es.publish(em)
 
-		// publish under specific device
-		mqttLocalPath := "eventstream/" + em.DestinationId + "/lastEvent"
-		(*es.MqttClient).Publish(mqttLocalPath, 1, true, string(data))
+	return em, err
+}
 
-		// publish under this server
-		mqttServerPath := "eventstream/" + es.EventStreamId + "/lastEvent"
-		(*es.MqttClient).Publish(mqttServerPath, 1, true, string(data))
+// SaveResult is the outcome of saving one event of a batch
+type SaveResult struct {
+	Event EventMessage
+	Err   error
+}
+
+// SaveMessages saves a batch of EventMessages in a single transaction,
+// every event gets its own result, in the same order as ems.
+// An invalid or duplicate event does not stop the others from being saved,
+// the returned error is only set when the batch as a whole failed.
+func (es *EventStream) SaveMessages(ctx context.Context, ems []EventMessage) ([]SaveResult, error) {
+	results := make([]SaveResult, len(ems))
+
+	valid := []EventMessage{}
+	validIndex := []int{}
+	for i := range ems {
+		em, err := es.prepareMessage(ems[i])
+		if err == nil {
+			em, err = es.Compression.Compress(em)
+		}
+		if err == nil {
+			em, err = es.Keys.Seal(em)
+		}
+		if err != nil {
+			results[i] = SaveResult{Event: em, Err: err}
+			continue
+		}
+		valid = append(valid, em)
+		validIndex = append(validIndex, i)
+	}
+	if len(valid) == 0 {
+		return results, nil
 	}
 
-	return em, err
+	ctx, cancel := es.insertContext(ctx)
+	defer cancel()
+	inserted, err := es.Store.InsertEvents(ctx, valid)
+	err = ctxErr(ctx, err)
+	if err != nil {
+		fmt.Println(err)
+		return results, err
+	}
+	for j, result := range inserted {
+		em, err := es.Keys.Open(result.Event)
+		result.Event = em
+		if result.Err == nil {
+			result.Err = err
+		}
+		results[validIndex[j]] = result
+		if result.Err == nil {
+			es.publish(result.Event)
+		}
+	}
+	fmt.Println("inserted batch of", len(ems), "events")
+
+	return results, nil
 }
 
-func ParseRows(rows pgx.Rows) ([]EventMessage, error) {
-	ms := []EventMessage{}
-
-	defer rows.Close()
-
-	for rows.Next() {
-		m := EventMessage{}
-		err := rows.Scan(
-			&m.Id,
-			&m.EventId,
-			&m.CreationTimeUnixSec,
-			&m.OriginId,
-			&m.OriginIter,
-			&m.OriginGroupId,
-			&m.OriginBuildVersion,
-			&m.DestinationId,
-			&m.EventTimeUnixSec,
-			&m.EventType,
-			&m.EventSubtype,
-			&m.EventVersion,
-			&m.PayloadJson,
-		)
+// prepareMessage checks the EventMessage and sets the EventStream values
+func (es *EventStream) prepareMessage(em EventMessage) (EventMessage, error) {
+	// check if eventId is set
+	if em.EventId == "" {
+		return em, fmt.Errorf("%w: EventId not set", ErrInvalidEvent)
+	}
+
+	// check if origin information is set
+	if em.OriginId == "" || em.OriginBuildVersion == "" {
+		return em, fmt.Errorf("%w: OriginId or OriginBuildVersion not set", ErrInvalidEvent)
+	}
+	if em.EventType == "" || em.EventVersion == "" {
+		return em, fmt.Errorf("%w: EventType or EventVersion not set", ErrInvalidEvent)
+	}
+	if em.DestinationId == "" {
+		em.DestinationId = em.OriginId
+	}
+	payload, err := normalizePayload(em.PayloadJson)
+	if err != nil {
+		return em, fmt.Errorf("%w: PayloadJson %v", ErrInvalidEvent, err)
+	}
+	em.PayloadJson = payload
+	if err := checkSignature(es.PublicKeys, &em); err != nil {
+		return em, err
+	}
+	if es.Schemas != nil {
+		if err := es.Schemas.Validate(em); err != nil {
+			return em, err
+		}
+	}
+
+	// generate EventStream values for in the database
+	em.CreationTimeUnixSec = time.Now().Unix()
+	em.RedactedUnixSec = 0
+	em.Chain = nil
+	if es.ChainScope != "" {
+		em.Chain, err = newChainLink(es.ChainScope, &em)
 		if err != nil {
-			return []EventMessage{}, err
+			return em, err
 		}
-		ms = append(ms, m)
 	}
 
-	return ms, rows.Err()
+	return em, nil
 }
 
-// getByEventId
+// normalizePayload checks the payload is well-formed JSON and compacts it,
+// an empty payload becomes {}.
+// Until all clients send the payload as nested JSON, the old form with the
+// JSON encoded in a string is accepted too and decoded here.
+func normalizePayload(payload json.RawMessage) (json.RawMessage, error) {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '"' {
+		legacy := ""
+		if err := json.Unmarshal(payload, &legacy); err != nil {
+			return nil, errors.New("is not valid JSON")
+		}
+		payload = bytes.TrimSpace([]byte(legacy))
+	}
+	if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+		return json.RawMessage("{}"), nil
+	}
 
-// getByEventType
+	compact := bytes.Buffer{}
+	if err := json.Compact(&compact, payload); err != nil {
+		return nil, errors.New("is not valid JSON")
+	}
+	// jsonb cannot store the null character
+	if bytes.Contains(compact.Bytes(), []byte(`\u0000`)) {
+		return nil, errors.New("cannot contain \\u0000")
+	}
+	return compact.Bytes(), nil
+}
 
-// GetByDestinationId
-// use -1 for newestId if you start from zero
-func (es *EventStream) GetByDestinationId(destId string, newestId, limit int) ([]EventMessage, error) {
+// publish notifies MQTT of a saved event, if MQTT is used for live updates
+func (es *EventStream) publish(em EventMessage) {
+	if es.MqttClient == nil {
+		return
+	}
+	data, _ := json.Marshal(&em)
+
+	// publish under specific device
+	mqttLocalPath := "eventstream/" + em.DestinationId + "/lastEvent"
+	(*es.MqttClient).Publish(mqttLocalPath, 1, true, string(data))
 
-	ms := []EventMessage{}
+	// publish under this server
+	mqttServerPath := "eventstream/" + es.EventStreamId + "/lastEvent"
+	(*es.MqttClient).Publish(mqttServerPath, 1, true, string(data))
+}
 
-	rows, err := es.Conn.Query(context.Background(),
-		"SELECT id, event_id, COALESCE(creation_time_unix_sec, 0), COALESCE(origin_id, ''), COALESCE(origin_iter, 0), COALESCE(origin_group_id, ''), COALESCE(origin_build_version, ''), COALESCE(destination_id, ''), COALESCE(event_time_unix_sec, 0), COALESCE(event_type, ''), COALESCE(event_subtype, ''), COALESCE(event_version, ''), COALESCE(payload_json, '{}') FROM events WHERE destination_id=$1 AND id > $2 ORDER BY id DESC LIMIT $3",
-		destId,
-		newestId,
-		limit,
-	)
+// GetByEventId returns the event an origin saved with eventId,
+// or ErrEventNotFound
+func (es *EventStream) GetByEventId(ctx context.Context, originId, eventId string) (EventMessage, error) {
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	em, err := es.Store.GetByEventId(ctx, originId, eventId)
 	if err != nil {
-		return ms, err
+		return em, ctxErr(ctx, err)
 	}
-
-	return ParseRows(rows)
+	return es.Keys.Open(em)
 }
 
-// GetByDestinationIdPage
-// use -1 for newestId if you start from zero
-func (es *EventStream) GetByDestinationIdPage(destId string, newestId, lastId, limit int) ([]EventMessage, error) {
+// GetByEventType returns the events of a type across the whole stream
+// use -1 for newestId if you start from zero, and 0 for lastId for the first page
+func (es *EventStream) GetByEventType(ctx context.Context, eventType string, newestId, lastId, limit int) ([]EventMessage, error) {
+	return es.QueryEvents(ctx, EventQuery{
+		EventType: eventType,
+		NewestId:  int64(newestId),
+		LastId:    int64(lastId),
+		Limit:     limit,
+	})
+}
 
-	ms := []EventMessage{}
+// AggregateEvents counts the events of aq in time buckets
+func (es *EventStream) AggregateEvents(ctx context.Context, aq AggregateQuery) ([]AggregateBucket, error) {
+	if err := aq.Check(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	buckets, err := es.Store.AggregateEvents(ctx, aq)
+	return buckets, ctxErr(ctx, err)
+}
 
-	rows, err := es.Conn.Query(context.Background(),
-		"SELECT id, event_id, COALESCE(creation_time_unix_sec, 0), COALESCE(origin_id, ''), COALESCE(origin_iter, 0), COALESCE(origin_group_id, ''), COALESCE(origin_build_version, ''), COALESCE(destination_id, ''), COALESCE(event_time_unix_sec, 0), COALESCE(event_type, ''), COALESCE(event_subtype), COALESCE(event_version, ''), COALESCE(payload_json, '{}') FROM events WHERE destination_id=$1 AND id > $2  AND id < $3 ORDER BY id DESC LIMIT $4",
-		destId,
-		newestId,
-		lastId,
-		limit,
-	)
+// LatestEvents returns the latest event of every event type of the destinations
+func (es *EventStream) LatestEvents(ctx context.Context, destIds []string) ([]EventMessage, error) {
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	ems, err := es.Store.LatestEvents(ctx, destIds)
 	if err != nil {
-		return ms, err
+		return ems, ctxErr(ctx, err)
 	}
-
-	return ParseRows(rows)
+	return es.Keys.OpenAll(ems)
 }
 
-// GetByDestinationIdAndEventType
-// use -1 for newestId if you start from zero
-func (es *EventStream) GetByDestinationIdAndEventType(destId, eventType string, newestId, limit int) ([]EventMessage, error) {
+// UpcastEvents returns the events with the payloads of the events of
+// eventType converted to targetVersion, the other events are returned as
+// they are
+func (es *EventStream) UpcastEvents(ems []EventMessage, eventType, targetVersion string) ([]EventMessage, error) {
+	upcasters := es.Upcasters
+	if upcasters == nil {
+		upcasters = &Upcasters{}
+	}
+	upcast := make([]EventMessage, len(ems))
+	for i := range ems {
+		if ems[i].EventType != eventType {
+			upcast[i] = ems[i]
+			continue
+		}
+		em, err := upcasters.Upcast(ems[i], targetVersion)
+		if err != nil {
+			return ems, err
+		}
+		upcast[i] = em
+	}
+	return upcast, nil
+}
 
-	ms := []EventMessage{}
+// QueryEvents returns the events matching q, from new to old
+func (es *EventStream) QueryEvents(ctx context.Context, q EventQuery) ([]EventMessage, error) {
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	ems, err := es.Store.QueryEvents(ctx, q)
+	if err != nil {
+		return ems, ctxErr(ctx, err)
+	}
+	return es.Keys.OpenAll(ems)
+}
 
-	rows, err := es.Conn.Query(context.Background(),
-		"SELECT id, event_id, COALESCE(creation_time_unix_sec, 0), COALESCE(origin_id, ''), COALESCE(origin_iter, 0), COALESCE(origin_group_id, ''), COALESCE(origin_build_version, ''), COALESCE(destination_id, ''), COALESCE(event_time_unix_sec, 0), COALESCE(event_type, ''), COALESCE(event_subtype, ''), COALESCE(event_version, ''), COALESCE(payload_json, '{}') FROM events WHERE destination_id=$1 AND event_type=$2 AND id > $3 ORDER BY id DESC LIMIT $4",
-		destId,
-		eventType,
-		newestId,
-		limit,
-	)
+// GetByOriginIdSinceIter returns the events sent by an origin with
+// OriginIter > sinceIter, from old to new
+func (es *EventStream) GetByOriginIdSinceIter(ctx context.Context, originId string, sinceIter int64, limit int) ([]EventMessage, error) {
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	ems, err := es.Store.GetByOriginIdSinceIter(ctx, originId, sinceIter, limit)
 	if err != nil {
-		return ms, err
+		return ems, ctxErr(ctx, err)
 	}
+	return es.Keys.OpenAll(ems)
+}
 
-	return ParseRows(rows)
+// GetByDestinationIdSinceIter returns the events of a destination with
+// DestinationIter > sinceIter, from old to new
+func (es *EventStream) GetByDestinationIdSinceIter(ctx context.Context, destId string, sinceIter int64, limit int) ([]EventMessage, error) {
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	ems, err := es.Store.GetByDestinationIdSinceIter(ctx, destId, sinceIter, limit)
+	if err != nil {
+		return ems, ctxErr(ctx, err)
+	}
+	return es.Keys.OpenAll(ems)
 }
 
-// GetByDestinationIdAndEventTypePage
-// use -1 for newestId if you start from zero
-func (es *EventStream) GetByDestinationIdAndEventTypePage(destId, eventType string, newestId, lastId, limit int) ([]EventMessage, error) {
+// GetByOriginGroupId returns the events sent by the origins of a group
+// use -1 for newestId if you start from zero, and 0 for lastId for the first page
+func (es *EventStream) GetByOriginGroupId(ctx context.Context, groupId string, newestId, lastId, limit int) ([]EventMessage, error) {
+	return es.QueryEvents(ctx, EventQuery{
+		OriginGroupId: groupId,
+		NewestId:      int64(newestId),
+		LastId:        int64(lastId),
+		Limit:         limit,
+	})
+}
 
-	ms := []EventMessage{}
+// Ping checks if the store is reachable
+func (es *EventStream) Ping(ctx context.Context) error {
+	ctx, cancel := es.queryContext(ctx)
+	defer cancel()
+	return ctxErr(ctx, es.Store.Ping(ctx))
+}
 
-	rows, err := es.Conn.Query(context.Background(),
-		"SELECT id, event_id, COALESCE(creation_time_unix_sec, 0), COALESCE(origin_id, ''), COALESCE(origin_iter, 0), COALESCE(origin_group_id, ''), COALESCE(origin_build_version, ''), COALESCE(destination_id, ''), COALESCE(event_time_unix_sec, 0), COALESCE(event_type, ''), COALESCE(event_subtype, ''), COALESCE(event_version, ''), COALESCE(payload_json, '{}') FROM events WHERE destination_id=$1 AND event_type=$2 AND id > $3 AND id < $4 ORDER BY id DESC LIMIT $5",
-		destId,
-		eventType,
-		newestId,
-		lastId,
-		limit,
-	)
-	if err != nil {
-		return ms, err
+// queryContext limits ctx to the QueryTimeout
+func (es *EventStream) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if es.QueryTimeout > 0 {
+		return context.WithTimeout(ctx, es.QueryTimeout)
 	}
+	return context.WithCancel(ctx)
+}
 
-	return ParseRows(rows)
+// insertContext limits ctx to the InsertTimeout
+func (es *EventStream) insertContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if es.InsertTimeout > 0 {
+		return context.WithTimeout(ctx, es.InsertTimeout)
+	}
+	return context.WithCancel(ctx)
 }
 
-// getByGroupId
+// ctxErr returns the error of a store call that failed because ctx was
+// canceled or past its deadline wrapping the error of ctx, the drivers do
+// not always wrap it themselves
+func ctxErr(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ctx.Err(), err)
+}
@@ -0,0 +1,129 @@
+package eventstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSaveMessageDuplicate(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			es := &EventStream{Store: store}
+
+			original, err := es.SaveMessage(ctx, testEvent("o1", "e1", `{"level":1}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name      string
+				em        EventMessage
+				id        int64 // 0 for a new event
+				duplicate bool
+			}{
+				{"retry", testEvent("o1", "e1", `{"level":1}`), original.Id, true},
+				{"retry with another payload", testEvent("o1", "e1", `{"level":2}`), original.Id, true},
+				{"same EventId of another origin", testEvent("o2", "e1", `{"level":1}`), 0, false},
+				{"next event", testEvent("o1", "e2", `{"level":1}`), 0, false},
+			}
+			for _, tt := range tests {
+				saved, err := es.SaveMessage(ctx, tt.em)
+				if errors.Is(err, ErrDuplicateEvent) != tt.duplicate || (err != nil && !tt.duplicate) {
+					t.Fatalf("%s: got %v, want duplicate %v", tt.name, err, tt.duplicate)
+				}
+				if tt.duplicate && (saved.Id != tt.id || string(saved.PayloadJson) != `{"level":1}` || saved.OriginIter != 1) {
+					t.Errorf("%s: got event %d %s at iter %d, want the original", tt.name, saved.Id, saved.PayloadJson, saved.OriginIter)
+				}
+				if !tt.duplicate && saved.Id == original.Id {
+					t.Errorf("%s: saved with the Id of the original", tt.name)
+				}
+			}
+
+			events, err := store.QueryEvents(ctx, EventQuery{OriginId: "o1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 2 {
+				t.Errorf("got %d events of o1, want 2", len(events))
+			}
+
+			// a batch skips the duplicates, also of an earlier event in the batch
+			results, err := es.SaveMessages(ctx, []EventMessage{
+				testEvent("o1", "e2", `{}`),
+				testEvent("o1", "e3", `{}`),
+				testEvent("o1", "e3", `{}`),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range []bool{true, false, true} {
+				if errors.Is(results[i].Err, ErrDuplicateEvent) != want {
+					t.Errorf("batch event %d: got %v, want duplicate %v", i, results[i].Err, want)
+				}
+			}
+			if results[2].Event.Id != results[1].Event.Id {
+				t.Errorf("the duplicate in the batch got Id %d, want %d", results[2].Event.Id, results[1].Event.Id)
+			}
+		})
+	}
+}
+
+func TestSaveMessageItersWithoutGaps(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			es := &EventStream{Store: store}
+
+			// two origins post to one destination at the same time, with
+			// retries in between
+			const perOrigin = 50
+			wg := sync.WaitGroup{}
+			for _, originId := range []string{"o1", "o2"} {
+				for i := 0; i < perOrigin; i++ {
+					wg.Add(1)
+					go func(originId string, i int) {
+						defer wg.Done()
+						em := testEvent(originId, fmt.Sprint("e", i), `{}`)
+						em.DestinationId = "d1"
+						for retry := 0; retry < 2; retry++ {
+							if _, err := es.SaveMessage(ctx, em); err != nil && !errors.Is(err, ErrDuplicateEvent) {
+								t.Error(err)
+							}
+						}
+					}(originId, i)
+				}
+			}
+			wg.Wait()
+
+			checkIters(t, "destination d1", 2*perOrigin, func() ([]EventMessage, error) {
+				return store.GetByDestinationIdSinceIter(ctx, "d1", 0, 1000)
+			}, func(em *EventMessage) int64 { return em.DestinationIter })
+			for _, originId := range []string{"o1", "o2"} {
+				checkIters(t, "origin "+originId, perOrigin, func() ([]EventMessage, error) {
+					return store.GetByOriginIdSinceIter(ctx, originId, 0, 1000)
+				}, func(em *EventMessage) int64 { return em.OriginIter })
+			}
+		})
+	}
+}
+
+// checkIters checks that the events of get are numbered 1 up to n by iter
+func checkIters(t *testing.T, stream string, n int, get func() ([]EventMessage, error), iter func(em *EventMessage) int64) {
+	t.Helper()
+	events, err := get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != n {
+		t.Fatalf("%s has %d events, want %d", stream, len(events), n)
+	}
+	for i := range events {
+		if iter(&events[i]) != int64(i+1) {
+			t.Fatalf("%s: event %d has iter %d, want %d", stream, i, iter(&events[i]), i+1)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package eventstream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// upcasting of events on read
+//
+// The origins run different builds, so the same EventType is saved in
+// several EventVersions. An upcaster converts the payload of one version to
+// the next, and the upcasters of a type are chained to convert an old event
+// to the version a consumer asks for. Only the returned copy is converted,
+// the saved event is never changed.
+
+// ErrNoUpcaster is returned when there is no chain of upcasters from the
+// version of an event to the target version
+var ErrNoUpcaster = errors.New("no upcaster")
+
+// UpcastFunc converts a payload to the next version, the payload is decoded
+// with json.Number for the numbers, it can be changed in place
+type UpcastFunc func(payload interface{}) (interface{}, error)
+
+// Upcasters are the registered upcasters per EventType and EventVersion
+type Upcasters struct {
+	sync.RWMutex
+
+	steps map[schemaKey]upcastStep // from the type and version it converts
+}
+
+type upcastStep struct {
+	toVersion string
+	upcast    UpcastFunc
+}
+
+// Register adds the upcaster of eventType from fromVersion to toVersion,
+// a version can only be converted by one upcaster
+func (u *Upcasters) Register(eventType, fromVersion, toVersion string, upcast UpcastFunc) error {
+	if eventType == "" || fromVersion == "" || toVersion == "" {
+		return errors.New("upcaster needs an EventType, a from and a to version")
+	}
+	if fromVersion == toVersion {
+		return fmt.Errorf("upcaster of %s converts version %s to itself", eventType, fromVersion)
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	if u.steps == nil {
+		u.steps = make(map[schemaKey]upcastStep)
+	}
+	key := schemaKey{eventType, fromVersion}
+	if step, ok := u.steps[key]; ok {
+		return fmt.Errorf("%s version %s already has an upcaster to version %s", eventType, fromVersion, step.toVersion)
+	}
+	u.steps[key] = upcastStep{toVersion: toVersion, upcast: upcast}
+	return nil
+}
+
+// Upcast returns a copy of em with its payload converted to targetVersion
+func (u *Upcasters) Upcast(em EventMessage, targetVersion string) (EventMessage, error) {
+	if em.EventVersion == targetVersion {
+		return em, nil
+	}
+
+	u.RLock()
+	defer u.RUnlock()
+
+	payload, err := decodePayload(em.PayloadJson)
+	if err != nil {
+		return em, fmt.Errorf("upcast of event %d: %w", em.Id, err)
+	}
+	version := em.EventVersion
+	for steps := 0; version != targetVersion; steps++ {
+		step, ok := u.steps[schemaKey{em.EventType, version}]
+		// more steps than upcasters is a cycle
+		if !ok || steps > len(u.steps) {
+			return em, fmt.Errorf("%w from %s version %s to %s", ErrNoUpcaster, em.EventType, em.EventVersion, targetVersion)
+		}
+		payload, err = step.upcast(payload)
+		if err != nil {
+			return em, fmt.Errorf("upcast of event %d from %s version %s to %s: %w", em.Id, em.EventType, version, step.toVersion, err)
+		}
+		version = step.toVersion
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return em, fmt.Errorf("upcast of event %d: %w", em.Id, err)
+	}
+	em.PayloadJson = data
+	em.EventVersion = targetVersion
+	return em, nil
+}
+
+// RenameField is an UpcastFunc that renames a key of an object payload
+func RenameField(from, to string) UpcastFunc {
+	return func(payload interface{}) (interface{}, error) {
+		object, ok := payload.(map[string]interface{})
+		if !ok {
+			return payload, errors.New("payload is not an object")
+		}
+		if value, ok := object[from]; ok {
+			object[to] = value
+			delete(object, from)
+		}
+		return object, nil
+	}
+}
+
+// DefaultField is an UpcastFunc that adds a key that is new in the next
+// version to an object payload, if it is not there yet
+func DefaultField(key string, value interface{}) UpcastFunc {
+	return func(payload interface{}) (interface{}, error) {
+		object, ok := payload.(map[string]interface{})
+		if !ok {
+			return payload, errors.New("payload is not an object")
+		}
+		if _, ok := object[key]; !ok {
+			object[key] = value
+		}
+		return object, nil
+	}
+}
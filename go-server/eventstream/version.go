@@ -0,0 +1,50 @@
+package eventstream
+
+import (
+	"context"
+	"fmt"
+)
+
+// optimistic concurrency of the destinations
+//
+// A destination used as an event-sourced aggregate, such as a mission plan
+// edited from several UIs, has as version its last DestinationIter, 0
+// before its first event. A writer that read the destination at a version
+// saves its next event with SaveExpected and that version. The stores check
+// it while they hold the lock of the iter of the destination, so when
+// another event was saved to the destination in the meantime the event is
+// refused with a *VersionError, and the writer can read the new events and
+// try again, instead of interleaving silently.
+//
+// A retry of an event that was already saved is still a duplicate, with the
+// original, also when the destination moved on since.
+
+// VersionError is the error of an event saved with SaveExpected to a
+// destination that is at another version
+type VersionError struct {
+	DestinationId   string
+	ExpectedVersion int64
+	Version         int64 // the last DestinationIter of the destination
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("destination %s is at version %d, not at the expected version %d", e.DestinationId, e.Version, e.ExpectedVersion)
+}
+
+// SaveExpected saves em like SaveMessage, if its destination is still at
+// expectedVersion, and otherwise returns a *VersionError
+func (es *EventStream) SaveExpected(ctx context.Context, em EventMessage, expectedVersion int64) (EventMessage, error) {
+	em.expectVersion = true
+	em.expectedVersion = expectedVersion
+	return es.SaveMessage(ctx, em)
+}
+
+// checkVersion checks the expected version of em against version, the
+// current version of its destination, the caller holds the lock of the iter
+// of the destination
+func checkVersion(em EventMessage, version int64) error {
+	if !em.expectVersion || em.expectedVersion == version {
+		return nil
+	}
+	return &VersionError{DestinationId: em.DestinationId, ExpectedVersion: em.expectedVersion, Version: version}
+}
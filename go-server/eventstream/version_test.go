@@ -0,0 +1,52 @@
+package eventstream
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSaveExpected(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			es := &EventStream{Store: store}
+
+			steps := []struct {
+				eventId  string
+				expected int64
+				version  int64 // of the VersionError, 0 if the event is saved
+				iter     int64
+			}{
+				{"e1", 0, 0, 1},
+				{"e2", 0, 1, 0},
+				{"e2", 1, 0, 2},
+				{"e3", 1, 2, 0},
+				{"e3", 5, 2, 0},
+				{"e3", 2, 0, 3},
+			}
+			for _, step := range steps {
+				saved, err := es.SaveExpected(ctx, testEvent("o1", step.eventId, `{}`), step.expected)
+				versionErr := &VersionError{}
+				if step.version > 0 {
+					if !errors.As(err, &versionErr) || versionErr.Version != step.version {
+						t.Fatalf("%s at %d: got %v, want version %d", step.eventId, step.expected, err, step.version)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s at %d: %v", step.eventId, step.expected, err)
+				}
+				if saved.DestinationIter != step.iter {
+					t.Fatalf("%s saved with DestinationIter %d, want %d", step.eventId, saved.DestinationIter, step.iter)
+				}
+			}
+
+			// a retry is a duplicate, also at a version that is not current
+			saved, err := es.SaveExpected(ctx, testEvent("o1", "e1", `{}`), 0)
+			if !errors.Is(err, ErrDuplicateEvent) || saved.DestinationIter != 1 {
+				t.Fatalf("retry of e1: got %v with DestinationIter %d, want the duplicate at 1", err, saved.DestinationIter)
+			}
+		})
+	}
+}
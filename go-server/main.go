@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -13,6 +15,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/kexxu-robotics/kex-stream-server/go-server/eventstream"
@@ -31,6 +35,8 @@ type Conf struct {
 	StaticPath    string
 	ApiPass       string
 	EventStreamId string
+	Store         string // postgres (default), sqlite or memory
+	AutoMigrate   bool   // apply pending database migrations on startup
 
 	Postgres struct {
 		Host     string
@@ -39,6 +45,76 @@ type Conf struct {
 		Password string
 	}
 
+	// use with store: sqlite, in place of the Postgres block
+	Sqlite struct {
+		Path string
+	}
+
+	// only used by the memory store, which has no origins table
+	Memory struct {
+		Origins []struct {
+			Id         string
+			PassHash   string
+			OwnerEmail string
+			PublicKey  string
+		}
+	}
+
+	// deadlines of the database calls of a request, a request that runs out
+	// of time gets a 504
+	Timeouts struct {
+		QueryMs  int
+		InsertMs int
+	}
+
+	// group commit of concurrent addEvent calls, off when windowms is 0
+	WriteBatch struct {
+		WindowMs  int
+		MaxEvents int
+	}
+
+	// delete old events, the first rule that matches an event decides,
+	// see eventstream.Retention, no rules keeps all events forever
+	Retention struct {
+		IntervalMin int
+		BatchSize   int
+		Rules       []eventstream.RetentionRule
+	}
+
+	// time partitions of the events table, only for store: postgres
+	Partitions struct {
+		IntervalDays int
+		Ahead        int
+		Detach       bool
+	}
+
+	// directory of the archives of /api/archive, empty turns the endpoints off
+	Archive struct {
+		Path string
+	}
+
+	// payload validation, the schemas are managed through /api/schemas
+	Schemas struct {
+		DefaultMode string // of the event types without a mode: enforce (default), warn or off
+	}
+
+	// encryption at rest of the payloads, see eventstream.PayloadKeys
+	Encryption struct {
+		KeyId string         // the key new payloads are encrypted with, empty saves them in plain text
+		Keys  payloadKeyConf // base64 of 32 random bytes by key id, keep the old keys
+	}
+
+	// compression of the large payloads, see eventstream.PayloadCompression
+	Compression struct {
+		Codec    string // zstd or gzip, empty does not compress
+		MinBytes int    // the payloads of at least MinBytes are compressed, default 4096
+	}
+
+	// hash chain of the events, see eventstream.ChainLink
+	Chain struct {
+		Scope string // destination or global, empty does not chain the events
+	}
+
 	Mqtt struct {
 		Enabled          bool
 		Username         string
@@ -51,6 +127,19 @@ type Conf struct {
 	}
 }
 
+// payloadKeyConf are the master keys of the payload encryption by key id,
+// only the ids are printed with the conf
+type payloadKeyConf map[string]string
+
+func (keys payloadKeyConf) String() string {
+	keyIds := []string{}
+	for keyId := range keys {
+		keyIds = append(keyIds, keyId)
+	}
+	sort.Strings(keyIds)
+	return fmt.Sprint(keyIds)
+}
+
 func getLetsEncryptCert(certManager *autocert.Manager) func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		dirCache, ok := certManager.Cache.(autocert.DirCache)
@@ -112,12 +201,41 @@ func checkAuthorizedHandler(h http.Handler) http.Handler {
 	})
 }
 
+// archiveDir returns the directory of the archive <name> in the archive path,
+// if the name is not a plain directory name it writes the error
+func archiveDir(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := r.FormValue("name")
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		http.Error(w, "name must be the directory name of the archive", 400)
+		return "", false
+	}
+	return filepath.Join(conf.Archive.Path, name), true
+}
+
 var mqttDefaultPublish mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
 	fmt.Printf("MQTT TOPIC: %s MSG: %s\n", msg.Topic(), msg.Payload())
 }
 
 var conf Conf
 
+func connectPostgres() *pgxpool.Pool {
+	dbUrl := fmt.Sprint(conf.Postgres.Host, conf.Postgres.Db, "?user=", conf.Postgres.User, "&password=", conf.Postgres.Password)
+	conn, err := pgxpool.Connect(context.Background(), dbUrl)
+	if err != nil {
+		panic(fmt.Sprintln("ERROR! cannot connect to Postgresql", err))
+	}
+
+	// test postgres connection
+	var postgresTest string
+	err = conn.QueryRow(context.Background(), "select 'Postgres connected'").Scan(&postgresTest)
+	if err != nil {
+		panic(fmt.Sprintln("ERROR! test call to Postgresql failed", err))
+	}
+	fmt.Println(postgresTest)
+
+	return conn
+}
+
 func main() {
 	fmt.Println("Kexxu Event Streaming Server")
 
@@ -136,44 +254,94 @@ func main() {
 		panic("ERROR! you cannot continue with static path not set to a subfolder, else you will be exposing valuable system files")
 	}
 
-	// connect to
-	dbUrl := fmt.Sprint(conf.Postgres.Host, conf.Postgres.Db, "?user=", conf.Postgres.User, "&password=", conf.Postgres.Password)
-	conn, err := pgxpool.Connect(context.Background(), dbUrl)
-	if err != nil {
-		panic(fmt.Sprintln("ERROR! cannot connect to Postgresql", err))
+	// init the event store
+	var store eventstream.EventStore
+	var originStore eventstream.OriginStore
+	switch conf.Store {
+	case "", "postgres":
+		conn := connectPostgres()
+		defer conn.Close()
+		pgStore := &eventstream.PostgresStore{Conn: conn}
+		store, originStore = pgStore, pgStore
+	case "sqlite":
+		sqliteStore, err := eventstream.OpenSQLiteStore(conf.Sqlite.Path)
+		if err != nil {
+			panic(fmt.Sprintln("ERROR! cannot open SQLite database", conf.Sqlite.Path, err))
+		}
+		defer sqliteStore.Close()
+		fmt.Println("SQLite opened", conf.Sqlite.Path)
+		store, originStore = sqliteStore, sqliteStore
+	case "memory":
+		fmt.Println("WARNING! using the memory store, events are lost when the server stops")
+		memStore := &eventstream.MemoryStore{}
+		for _, origin := range conf.Memory.Origins {
+			memStore.AddOrigin(origin.Id, origin.PassHash, origin.OwnerEmail, origin.PublicKey)
+		}
+		store, originStore = memStore, memStore
+	default:
+		panic(fmt.Sprint("ERROR! unknown store '", conf.Store, "' in conf"))
 	}
-	defer conn.Close()
 
-	// test postgres connection
-	var postgresTest string
-	err = conn.QueryRow(context.Background(), "select 'Postgres connected'").Scan(&postgresTest)
-	if err != nil {
-		panic(fmt.Sprintln("ERROR! test call to Postgresql failed", err))
+	// subcommands instead of the server, e.g. ./go-server migrate status
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:], store)
+		return
+	}
+
+	// make sure the database schema is up to date
+	if migrator, ok := store.(eventstream.Migrator); ok {
+		checkMigrations(migrator)
 	}
-	fmt.Println(postgresTest)
 
 	// tests to check the server is running
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/test", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "OK")
 	}))
+
+	// init eventStream
+	eventStream := eventstream.EventStream{
+		Store:          store,
+		EventStreamId:  conf.EventStreamId,
+		BatchWindow:    time.Duration(conf.WriteBatch.WindowMs) * time.Millisecond,
+		BatchMaxEvents: conf.WriteBatch.MaxEvents,
+		QueryTimeout:   time.Duration(conf.Timeouts.QueryMs) * time.Millisecond,
+		InsertTimeout:  time.Duration(conf.Timeouts.InsertMs) * time.Millisecond,
+	}
+	if eventStream.QueryTimeout <= 0 {
+		eventStream.QueryTimeout = 10 * time.Second
+	}
+	if eventStream.InsertTimeout <= 0 {
+		eventStream.InsertTimeout = 5 * time.Second
+	}
+	keys, err := payloadKeys()
+	if err != nil {
+		panic(fmt.Sprintln("ERROR! invalid encryption in conf", err))
+	}
+	if keys.Encrypted() {
+		eventStream.Keys = keys
+	}
+	compression, err := payloadCompression()
+	if err != nil {
+		panic(fmt.Sprintln("ERROR! invalid compression in conf", err))
+	}
+	if compression.Compressed() {
+		eventStream.Compression = compression
+	}
+	if err := eventstream.CheckChainScope(conf.Chain.Scope); err != nil {
+		panic(fmt.Sprintln("ERROR! invalid chain in conf", err))
+	}
+	eventStream.ChainScope = conf.Chain.Scope
+
 	// test to check the database connection is working
 	mux.HandleFunc("/api/testDb", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
-		var postgresTest string
-		err = conn.QueryRow(context.Background(), "select 'OK'").Scan(&postgresTest)
-		if err != nil {
-			fmt.Fprint(w, "ERROR! test call to Postgresql failed")
+		if err := eventStream.Ping(r.Context()); err != nil {
+			fmt.Fprint(w, "ERROR! test call to the database failed")
 			return
 		}
 		fmt.Fprint(w, "OK")
 	}))
 
-	// init eventStream
-	eventStream := eventstream.EventStream{
-		Conn:          conn,
-		EventStreamId: conf.EventStreamId,
-	}
-
 	// init mqtt
 	if conf.Mqtt.Enabled {
 		// https://github.com/eclipse/paho.mqtt.golang/blob/master/cmd/simple/main.go
@@ -213,23 +381,298 @@ func main() {
 	// this prevents origins spamming the service
 	// and unknown origins from making requests
 	originSecure := eventstream.Secure{
-		Conn:              conn,
-		MaxRequestsPerMin: 60,
+		Store:                 originStore,
+		MaxRequestsPerMin:     60,
+		BatchEventsPerRequest: 100,
+		QueryTimeout:          eventStream.QueryTimeout,
 	}
 	go originSecure.ReloadOriginsChron()
+	eventStream.PublicKeys = &originSecure
+
+	// init the pruning of expired events
+	retention := eventstream.Retention{
+		Store:     store,
+		Rules:     conf.Retention.Rules,
+		Interval:  time.Duration(conf.Retention.IntervalMin) * time.Minute,
+		BatchSize: conf.Retention.BatchSize,
+
+		QueryTimeout: eventStream.QueryTimeout,
+	}
+	if retention.Interval <= 0 {
+		retention.Interval = time.Hour
+	}
+	if retention.BatchSize == 0 {
+		retention.BatchSize = 1000
+	}
+	if err := retention.CheckRules(); err != nil {
+		panic(fmt.Sprintln("ERROR! invalid retention in conf", err))
+	}
+	if len(retention.Rules) > 0 {
+		go retention.PruneChron()
+
+		// what the last prune run removed
+		mux.HandleFunc("/api/retention", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			js, _ := json.Marshal(retention.Report())
+			w.Write(js)
+		}))
+	}
+
+	// init the time partitions, expired partitions are removed as a whole
+	if partitioner, ok := store.(eventstream.Partitioner); ok {
+		partitionConf := eventstream.PartitionConf{
+			IntervalDays: conf.Partitions.IntervalDays,
+			Ahead:        conf.Partitions.Ahead,
+			Detach:       conf.Partitions.Detach,
+			Timeout:      time.Minute,
+		}
+		if partitionConf.IntervalDays <= 0 {
+			partitionConf.IntervalDays = 7
+		}
+		if partitionConf.Ahead <= 0 {
+			partitionConf.Ahead = 2
+		}
+		go eventstream.PartitionsChron(partitioner, partitionConf, retention.MaxAgeDays(), retention.Interval)
+	}
+
+	// export and import of archives, see eventstream.ExportArchive
+	if conf.Archive.Path != "" {
+		mux.HandleFunc("/api/archive/export", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			dir, ok := archiveDir(w, r)
+			if !ok {
+				return
+			}
+			ar, segmentEvents, err := parseArchiveRange(r.FormValue)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			manifest, err := eventstream.ExportArchive(r.Context(), store, conf.EventStreamId, dir, ar, segmentEvents)
+			if err != nil {
+				fmt.Println("ERROR! archive export failed", err)
+				http.Error(w, "archive export failed", http.StatusInternalServerError)
+				return
+			}
+			js, _ := json.Marshal(&manifest)
+			w.Write(js)
+		}))
+		mux.HandleFunc("/api/archive/import", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			dir, ok := archiveDir(w, r)
+			if !ok {
+				return
+			}
+			report, err := eventstream.ImportArchive(r.Context(), store, dir)
+			if err != nil {
+				fmt.Println("ERROR! archive import failed", err)
+				http.Error(w, fmt.Sprint("archive import failed, ", report.Restored, " events restored"), http.StatusInternalServerError)
+				return
+			}
+			js, _ := json.Marshal(&report)
+			w.Write(js)
+		}))
+	}
+
+	// erasure of the personal data of an origin or of all origins of an owner,
+	// the events stay as tombstones, see eventstream.Eraser
+	if eraser, ok := store.(eventstream.Eraser); ok {
+		// originId or ownerEmail, by, reason (optional), path (optional, repeatable, only removes that payload path, e.g. gps.lat)
+		mux.HandleFunc("/api/erasures/erase", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "an erasure has to be posted", http.StatusMethodNotAllowed)
+				return
+			}
+			req := eventstream.ErasureRequest{
+				OriginId:   r.FormValue("originId"),
+				OwnerEmail: r.FormValue("ownerEmail"),
+				By:         r.FormValue("by"),
+				Reason:     r.FormValue("reason"),
+			}
+			for _, path := range r.Form["path"] {
+				req.Paths = append(req.Paths, strings.Split(path, "."))
+			}
+			if err := req.Check(); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			erasure, err := eraser.EraseEvents(r.Context(), req)
+			if errors.Is(err, eventstream.ErrPayloadEncrypted) || errors.Is(err, eventstream.ErrPayloadCompressed) {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if err != nil {
+				fmt.Println("ERROR! erasure failed", err)
+				http.Error(w, "erasure failed", http.StatusInternalServerError)
+				return
+			}
+			fmt.Println("erased", erasure.Events, "events of", erasure.OriginIds, "by", erasure.By)
+			js, _ := json.Marshal(&erasure)
+			w.Write(js)
+		}))
+		// the audit of all erasures
+		mux.HandleFunc("/api/erasures", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			erasures, err := eraser.Erasures(r.Context())
+			if err != nil {
+				fmt.Println("ERROR! cannot load the erasures", err)
+				http.Error(w, "error loading erasures", http.StatusInternalServerError)
+				return
+			}
+			js, _ := json.Marshal(erasures)
+			w.Write(js)
+		}))
+	}
+
+	// the storage of the payloads per codec, to see what the compression saves
+	if statsStore, ok := store.(eventstream.PayloadStatsStore); ok {
+		mux.HandleFunc("/api/stats/payloads", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			stats, err := statsStore.PayloadStats(r.Context())
+			if err != nil {
+				fmt.Println("ERROR! cannot load the payload stats", err)
+				http.Error(w, "error loading payload stats", http.StatusInternalServerError)
+				return
+			}
+			js, _ := json.Marshal(stats)
+			w.Write(js)
+		}))
+	}
+
+	// the hash chains of the events, a copy of the heads kept elsewhere shows
+	// if a chain was rewritten, see eventstream.VerifyChain
+	if chainStore, ok := store.(eventstream.ChainStore); ok {
+		mux.HandleFunc("/api/chains", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			heads, err := chainStore.ChainHeads(r.Context())
+			if err != nil {
+				fmt.Println("ERROR! cannot load the chain heads", err)
+				http.Error(w, "error loading chain heads", http.StatusInternalServerError)
+				return
+			}
+			js, _ := json.Marshal(heads)
+			w.Write(js)
+		}))
+		// chainId, fromSeq (optional), toSeq (optional, default the head)
+		mux.HandleFunc("/api/chains/verify", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			fromSeq, toSeq, err := parseChainRange(r.FormValue)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			report, err := eventstream.VerifyChain(r.Context(), chainStore, eventStream.Keys, r.FormValue("chainId"), fromSeq, toSeq)
+			if errors.Is(err, eventstream.ErrUnknownChain) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println("ERROR! chain verification failed", err)
+				http.Error(w, "chain verification failed", http.StatusInternalServerError)
+				return
+			}
+			js, _ := json.Marshal(&report)
+			w.Write(js)
+		}))
+	}
+
+	// init the schema registry, the payloads of the event types with a
+	// schema are validated before they are saved
+	if schemaStore, ok := store.(eventstream.SchemaStore); ok {
+		schemas := eventstream.SchemaRegistry{
+			Store:        schemaStore,
+			DefaultMode:  conf.Schemas.DefaultMode,
+			QueryTimeout: eventStream.QueryTimeout,
+		}
+		if schemas.DefaultMode == "" {
+			schemas.DefaultMode = eventstream.SchemaEnforce
+		}
+		if err := eventstream.CheckSchemaMode(schemas.DefaultMode); err != nil {
+			panic(fmt.Sprintln("ERROR! invalid schemas in conf", err))
+		}
+		if err := schemas.Reload(context.Background()); err != nil {
+			panic(fmt.Sprintln("ERROR! cannot load the event schemas", err))
+		}
+		go schemas.ReloadChron()
+		eventStream.Schemas = &schemas
+
+		mux.HandleFunc("/api/schemas", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			registered, modes := schemas.Schemas()
+			js, _ := json.Marshal(struct {
+				Schemas     []eventstream.EventSchema
+				Modes       map[string]string
+				DefaultMode string
+			}{registered, modes, schemas.DefaultMode})
+			w.Write(js)
+		}))
+		// eventType, eventVersion, body: the JSON Schema of the payload
+		mux.HandleFunc("/api/schemas/add", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "the schema is posted in the body", http.StatusMethodNotAllowed)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, 1*1024*1024) // max 1mb
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "error", http.StatusInternalServerError)
+				return
+			}
+			err = schemas.AddSchema(r.Context(), eventstream.EventSchema{
+				EventType:    r.FormValue("eventType"),
+				EventVersion: r.FormValue("eventVersion"),
+				Schema:       data,
+			})
+			if err != nil {
+				fmt.Println("ERROR! cannot add schema", err)
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			fmt.Fprint(w, "OK")
+		}))
+		// eventType, eventVersion
+		mux.HandleFunc("/api/schemas/delete", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			err := schemas.DeleteSchema(r.Context(), r.FormValue("eventType"), r.FormValue("eventVersion"))
+			if errors.Is(err, eventstream.ErrSchemaNotFound) {
+				http.Error(w, "schema not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				fmt.Println("ERROR! cannot delete schema", err)
+				http.Error(w, "error deleting schema", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, "OK")
+		}))
+		// eventType, mode (enforce, warn or off)
+		mux.HandleFunc("/api/schemas/mode", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
+			if err := schemas.SetMode(r.Context(), r.FormValue("eventType"), r.FormValue("mode")); err != nil {
+				fmt.Println("ERROR! cannot set schema mode", err)
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			fmt.Fprint(w, "OK")
+		}))
+	}
+
+	// conversions of old EventVersions on read, see upcasters.go
+	upcasters := eventstream.Upcasters{}
+	if err := registerUpcasters(&upcasters); err != nil {
+		panic(fmt.Sprintln("ERROR! invalid upcaster", err))
+	}
+	eventStream.Upcasters = &upcasters
 
 	// init eventstream handler
 	eventsHandler := eventstream.Handler{
 		BaseUrl:     conf.BaseUrl,
 		StaticPath:  conf.StaticPath,
-		Conn:        conn,
 		Secure:      &originSecure,
 		EventStream: &eventStream,
+		ApiPass:     conf.ApiPass,
 	}
 
 	// eventstream endpoints
 	mux.HandleFunc("/api/eventstream/addEvent", eventsHandler.AddEvent)
-	mux.HandleFunc("/api/eventstream/getOriginEvents", eventsHandler.GetOriginEvents) // id, newestId (optional, to cap below id), lastId (optional, for pagination), limit (hard limit set at 10k)
+	mux.HandleFunc("/api/eventstream/addEvents", eventsHandler.AddEvents)             // id, destId (optional), body: JSON array or NDJSON of events
+	mux.HandleFunc("/api/eventstream/getOriginEvents", eventsHandler.GetOriginEvents) // id, newestId (optional, to cap below id), lastId (optional, for pagination), limit (hard limit set at 10k), sinceIter or sinceOriginIter (optional, from old to new), filters of queryEvents (optional), targetVersion (optional, with eventType)
+	mux.HandleFunc("/api/eventstream/getEvent", eventsHandler.GetEvent)               // id, eventId, originId (optional, defaults to id), targetVersion (optional, with eventType)
+	mux.HandleFunc("/api/eventstream/getTypeEvents", eventsHandler.GetTypeEvents)     // pass, eventType, newestId, lastId, limit (optional, as getOriginEvents), targetVersion (optional)
+	mux.HandleFunc("/api/eventstream/getGroupEvents", eventsHandler.GetGroupEvents)   // pass, groupId, newestId, lastId, limit (optional, as getOriginEvents), targetVersion (optional, with eventType)
+	mux.HandleFunc("/api/eventstream/getLatestEvents", eventsHandler.GetLatestEvents) // id, destIds (optional, comma separated, default id, others than id need pass), targetVersion (optional, with eventType)
+	mux.HandleFunc("/api/eventstream/aggregateEvents", eventsHandler.AggregateEvents) // id, bucket (minute, hour or day), from, to, time (optional, creation or event), groupBy (optional, originId,eventSubtype), value (optional, payload path), filters of queryEvents (optional)
+	mux.HandleFunc("/api/eventstream/queryEvents", eventsHandler.QueryEvents)         // id, originId, groupId, eventType, eventSubtype, eventVersion, originBuildVersion, eventTimeFrom, eventTimeTo, creationTimeFrom, creationTimeTo, payload (repeatable), newestId, lastId, limit, targetVersion (all optional, targetVersion with eventType)
 
 	// mqtt very basic initial implementation
 	mux.HandleFunc("/api/mqtt/server", checkAuthorized(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/kexxu-robotics/kex-stream-server/go-server/eventstream"
+)
+
+// registerUpcasters adds the conversions between the EventVersions of the
+// event types, consumers get a single version with targetVersion=<version>
+// and eventType=<type>, for example:
+//
+//	// version 2 of status renamed batt to batteryLevel
+//	upcasters.Register("status", "1", "2", eventstream.RenameField("batt", "batteryLevel"))
+//	// version 3 added the mode
+//	upcasters.Register("status", "2", "3", eventstream.DefaultField("mode", "auto"))
+func registerUpcasters(upcasters *eventstream.Upcasters) error {
+	return nil
+}